@@ -0,0 +1,126 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Condition types reported on an AnnotatorStatus.
+const (
+	// ConditionReady is true when rules are loaded and every Ingress is up to date.
+	ConditionReady = "Ready"
+	// ConditionProgressing is true while Ingresses are pending the current rules.
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded is true when Ingresses failed, reference unknown rules,
+	// or the rules ConfigMap could not be read.
+	ConditionDegraded = "Degraded"
+)
+
+// AnnotatorStatusSpec is empty; the object only carries status.
+type AnnotatorStatusSpec struct{}
+
+// IngressCounts counts Ingresses by how far they are in applying the current rules.
+type IngressCounts struct {
+	// Total is the number of Ingresses in the cluster.
+	Total int32 `json:"total"`
+	// UpToDate Ingresses were last reconciled with the current rules generation.
+	UpToDate int32 `json:"upToDate"`
+	// Pending Ingresses have not been reconciled with the current rules generation yet.
+	Pending int32 `json:"pending"`
+	// Failed Ingresses could not be reconciled.
+	Failed int32 `json:"failed"`
+}
+
+// IngressReference names an Ingress and the rules it references that are not defined.
+type IngressReference struct {
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Rules     []string `json:"rules"`
+}
+
+// StagedRules summarizes the preview of the staged rules.
+type StagedRules struct {
+	// Generation is the digest of the staged rules.
+	Generation string `json:"generation"`
+	// ChangedIngresses is the number of Ingresses that promoting the staged
+	// rules would change.
+	ChangedIngresses int32 `json:"changedIngresses"`
+}
+
+// AnnotatorStatusStatus summarizes the rollout of the current rules.
+type AnnotatorStatusStatus struct {
+	// RulesGeneration is the digest of the rules currently loaded.
+	// +optional
+	RulesGeneration string `json:"rulesGeneration,omitempty"`
+
+	// Ingresses counts Ingresses by rollout state.
+	// +optional
+	Ingresses IngressCounts `json:"ingresses,omitempty"`
+
+	// UnknownRuleReferences lists Ingresses referencing rules that are not
+	// defined, directly or through their Namespace.
+	// +optional
+	UnknownRuleReferences []IngressReference `json:"unknownRuleReferences,omitempty"`
+
+	// UnusedRules lists rules that no Ingress references.
+	// +optional
+	UnusedRules []string `json:"unusedRules,omitempty"`
+
+	// StagedRules is set while the rules ConfigMap holds staged rules.
+	// +optional
+	StagedRules *StagedRules `json:"stagedRules,omitempty"`
+
+	// Conditions are Ready, Progressing and Degraded.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Generation",type=string,JSONPath=`.status.rulesGeneration`
+// +kubebuilder:printcolumn:name="Up-to-date",type=integer,JSONPath=`.status.ingresses.upToDate`
+// +kubebuilder:printcolumn:name="Pending",type=integer,JSONPath=`.status.ingresses.pending`
+// +kubebuilder:printcolumn:name="Failed",type=integer,JSONPath=`.status.ingresses.failed`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// AnnotatorStatus reports the progress of applying the rules to Ingresses. The
+// annotator maintains a single AnnotatorStatus named after the rules ConfigMap,
+// in the same namespace.
+type AnnotatorStatus struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   AnnotatorStatusSpec   `json:"spec,omitempty"`
+	Status AnnotatorStatusStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// AnnotatorStatusList contains a list of AnnotatorStatus
+type AnnotatorStatusList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []AnnotatorStatus `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&AnnotatorStatus{}, &AnnotatorStatusList{})
+}
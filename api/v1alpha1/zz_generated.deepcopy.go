@@ -0,0 +1,190 @@
+//go:build !ignore_autogenerated
+
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Code generated by controller-gen. DO NOT EDIT.
+
+package v1alpha1
+
+import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+)
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AnnotatorStatus) DeepCopyInto(out *AnnotatorStatus) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
+	in.Status.DeepCopyInto(&out.Status)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AnnotatorStatus.
+func (in *AnnotatorStatus) DeepCopy() *AnnotatorStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(AnnotatorStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *AnnotatorStatus) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AnnotatorStatusList) DeepCopyInto(out *AnnotatorStatusList) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ListMeta.DeepCopyInto(&out.ListMeta)
+	if in.Items != nil {
+		in, out := &in.Items, &out.Items
+		*out = make([]AnnotatorStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AnnotatorStatusList.
+func (in *AnnotatorStatusList) DeepCopy() *AnnotatorStatusList {
+	if in == nil {
+		return nil
+	}
+	out := new(AnnotatorStatusList)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *AnnotatorStatusList) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AnnotatorStatusSpec) DeepCopyInto(out *AnnotatorStatusSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AnnotatorStatusSpec.
+func (in *AnnotatorStatusSpec) DeepCopy() *AnnotatorStatusSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(AnnotatorStatusSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AnnotatorStatusStatus) DeepCopyInto(out *AnnotatorStatusStatus) {
+	*out = *in
+	out.Ingresses = in.Ingresses
+	if in.UnknownRuleReferences != nil {
+		in, out := &in.UnknownRuleReferences, &out.UnknownRuleReferences
+		*out = make([]IngressReference, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.UnusedRules != nil {
+		in, out := &in.UnusedRules, &out.UnusedRules
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.StagedRules != nil {
+		in, out := &in.StagedRules, &out.StagedRules
+		*out = new(StagedRules)
+		**out = **in
+	}
+	if in.Conditions != nil {
+		in, out := &in.Conditions, &out.Conditions
+		*out = make([]v1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AnnotatorStatusStatus.
+func (in *AnnotatorStatusStatus) DeepCopy() *AnnotatorStatusStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(AnnotatorStatusStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IngressCounts) DeepCopyInto(out *IngressCounts) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IngressCounts.
+func (in *IngressCounts) DeepCopy() *IngressCounts {
+	if in == nil {
+		return nil
+	}
+	out := new(IngressCounts)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IngressReference) DeepCopyInto(out *IngressReference) {
+	*out = *in
+	if in.Rules != nil {
+		in, out := &in.Rules, &out.Rules
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IngressReference.
+func (in *IngressReference) DeepCopy() *IngressReference {
+	if in == nil {
+		return nil
+	}
+	out := new(IngressReference)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *StagedRules) DeepCopyInto(out *StagedRules) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new StagedRules.
+func (in *StagedRules) DeepCopy() *StagedRules {
+	if in == nil {
+		return nil
+	}
+	out := new(StagedRules)
+	in.DeepCopyInto(out)
+	return out
+}
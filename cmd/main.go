@@ -22,43 +22,107 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/config"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	"github.com/kuoss/ingress-annotator/api/v1alpha1"
 	"github.com/kuoss/ingress-annotator/controllers/configmapcontroller"
 	"github.com/kuoss/ingress-annotator/controllers/ingresscontroller"
 	"github.com/kuoss/ingress-annotator/controllers/namespacecontroller"
+	"github.com/kuoss/ingress-annotator/controllers/statuscontroller"
+	"github.com/kuoss/ingress-annotator/pkg/audit"
+	"github.com/kuoss/ingress-annotator/pkg/backoff"
+	"github.com/kuoss/ingress-annotator/pkg/cachescope"
+	"github.com/kuoss/ingress-annotator/pkg/dryrun"
+	"github.com/kuoss/ingress-annotator/pkg/model"
+	"github.com/kuoss/ingress-annotator/pkg/progress"
+	"github.com/kuoss/ingress-annotator/pkg/rollout"
 	"github.com/kuoss/ingress-annotator/pkg/rulesstore"
+	"github.com/kuoss/ingress-annotator/pkg/scope"
+	"github.com/kuoss/ingress-annotator/pkg/shard"
+	"github.com/kuoss/ingress-annotator/pkg/statestore"
+	"github.com/kuoss/ingress-annotator/pkg/tracing"
+	"github.com/kuoss/ingress-annotator/pkg/trigger"
 	// +kubebuilder:scaffold:imports
 )
 
 var (
-	configMapName = "ingress-annotator"
-	scheme        = runtime.NewScheme()
-	setupLog      = ctrl.Log.WithName("setup")
+	configMapName     = "ingress-annotator"
+	conflictPolicy    = string(model.ConflictPolicyOverwrite)
+	stateStoreType    = statestore.TypeAnnotation
+	missingPolicy     = string(model.MissingPolicyKeep)
+	tracingOpts       = tracing.Options{SampleRatio: 1}
+	unreadableFor     = 5 * time.Minute
+	dryRun            bool
+	dryRunReport      = dryrun.NewReport()
+	stagedReport      = dryrun.NewReport()
+	auditSink         string
+	auditRedact       string
+	rolloutOpts       = rollout.Options{QPS: 10, BatchSize: 50, WaveInterval: time.Minute, MaxFailureRatio: 0.5, MinFailures: 5}
+	rolloutWaves      string
+	canarySelector    string
+	healthURL         string
+	watchNamespaces   string
+	namespaceSelector string
+	sharding          bool
+	shardLease        = 15 * time.Second
+	ingressWorkers    = 1
+	namespaceWorkers  = 1
+	backoffOpts       = backoff.Options{BaseDelay: time.Second, MaxDelay: 5 * time.Minute, Jitter: 0.2, MaxRetries: 10}
+	rulesDebounce     = 5 * time.Second
+	scheme            = runtime.NewScheme()
+	setupLog          = ctrl.Log.WithName("setup")
 )
 
 func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(v1alpha1.AddToScheme(scheme))
 
 	// +kubebuilder:scaffold:scheme
 }
 
 func main() {
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), getManagerOptions())
+	opts := getManagerOptions()
+	command, err := subcommand(flag.CommandLine)
+	if err != nil {
+		setupLog.Error(err, "invalid arguments")
+		os.Exit(1)
+	}
+	if command == "cleanup" {
+		c, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+		if err != nil {
+			setupLog.Error(err, "unable to create client")
+			os.Exit(1)
+		}
+		if err := cleanup(c, ctrl.SetupSignalHandler()); err != nil {
+			setupLog.Error(err, "unable to clean up managed annotations")
+			os.Exit(1)
+		}
+		return
+	}
+
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), opts)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
@@ -86,6 +150,79 @@ func getManagerOptions() ctrl.Options {
 		"If set, the metrics endpoint is served securely via HTTPS. Use --metrics-secure=false to use HTTP instead.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&conflictPolicy, "conflict-policy", conflictPolicy,
+		"What to do when a rule sets an annotation the Ingress already has: "+
+			"overwrite (restoring the original when the rule is removed), skip-if-present or fail.")
+	flag.StringVar(&stateStoreType, "state-store", stateStoreType,
+		"Where to keep the record of managed annotations: annotation (on the Ingress itself) "+
+			"or configmap (in a per-namespace "+statestore.ConfigMapName+" ConfigMap).")
+	flag.StringVar(&missingPolicy, "rules-missing-policy", missingPolicy,
+		"What to do while the rules ConfigMap does not exist: keep (the last-known rules), "+
+			"empty (remove all managed annotations) or pause (stop writing to Ingresses).")
+	flag.DurationVar(&unreadableFor, "rules-unreadable-threshold", unreadableFor,
+		"How long the rules ConfigMap may stay unreadable or invalid before the health check fails.")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"If set, Ingresses are never updated; the changes that would be made are logged, recorded as Events "+
+			"and served as JSON at "+dryrun.Path+" on the metrics endpoint.")
+	flag.StringVar(&auditSink, "audit-sink", "",
+		"Where to write the audit log of changes to Ingresses: stdout, file:<path> or an http(s) URL "+
+			"to POST each record to. Audit logging is off if unset.")
+	flag.StringVar(&auditRedact, "audit-redact-keys", "",
+		"Comma-separated annotation keys whose values are redacted in the audit log; "+
+			"shell patterns such as *auth-secret* are allowed.")
+	flag.Float64Var(&rolloutOpts.QPS, "rollout-qps", rolloutOpts.QPS,
+		"The maximum number of Ingresses annotated per second after a rules change; 0 is unlimited.")
+	flag.IntVar(&rolloutOpts.BatchSize, "rollout-batch-size", rolloutOpts.BatchSize,
+		"The number of Ingresses annotated between rollout checkpoints; 0 annotates all in one batch.")
+	flag.DurationVar(&rolloutOpts.BatchInterval, "rollout-batch-interval", 0,
+		"The pause between rollout batches, giving ingress controllers time to reload.")
+	flag.StringVar(&rolloutWaves, "rollout-waves", "",
+		"Comma-separated cumulative percentages of Ingresses updated by each wave of a rollout, e.g. 10,50,100. "+
+			"Rollouts are done in a single wave if unset.")
+	flag.DurationVar(&rolloutOpts.WaveInterval, "rollout-wave-interval", rolloutOpts.WaveInterval,
+		"The pause after each rollout wave, before its health is checked.")
+	flag.StringVar(&canarySelector, "rollout-canary-selector", "",
+		"A label selector of the Namespaces whose Ingresses make up the first wave of a rollout, e.g. canary=true.")
+	flag.StringVar(&healthURL, "rollout-health-url", "",
+		"A URL that must answer a GET with a 2xx status after each rollout wave, or the rollout is rolled back.")
+	flag.Float64Var(&rolloutOpts.MaxFailureRatio, "rollout-max-failure-ratio", rolloutOpts.MaxFailureRatio,
+		"The share of Ingresses that may fail to update before a rollout is aborted and rolled back to the "+
+			"previous rules; 0 never aborts.")
+	flag.IntVar(&rolloutOpts.MinFailures, "rollout-min-failures", rolloutOpts.MinFailures,
+		"The number of Ingresses that may fail to update during a rollout whatever their share.")
+	flag.StringVar(&watchNamespaces, "watch-namespaces", "",
+		"Comma-separated Namespaces whose Ingresses the annotator manages; all Namespaces if unset. "+
+			"The rules ConfigMap is always read from POD_NAMESPACE.")
+	flag.StringVar(&namespaceSelector, "namespace-selector", "",
+		"A label selector of the Namespaces whose Ingresses the annotator manages, e.g. team=a.")
+	flag.BoolVar(&sharding, "sharding", false,
+		"Run replicas active-active, splitting the Namespaces between them by consistent hashing. "+
+			"Leader election is then only used for the AnnotatorStatus.")
+	flag.DurationVar(&shardLease, "shard-lease-duration", shardLease,
+		"How long the Namespaces of a replica that stopped renewing its Lease wait before moving to the others.")
+	flag.IntVar(&ingressWorkers, "ingress-workers", ingressWorkers,
+		"The number of Ingresses reconciled concurrently.")
+	flag.IntVar(&namespaceWorkers, "namespace-workers", namespaceWorkers,
+		"The number of Namespaces reconciled concurrently.")
+	flag.DurationVar(&backoffOpts.BaseDelay, "retry-base-delay", backoffOpts.BaseDelay,
+		"The delay before retrying a failed reconcile; it doubles with each consecutive failure of the same object.")
+	flag.DurationVar(&backoffOpts.MaxDelay, "retry-max-delay", backoffOpts.MaxDelay,
+		"The maximum delay between retries of a failed reconcile.")
+	flag.Float64Var(&backoffOpts.Jitter, "retry-jitter", backoffOpts.Jitter,
+		"The fraction of each retry delay added at random, so that objects failing together are not retried together.")
+	flag.IntVar(&backoffOpts.MaxRetries, "max-retries", backoffOpts.MaxRetries,
+		"The number of retries after which an Ingress is marked failed and left until it or the rules change; "+
+			"0 retries forever.")
+	flag.DurationVar(&rulesDebounce, "rules-debounce", rulesDebounce,
+		"How long the rules must stay unchanged before they are rolled out, so that a burst of updates "+
+			"is rolled out once; 0 rolls out every update right away.")
+	flag.StringVar(&tracingOpts.Endpoint, "otlp-endpoint", "",
+		"The host:port of the OTLP/gRPC collector to export traces to. Tracing is off unless this flag "+
+			"or OTEL_EXPORTER_OTLP_ENDPOINT is set.")
+	flag.BoolVar(&tracingOpts.Insecure, "otlp-insecure", false,
+		"If set, traces are exported without TLS.")
+	flag.Float64Var(&tracingOpts.SampleRatio, "trace-sample-ratio", tracingOpts.SampleRatio,
+		"The ratio of rollouts to trace, between 0 and 1.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -111,17 +248,34 @@ func getManagerOptions() ctrl.Options {
 		TLSOpts:       tlsOpts,
 	}
 
+	// The changes held back by a dry run or a pause, and those promoting the
+	// staged rules would make.
+	metricsServerOptions.ExtraHandlers = map[string]http.Handler{
+		dryrun.Path:       dryRunReport,
+		dryrun.StagedPath: stagedReport,
+	}
+
 	if secureMetrics {
 		metricsServerOptions.FilterProvider = filters.WithAuthenticationAndAuthorization
 	}
 
 	return ctrl.Options{
-		Scheme:                 scheme,
+		Scheme: scheme,
+		// Only the rules ConfigMap, the state ConfigMaps and the metadata of
+		// Namespaces are cached, without managed fields, to save memory on
+		// large clusters.
+		Cache: cachescope.Options(os.Getenv("POD_NAMESPACE"), stateStoreType == statestore.TypeConfigMap,
+			scope.SplitNamespaces(watchNamespaces)),
+		Controller: config.Controller{GroupKindConcurrency: map[string]int{
+			"Ingress.networking.k8s.io": ingressWorkers,
+			"Namespace":                 namespaceWorkers,
+		}},
 		Metrics:                metricsServerOptions,
 		WebhookServer:          webhookServer,
 		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "annotator.ingress.kubernetes.io",
+		// With sharding, the replicas still elect the one writing the AnnotatorStatus.
+		LeaderElection:   enableLeaderElection || sharding,
+		LeaderElectionID: "annotator.ingress.kubernetes.io",
 	}
 }
 
@@ -136,26 +290,111 @@ func run(mgr ctrl.Manager, ctx context.Context) error {
 		Name:      configMapName,
 	}
 
-	cm, err := fetchConfigMapDirectly(mgr.GetAPIReader(), nn)
+	policy, err := model.ParseConflictPolicy(conflictPolicy)
 	if err != nil {
 		return err
 	}
-	rulesStore, err := rulesstore.New(cm)
+	stateStore, err := statestore.New(stateStoreType, mgr.GetClient())
+	if err != nil {
+		return err
+	}
+	rulesMissingPolicy, err := model.ParseMissingPolicy(missingPolicy)
+	if err != nil {
+		return err
+	}
+	namespaceScope, err := scope.Parse(watchNamespaces, namespaceSelector)
 	if err != nil {
-		return fmt.Errorf("unable to start rules store: %w", err)
+		return err
+	}
+	namespaceShard, err := newShard(mgr, ns)
+	if err != nil {
+		return err
+	}
+	retryPolicy, err := backoff.New(backoffOpts)
+	if err != nil {
+		return err
+	}
+	if rulesDebounce < 0 {
+		return fmt.Errorf("invalid rules debounce %v: must not be negative", rulesDebounce)
+	}
+	if ingressWorkers <= 0 {
+		return fmt.Errorf("invalid ingress workers %d: must be positive", ingressWorkers)
+	}
+	if namespaceWorkers <= 0 {
+		return fmt.Errorf("invalid namespace workers %d: must be positive", namespaceWorkers)
 	}
 
-	if err = (&configmapcontroller.ConfigMapReconciler{
-		Client:     mgr.GetClient(),
-		NN:         nn,
-		RulesStore: rulesStore,
-	}).SetupWithManager(mgr); err != nil {
-		return fmt.Errorf("unable to create ConfigMapReconciler: %w", err) // test unreachable
+	shutdownTracing, err := tracing.Setup(ctx, tracingOpts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			setupLog.Error(err, "unable to flush traces")
+		}
+	}()
+
+	rulesStore, err := newRulesStore(mgr.GetAPIReader(), nn, rulesMissingPolicy)
+	if err != nil {
+		return err
+	}
+	auditLogger, err := newAuditLogger()
+	if err != nil {
+		return err
+	}
+	tracker := progress.NewTracker()
+	// The rollout only triggers the update of each Ingress; the updates
+	// rejected afterwards, e.g. by an admission webhook, count as failures.
+	failures := func(keys []types.NamespacedName) map[string]error {
+		return tracker.Failures(rulesStore.GetGeneration(), keys)
+	}
+	rolloutEngine, canaries, healthChecks, err := newRollout(mgr.GetClient(), nn, failures)
+	if err != nil {
+		return err
+	}
+	recorder := mgr.GetEventRecorderFor("ingress-annotator")
+	if dryRun {
+		setupLog.Info("dry run, Ingresses will not be updated")
 	}
 
 	ingressReconciler := &ingresscontroller.IngressReconciler{
-		Client:     mgr.GetClient(),
-		RulesStore: rulesStore,
+		Client:         mgr.GetClient(),
+		RulesStore:     rulesStore,
+		StateStore:     stateStore,
+		ConflictPolicy: policy,
+		Recorder:       recorder,
+		Progress:       tracker,
+		DryRun:         dryRun,
+		DryRunReport:   dryRunReport,
+		Audit:          auditLogger,
+		Gate:           rolloutEngine.Gate(),
+		Scope:          namespaceScope,
+		Shard:          namespaceShard,
+		Backoff:        retryPolicy,
+		Retries:        backoff.NewRetries(backoffOpts.MaxRetries),
+		Triggers:       trigger.New(),
+	}
+
+	if err = (&configmapcontroller.ConfigMapReconciler{
+		Client:            mgr.GetClient(),
+		NN:                nn,
+		RulesStore:        rulesStore,
+		MissingPolicy:     rulesMissingPolicy,
+		Recorder:          recorder,
+		DryRun:            dryRun,
+		IngressReconciler: ingressReconciler,
+		Rollout:           rolloutEngine,
+		CanarySelector:    canaries,
+		HealthChecks:      healthChecks,
+		Previewer:         ingressReconciler,
+		StagedReport:      stagedReport,
+		Scope:             namespaceScope,
+		Shard:             namespaceShard,
+		Backoff:           retryPolicy,
+		Debounce:          rulesDebounce,
+		Triggers:          ingressReconciler.Triggers,
+	}).SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create ConfigMapReconciler: %w", err) // test unreachable
 	}
 
 	if err = ingressReconciler.SetupWithManager(mgr); err != nil {
@@ -165,15 +404,43 @@ func run(mgr ctrl.Manager, ctx context.Context) error {
 	if err = (&namespacecontroller.NamespaceReconciler{
 		Client:            mgr.GetClient(),
 		IngressReconciler: ingressReconciler,
+		RulesStore:        rulesStore,
+		Recorder:          recorder,
+		DryRun:            dryRun,
+		Gate:              rolloutEngine.Gate(),
+		Scope:             namespaceScope,
+		Shard:             namespaceShard,
+		Backoff:           retryPolicy,
+		Triggers:          ingressReconciler.Triggers,
 	}).SetupWithManager(mgr); err != nil {
 		return fmt.Errorf("unable to create NamespaceReconciler: %w", err) // test unreachable
 	}
+
+	if err = (&statuscontroller.StatusReconciler{
+		Client:       mgr.GetClient(),
+		NN:           nn,
+		RulesStore:   rulesStore,
+		Progress:     tracker,
+		StagedReport: stagedReport,
+		Scope:        namespaceScope,
+		Shard:        namespaceShard,
+	}).SetupWithManager(mgr); err != nil {
+		return fmt.Errorf("unable to create StatusReconciler: %w", err) // test unreachable
+	}
 	// +kubebuilder:scaffold:builder
 
-	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
+	// Checks are named so that /healthz?verbose and /readyz?verbose list each
+	// of them, and /readyz/<name> can be queried on its own.
+	if err := mgr.AddHealthzCheck("ping", healthz.Ping); err != nil {
+		return fmt.Errorf("unable to set up health check: %w", err)
+	}
+	if err := mgr.AddHealthzCheck("rules-source", rulesStore.HealthzCheck(unreadableFor)); err != nil {
 		return fmt.Errorf("unable to set up health check: %w", err)
 	}
-	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
+	if err := mgr.AddReadyzCheck("rules", rulesStore.ReadyzCheck); err != nil {
+		return fmt.Errorf("unable to set up ready check: %w", err)
+	}
+	if err := mgr.AddReadyzCheck("informers", cacheSyncCheck(mgr.GetCache())); err != nil {
 		return fmt.Errorf("unable to set up ready check: %w", err)
 	}
 
@@ -185,6 +452,172 @@ func run(mgr ctrl.Manager, ctx context.Context) error {
 	return nil
 }
 
+// subcommand returns the command given after the flags of fs, or "" to run
+// the manager. As parsing stops at the first argument that is not a flag,
+// the flags following the command are parsed here, so that they are not
+// silently ignored.
+func subcommand(fs *flag.FlagSet) (string, error) {
+	if fs.NArg() == 0 {
+		return "", nil
+	}
+	command := fs.Arg(0)
+	if command != "cleanup" {
+		return "", fmt.Errorf("unknown command %q", command)
+	}
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return "", err
+	}
+	if fs.NArg() > 0 {
+		return "", fmt.Errorf("unexpected arguments after %s: %s", command, strings.Join(fs.Args(), " "))
+	}
+	return command, nil
+}
+
+// cleanup removes all managed annotations from all Ingresses. It runs
+// without a manager, for use when the annotator is being uninstalled.
+func cleanup(c client.Client, ctx context.Context) error {
+	stateStore, err := statestore.New(stateStoreType, c)
+	if err != nil {
+		return err
+	}
+	auditLogger, err := newAuditLogger()
+	if err != nil {
+		return err
+	}
+	r := &ingresscontroller.IngressReconciler{
+		Client:     c,
+		StateStore: stateStore,
+		Audit:      auditLogger,
+	}
+
+	setupLog.Info("cleaning up managed annotations")
+	if err := r.CleanupAll(ctx); err != nil {
+		return fmt.Errorf("problem cleaning up: %w", err)
+	}
+	setupLog.Info("cleanup finished")
+	return nil
+}
+
+// newAuditLogger returns the audit Logger configured by the flags.
+func newAuditLogger() (*audit.Logger, error) {
+	sink, err := audit.NewSink(auditSink)
+	if err != nil {
+		return nil, err
+	}
+	logger := &audit.Logger{Sink: sink}
+	for _, key := range strings.Split(auditRedact, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			logger.Redact = append(logger.Redact, key)
+		}
+	}
+	return logger, nil
+}
+
+// newRollout returns the rollout Engine configured by the flags, keeping its
+// checkpoint next to the rules ConfigMap nn and counting failures, with the
+// canary selector and health checks of rollouts in waves.
+func newRollout(c client.Client, nn types.NamespacedName, failures rollout.Failures) (*rollout.Engine, labels.Selector, rollout.HealthChecks, error) {
+	opts := rolloutOpts
+	opts.Failures = failures
+	if opts.MaxFailureRatio < 0 || opts.MaxFailureRatio > 1 {
+		return nil, nil, nil, fmt.Errorf("invalid rollout max failure ratio %v: must be between 0 and 1", opts.MaxFailureRatio)
+	}
+	for _, wave := range strings.Split(rolloutWaves, ",") {
+		if wave = strings.TrimSpace(wave); wave == "" {
+			continue
+		}
+		percent, err := strconv.Atoi(wave)
+		if err != nil || percent < 1 || percent > 100 {
+			return nil, nil, nil, fmt.Errorf("invalid rollout wave %q: must be a percentage between 1 and 100", wave)
+		}
+		opts.Waves = append(opts.Waves, percent)
+	}
+	var selector labels.Selector
+	if canarySelector != "" {
+		var err error
+		if selector, err = labels.Parse(canarySelector); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid rollout canary selector: %w", err)
+		}
+		if len(opts.Waves) == 0 {
+			// The canaries make up a wave of their own.
+			opts.Waves = []int{100}
+		}
+	}
+	var checks rollout.HealthChecks
+	if healthURL != "" {
+		checks = append(checks, &rollout.ProbeCheck{URL: healthURL, Client: &http.Client{Timeout: 5 * time.Second}})
+	}
+
+	// With sharding, each replica rolls out its own shard, which is not
+	// the same after a restart; rollouts then start over instead of resuming.
+	var checkpoints rollout.CheckpointStore
+	if !sharding {
+		checkpoints = &rollout.ConfigMapCheckpointStore{
+			Client: c,
+			NN:     types.NamespacedName{Namespace: nn.Namespace, Name: nn.Name + "-rollout"},
+		}
+	}
+	engine := rollout.New(opts, checkpoints)
+	return engine, selector, checks, nil
+}
+
+// newShard returns the Shard of this replica, added to mgr, or nil without
+// sharding. Replicas are named after their Pod, or their host name.
+func newShard(mgr ctrl.Manager, namespace string) (*shard.Shard, error) {
+	if !sharding {
+		return nil, nil
+	}
+	if shardLease < 3*time.Second {
+		return nil, fmt.Errorf("invalid shard lease duration %v: must be at least 3s", shardLease)
+	}
+	identity := os.Getenv("POD_NAME")
+	if identity == "" {
+		var err error
+		if identity, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("unable to name the replica: %w", err)
+		}
+	}
+	s := shard.New(mgr.GetClient(), mgr.GetAPIReader(), shard.Options{
+		Namespace:     namespace,
+		Identity:      identity,
+		LeaseDuration: shardLease,
+	})
+	if err := mgr.Add(s); err != nil {
+		return nil, fmt.Errorf("unable to set up shard: %w", err)
+	}
+	return s, nil
+}
+
+// cacheSyncCheck fails until the informers of the manager's cache have synced.
+func cacheSyncCheck(c cache.Cache) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), time.Second)
+		defer cancel()
+		if !c.WaitForCacheSync(ctx) {
+			return errors.New("informers have not synced")
+		}
+		return nil
+	}
+}
+
+// newRulesStore loads the rules from the ConfigMap. If the ConfigMap does not
+// exist yet, the manager starts anyway and waits for it to be created.
+func newRulesStore(reader client.Reader, nn types.NamespacedName, policy model.MissingPolicy) (*rulesstore.RulesStore, error) {
+	cm, err := fetchConfigMapDirectly(reader, nn)
+	if apierrors.IsNotFound(err) {
+		setupLog.Info("rules ConfigMap not found, waiting for it to be created", "configMap", nn, "policy", policy)
+		return rulesstore.NewMissing(policy), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rulesStore, err := rulesstore.New(cm)
+	if err != nil {
+		return nil, fmt.Errorf("unable to start rules store: %w", err)
+	}
+	return rulesStore, nil
+}
+
 func fetchConfigMapDirectly(reader client.Reader, nn types.NamespacedName) (*corev1.ConfigMap, error) {
 	cm := &corev1.ConfigMap{}
 	err := reader.Get(context.Background(), nn, cm)
@@ -5,13 +5,22 @@ import (
 	"crypto/tls"
 	"errors"
 	"flag"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/jmnote/tester/testcase"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/mock/gomock"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/config"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
@@ -51,6 +60,12 @@ func TestGetManagerOptions(t *testing.T) {
 		assert.Equal(t, []string{"http/1.1"}, tlsConfig.NextProtos, "Expected HTTP/2 to be disabled")
 	}
 
+	// Check the cache is restricted
+	assert.NotNil(t, opts.Cache.DefaultTransform, "Expected managed fields to be stripped from the cache")
+	assert.Len(t, opts.Cache.ByObject, 1, "Expected ConfigMaps not to be scoped without POD_NAMESPACE")
+	assert.Equal(t, map[string]int{"Ingress.networking.k8s.io": 1, "Namespace": 1}, opts.Controller.GroupKindConcurrency,
+		"Expected one worker per controller by default")
+
 	// Check the default leader election ID
 	assert.Equal(t, "annotator.ingress.kubernetes.io", opts.LeaderElectionID, "Expected leader election ID to match")
 }
@@ -81,6 +96,7 @@ func setupMockManager(mockCtrl *gomock.Controller, opts *managerOpts, objs ...cl
 	mockManager.EXPECT().AddReadyzCheck(gomock.Any(), gomock.Any()).Return(opts.AddReadyzCheckErr).AnyTimes()
 	mockManager.EXPECT().GetLogger().Return(zap.New(zap.WriteTo(nil))).AnyTimes()
 	mockManager.EXPECT().GetAPIReader().Return(fakeClient).AnyTimes()
+	mockManager.EXPECT().GetEventRecorderFor(gomock.Any()).Return(record.NewFakeRecorder(10)).AnyTimes()
 	mockManager.EXPECT().Start(gomock.Any()).Return(opts.StartErr).AnyTimes()
 
 	return mockManager
@@ -93,6 +109,11 @@ func TestRun(t *testing.T) {
 		managerOpts       *managerOpts
 		cm                *corev1.ConfigMap
 		setupManagerError func(mgr *mocks.MockManager)
+		namespaceSelector string
+		maxRetries        int
+		rulesDebounce     time.Duration
+		ingressWorkers    *int
+		namespaceWorkers  *int
 		wantError         string
 	}{
 		{
@@ -115,10 +136,9 @@ func TestRun(t *testing.T) {
 			wantError:   "failed to fetch ConfigMap: mocked GetError",
 		},
 		{
-			name:      "Error fetching ConfigMap - ConfigMap not found",
+			name:      "ConfigMap not found - start and wait for it",
 			namespace: "test-namespace",
 			cm:        &corev1.ConfigMap{},
-			wantError: `failed to fetch ConfigMap: configmaps "ingress-annotator" not found`,
 		},
 		{
 			name:      "Error setting up health check",
@@ -129,6 +149,56 @@ func TestRun(t *testing.T) {
 			},
 			wantError: "unable to start rules store: failed to initialize RulesStore: failed to extract rules from configMap: failed to unmarshal rules: yaml: unmarshal errors:\n  line 1: cannot unmarshal !!str `invalid...` into model.Rules",
 		},
+		{
+			name:      "Invalid namespace selector",
+			namespace: "test-namespace",
+			cm: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test-namespace", Name: "ingress-annotator"},
+				Data:       map[string]string{"rules": ""},
+			},
+			namespaceSelector: "team in",
+			wantError:         "invalid namespace selector: unable to parse requirement: found '' expected: '('",
+		},
+		{
+			name:      "Invalid max retries",
+			namespace: "test-namespace",
+			cm: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test-namespace", Name: "ingress-annotator"},
+				Data:       map[string]string{"rules": ""},
+			},
+			maxRetries: -1,
+			wantError:  "invalid max retries -1: must not be negative",
+		},
+		{
+			name:      "Invalid rules debounce",
+			namespace: "test-namespace",
+			cm: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test-namespace", Name: "ingress-annotator"},
+				Data:       map[string]string{"rules": ""},
+			},
+			rulesDebounce: -time.Second,
+			wantError:     "invalid rules debounce -1s: must not be negative",
+		},
+		{
+			name:      "Invalid ingress workers",
+			namespace: "test-namespace",
+			cm: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test-namespace", Name: "ingress-annotator"},
+				Data:       map[string]string{"rules": ""},
+			},
+			ingressWorkers: ptr.To(0),
+			wantError:      "invalid ingress workers 0: must be positive",
+		},
+		{
+			name:      "Invalid namespace workers",
+			namespace: "test-namespace",
+			cm: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "test-namespace", Name: "ingress-annotator"},
+				Data:       map[string]string{"rules": ""},
+			},
+			namespaceWorkers: ptr.To(-1),
+			wantError:        "invalid namespace workers -1: must be positive",
+		},
 		{
 			name:      "Error setting up ready check",
 			namespace: "test-namespace",
@@ -173,6 +243,10 @@ func TestRun(t *testing.T) {
 			defer mockCtrl.Finish()
 
 			t.Setenv("POD_NAMESPACE", tc.namespace)
+			namespaceSelector, backoffOpts.MaxRetries, rulesDebounce = tc.namespaceSelector, tc.maxRetries, tc.rulesDebounce
+			defer func() { namespaceSelector, backoffOpts.MaxRetries, rulesDebounce = "", 10, 5*time.Second }()
+			ingressWorkers, namespaceWorkers = ptr.Deref(tc.ingressWorkers, 1), ptr.Deref(tc.namespaceWorkers, 1)
+			defer func() { ingressWorkers, namespaceWorkers = 1, 1 }()
 			mgr := setupMockManager(mockCtrl, tc.managerOpts, tc.cm)
 			if tc.setupManagerError != nil {
 				tc.setupManagerError(mgr)
@@ -186,3 +260,256 @@ func TestRun(t *testing.T) {
 		})
 	}
 }
+
+func TestSubcommand(t *testing.T) {
+	testCases := []struct {
+		args           []string
+		wantCommand    string
+		wantStateStore string
+		wantError      string
+	}{
+		{
+			args:           []string{"--state-store=configmap"},
+			wantStateStore: "configmap",
+		},
+		{
+			args:           []string{"--state-store=configmap", "cleanup"},
+			wantCommand:    "cleanup",
+			wantStateStore: "configmap",
+		},
+		{
+			args:           []string{"cleanup", "--state-store=configmap"},
+			wantCommand:    "cleanup",
+			wantStateStore: "configmap",
+		},
+		{
+			args:      []string{"cleanup", "--state-store=configmap", "extra"},
+			wantError: "unexpected arguments after cleanup: extra",
+		},
+		{
+			args:      []string{"cleanup", "--unknown"},
+			wantError: "flag provided but not defined: -unknown",
+		},
+		{
+			args:      []string{"xxx"},
+			wantError: `unknown command "xxx"`,
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.args), func(t *testing.T) {
+			fs := flag.NewFlagSet("manager", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			stateStore := fs.String("state-store", "annotation", "")
+			require.NoError(t, fs.Parse(tc.args))
+
+			command, err := subcommand(fs)
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantCommand, command)
+			assert.Equal(t, tc.wantStateStore, *stateStore)
+		})
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	ingress := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default",
+		Name:      "my-ingress",
+		Annotations: map[string]string{
+			"annotator.ingress.kubernetes.io/managed-annotations": "{\"new-key\":\"new-value\"}\n",
+			"new-key": "new-value",
+		},
+	}}
+
+	testCases := []struct {
+		name           string
+		stateStoreType string
+		clientOpts     *fakeclient.ClientOpts
+		wantError      string
+	}{
+		{
+			name:           "no error",
+			stateStoreType: "annotation",
+		},
+		{
+			name:           "invalid state store",
+			stateStoreType: "xxx",
+			wantError:      `invalid state store "xxx": must be one of annotation, configmap`,
+		},
+		{
+			name:           "list error",
+			stateStoreType: "annotation",
+			clientOpts:     &fakeclient.ClientOpts{ListError: true},
+			wantError:      "problem cleaning up: failed to list ingresses: mocked ListError",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			stateStoreType = tc.stateStoreType
+			defer func() { stateStoreType = "annotation" }()
+
+			c := fakeclient.NewClient(tc.clientOpts, ingress.DeepCopy())
+			err := cleanup(c, context.TODO())
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+				return
+			}
+			assert.NoError(t, err)
+
+			var got networkingv1.Ingress
+			assert.NoError(t, c.Get(context.TODO(), client.ObjectKeyFromObject(ingress), &got))
+			assert.Empty(t, got.Annotations)
+		})
+	}
+}
+
+func TestCacheSyncCheck(t *testing.T) {
+	testCases := []struct {
+		name      string
+		synced    bool
+		wantError string
+	}{
+		{
+			name:   "synced",
+			synced: true,
+		},
+		{
+			name:      "not synced",
+			wantError: "informers have not synced",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			mockCache := mocks.NewMockCache(mockCtrl)
+			mockCache.EXPECT().WaitForCacheSync(gomock.Any()).Return(tc.synced)
+
+			err := cacheSyncCheck(mockCache)(httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if tc.wantError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.wantError)
+			}
+		})
+	}
+}
+
+func TestNewShard(t *testing.T) {
+	testCases := []struct {
+		name      string
+		sharding  bool
+		lease     time.Duration
+		wantShard bool
+		wantError string
+	}{
+		{
+			name:  "no sharding",
+			lease: 15 * time.Second,
+		},
+		{
+			name:      "sharding",
+			sharding:  true,
+			lease:     15 * time.Second,
+			wantShard: true,
+		},
+		{
+			name:      "invalid lease duration",
+			sharding:  true,
+			lease:     time.Second,
+			wantError: "invalid shard lease duration 1s: must be at least 3s",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			sharding, shardLease = tc.sharding, tc.lease
+			defer func() { sharding, shardLease = false, 15*time.Second }()
+			t.Setenv("POD_NAME", "pod-0")
+
+			s, err := newShard(setupMockManager(mockCtrl, nil, &corev1.ConfigMap{}), "default")
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantShard, s != nil)
+		})
+	}
+}
+
+func TestNewRollout(t *testing.T) {
+	testCases := []struct {
+		name            string
+		waves           string
+		selector        string
+		healthURL       string
+		maxFailureRatio float64
+		wantGate        bool
+		wantSelector    string
+		wantChecks      int
+		wantError       string
+	}{
+		{
+			name: "single wave",
+		},
+		{
+			name:     "waves",
+			waves:    "10, 50,100",
+			wantGate: true,
+		},
+		{
+			name:         "canaries make up a wave",
+			selector:     "canary=true",
+			healthURL:    "http://localhost:8080/healthz",
+			wantGate:     true,
+			wantSelector: "canary=true",
+			wantChecks:   1,
+		},
+		{
+			name:      "invalid wave",
+			waves:     "10,150",
+			wantError: `invalid rollout wave "150": must be a percentage between 1 and 100`,
+		},
+		{
+			name:            "invalid max failure ratio",
+			maxFailureRatio: 1.5,
+			wantError:       "invalid rollout max failure ratio 1.5: must be between 0 and 1",
+		},
+		{
+			name:      "invalid selector",
+			selector:  "canary in",
+			wantError: "invalid rollout canary selector: unable to parse requirement: found '' expected: '('",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			rolloutWaves, canarySelector, healthURL = tc.waves, tc.selector, tc.healthURL
+			rolloutOpts.MaxFailureRatio = tc.maxFailureRatio
+			defer func() {
+				rolloutWaves, canarySelector, healthURL = "", "", ""
+				rolloutOpts.MaxFailureRatio = 0.5
+			}()
+
+			engine, selector, checks, err := newRollout(fakeclient.NewClient(nil), types.NamespacedName{Namespace: "default", Name: "ingress-annotator"}, nil)
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantGate, engine.Gate() != nil)
+			if tc.wantSelector == "" {
+				assert.Nil(t, selector)
+			} else {
+				assert.Equal(t, tc.wantSelector, selector.String())
+			}
+			assert.Len(t, checks, tc.wantChecks)
+		})
+	}
+}
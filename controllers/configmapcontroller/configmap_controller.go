@@ -18,45 +18,136 @@ package configmapcontroller
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
+	"github.com/kuoss/ingress-annotator/controllers/ingresscontroller"
+	"github.com/kuoss/ingress-annotator/pkg/audit"
+	"github.com/kuoss/ingress-annotator/pkg/backoff"
+	"github.com/kuoss/ingress-annotator/pkg/dryrun"
+	"github.com/kuoss/ingress-annotator/pkg/metrics"
 	"github.com/kuoss/ingress-annotator/pkg/model"
+	"github.com/kuoss/ingress-annotator/pkg/rollout"
 	"github.com/kuoss/ingress-annotator/pkg/rulesstore"
+	"github.com/kuoss/ingress-annotator/pkg/scope"
+	"github.com/kuoss/ingress-annotator/pkg/shard"
+	"github.com/kuoss/ingress-annotator/pkg/tracing"
+	"github.com/kuoss/ingress-annotator/pkg/trigger"
 )
 
+var (
+	// errSuperseded cancels a rollout when newer rules arrive.
+	errSuperseded = errors.New("rollout superseded by newer rules")
+	// errPaused cancels a rollout when the ConfigMap asks for a pause.
+	errPaused = errors.New("rollout paused")
+)
+
+// Previewer computes the change that a rule set would make to an Ingress.
+type Previewer interface {
+	PreviewRules(ctx context.Context, ing *networkingv1.Ingress, namespace *corev1.Namespace,
+		rules *model.Rules, generation string) (dryrun.Change, error)
+}
+
 // ConfigMapReconciler reconciles a ConfigMap object
 type ConfigMapReconciler struct {
 	client.Client
-	NN         types.NamespacedName
-	RulesStore rulesstore.IRulesStore
+	NN            types.NamespacedName
+	RulesStore    rulesstore.IRulesStore
+	MissingPolicy model.MissingPolicy
+	Recorder      record.EventRecorder
+	// DryRun evaluates Ingresses with IngressReconciler instead of writing
+	// the reconcile trigger annotation to them, as do pauses.
+	DryRun            bool
+	IngressReconciler reconcile.Reconciler
+	// Rollout paces the annotation of Ingresses after a rules change.
+	Rollout *rollout.Engine
+	// CanarySelector selects the Namespaces whose Ingresses make up the first
+	// wave of a rollout in waves.
+	CanarySelector labels.Selector
+	// HealthChecks are run after each wave, besides the check that Ingresses
+	// keep their load balancer address.
+	HealthChecks rollout.HealthChecks
+	// Previewer computes the changes the staged rules would make, which are
+	// kept in StagedReport.
+	Previewer    Previewer
+	StagedReport *dryrun.Report
+	// Scope restricts the annotator to the Ingresses of some namespaces.
+	Scope *scope.Scope
+	// Shard restricts rollouts to the namespaces of this replica when
+	// replicas share the namespaces; every replica then loads the rules.
+	Shard *shard.Shard
+	// Backoff paces the retries of failed reconciles.
+	Backoff *backoff.Policy
+	// Triggers holds the triggers of the Ingress reconciles, shared with the
+	// IngressReconciler.
+	Triggers *trigger.Triggers
+	// Debounce holds back the loading of changed rules until they have not
+	// changed for that long, so that a burst of updates is rolled out once.
+	Debounce time.Duration
+
+	mutex sync.Mutex
+	now   func() time.Time
+	// pending is the generation of the changed rules waiting to settle,
+	// first seen at changedAt.
+	pending   string
+	changedAt time.Time
+	// rolling is the generation of the rollout in flight, which cancel stops.
+	rolling string
+	cancel  context.CancelCauseFunc
 }
 
-// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update
 // +kubebuilder:rbac:groups=core,resources=configmaps/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=core,resources=configmaps/finalizers,verbs=update
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *ConfigMapReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	isRulesConfigMap := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return obj.GetNamespace() == r.NN.Namespace && obj.GetName() == r.NN.Name
+	})
+	opts := controller.Options{RateLimiter: r.Backoff.RateLimiter()}
+	if r.Shard != nil {
+		opts.NeedLeaderElection = ptr.To(false)
+	}
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.ConfigMap{}).
+		For(&corev1.ConfigMap{}, builder.WithPredicates(isRulesConfigMap)).
+		// The rollout in flight blocks the only worker, so newer rules cancel
+		// it from the event handler rather than from Reconcile.
+		Watches(&corev1.ConfigMap{}, handler.Funcs{UpdateFunc: r.supersede}, builder.WithPredicates(isRulesConfigMap)).
+		WithOptions(opts).
 		Complete(r)
 }
 
-func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, err error) {
 	// Only proceed if the request is for the ConfigMap we're watching
 	if req.Namespace != r.NN.Namespace || req.Name != r.NN.Name {
 		return ctrl.Result{}, nil
 	}
 
+	defer metrics.ObserveReconcile("configmap", time.Now())
+	ctx, span := tracing.Start(ctx, "ConfigMap reconcile")
+	defer func() { tracing.End(span, err) }()
 	logger := ctrl.LoggerFrom(ctx).WithValues("kind", "ConfigMap", "namespace", req.Namespace, "name", req.Name)
 	logger.Info("Reconciling ConfigMap")
 
@@ -64,10 +155,20 @@ func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	var cm corev1.ConfigMap
 	if err := r.Get(ctx, r.NN, &cm); err != nil {
 		if apierrors.IsNotFound(err) {
-			logger.Error(err, "ConfigMap %s not found, will retry after delay", r.NN)
-			return ctrl.Result{RequeueAfter: 30 * time.Second}, nil
+			return r.reconcileMissing(ctx)
+		}
+		r.RulesStore.MarkReadError(err)
+		return ctrl.Result{}, fmt.Errorf("failed to get ConfigMap: %w", err)
+	}
+
+	// Changed rules are not loaded before they settle, so that no Ingress
+	// gets the rules of an update the burst is going to supersede. A pause
+	// is loaded right away, with the rules.
+	if generation, err := rulesstore.Generation(&cm); err == nil && !rulesstore.PauseRequested(&cm) {
+		if wait := r.debounce(generation); wait > 0 {
+			logger.Info("Waiting for the rules to settle before loading them", "generation", generation, "wait", wait)
+			return ctrl.Result{RequeueAfter: wait}, nil
 		}
-		return ctrl.Result{RequeueAfter: 30 * time.Second}, fmt.Errorf("failed to get ConfigMap: %w", err)
 	}
 
 	// Update rules in the RulesStore
@@ -75,13 +176,73 @@ func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	logger.Info("Updating rules", "oldRules", oldRules)
 
 	if err := r.RulesStore.UpdateRules(&cm); err != nil {
-		return ctrl.Result{RequeueAfter: 30 * time.Second}, fmt.Errorf("failed to update rules in rules store: %w", err)
+		r.Recorder.Eventf(&cm, corev1.EventTypeWarning, "RulesInvalid", "Failed to load rules: %v", err)
+		metrics.RuleParseFailures.Inc()
+		return ctrl.Result{}, fmt.Errorf("failed to update rules in rules store: %w", err)
 	}
 
 	newRules := r.RulesStore.GetRules()
 	logger.Info("Rules updated", "newRules", newRules)
+	metrics.RulesLoaded.Set(float64(len(*newRules)))
+	metrics.RulesLastLoadTimestamp.SetToCurrentTime()
+	span.SetAttributes(
+		tracing.AttrRulesGeneration.String(r.RulesStore.GetGeneration()),
+		tracing.AttrRuleNames.StringSlice(newRules.Names()),
+	)
+	r.Recorder.Eventf(&cm, corev1.EventTypeNormal, "RulesLoaded", "Loaded %d rules (generation %s)",
+		len(*newRules), r.RulesStore.GetGeneration())
 
-	if err := r.annotateAllIngresses(ctx); err != nil {
+	// The update of the ConfigMap triggers the rollout of the promoted rules.
+	if _, ok := cm.Annotations[model.PromoteKey]; ok {
+		if !r.DryRun {
+			return ctrl.Result{}, r.promote(ctx, &cm)
+		}
+		// A dry run writes nothing: the staged rules stay staged, and what
+		// promoting them would change is previewed below.
+		logger.Info("Dry run, staged rules not promoted")
+		r.Recorder.Eventf(&cm, corev1.EventTypeNormal, "DryRun", "Dry run; staged rules (generation %s) not promoted",
+			r.RulesStore.GetStagedGeneration())
+	}
+	if err := r.previewStagedRules(ctx, &cm); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to previewStagedRules: %w", err)
+	}
+
+	// The rules of the ConfigMap are valid, as they were just loaded.
+	generation, _ := rulesstore.Generation(&cm)
+	rolloutCtx, done := r.startRollout(ctx, generation)
+	defer done()
+	if err := r.annotateAllIngresses(rolloutCtx); err != nil {
+		if errors.Is(context.Cause(rolloutCtx), errSuperseded) {
+			// The update carrying the newer rules is reconciled next.
+			logger.Info("Rollout superseded by newer rules", "generation", generation)
+			r.Recorder.Eventf(&cm, corev1.EventTypeNormal, "RolloutSuperseded",
+				"Cancelled the rollout of generation %s for newer rules", generation)
+			return ctrl.Result{}, nil
+		}
+		if errors.Is(context.Cause(rolloutCtx), errPaused) {
+			// The update carrying the pause is reconciled next.
+			logger.Info("Rollout paused", "generation", generation)
+			r.Recorder.Eventf(&cm, corev1.EventTypeNormal, "RolloutPaused",
+				"Cancelled the rollout of generation %s for a pause", generation)
+			return ctrl.Result{}, nil
+		}
+		var healthErr *rollout.HealthError
+		if errors.As(err, &healthErr) {
+			// Retrying would not help: the rollout stays aborted until the rules change.
+			logger.Error(err, "Rollout aborted")
+			r.Recorder.Eventf(&cm, corev1.EventTypeWarning, "RolloutAborted", "%v", err)
+			var rollbackErr *rollbackError
+			if errors.As(err, &rollbackErr) {
+				r.Recorder.Eventf(&cm, corev1.EventTypeWarning, "RulesRolledBack",
+					"Rolled back to the previous rules (generation %s)", rollbackErr.generation)
+			}
+			return ctrl.Result{}, nil
+		}
+		var rolloutErr *rollout.Error
+		if errors.As(err, &rolloutErr) {
+			r.Recorder.Eventf(&cm, corev1.EventTypeWarning, "RolloutFailed", "Failed to update %d of %d Ingresses",
+				len(rolloutErr.Failed), rolloutErr.Total)
+		}
 		return ctrl.Result{}, fmt.Errorf("failed to annotateAllIngresses: %w", err)
 	}
 
@@ -89,6 +250,171 @@ func (r *ConfigMapReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	return ctrl.Result{}, nil
 }
 
+// debounce returns how long the rules of generation must still wait to
+// settle before they are loaded. The rules already loaded never wait.
+func (r *ConfigMapReconciler) debounce(generation string) time.Duration {
+	if r.Debounce <= 0 {
+		return 0
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if generation == r.RulesStore.GetGeneration() {
+		r.pending = ""
+		return 0
+	}
+
+	now := time.Now()
+	if r.now != nil {
+		now = r.now()
+	}
+	if generation != r.pending {
+		r.pending, r.changedAt = generation, now
+	}
+	return max(r.changedAt.Add(r.Debounce).Sub(now), 0)
+}
+
+// startRollout returns the context of the rollout of generation, which
+// supersede cancels, and the func to call once the rollout is over.
+func (r *ConfigMapReconciler) startRollout(ctx context.Context, generation string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	r.mutex.Lock()
+	r.rolling, r.cancel = generation, cancel
+	r.mutex.Unlock()
+	return ctx, func() {
+		r.mutex.Lock()
+		r.rolling, r.cancel = "", nil
+		r.mutex.Unlock()
+		cancel(nil)
+	}
+}
+
+// supersede cancels the rollout in flight when the rules ConfigMap is
+// updated with rules of another generation, or asks for a pause: the single
+// worker would otherwise only load the update once the rollout is over.
+// Invalid rules leave it be, as they are not loaded.
+func (r *ConfigMapReconciler) supersede(_ context.Context, e event.UpdateEvent, _ workqueue.RateLimitingInterface) {
+	cm, ok := e.ObjectNew.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+	generation, err := rulesstore.Generation(cm)
+	if err != nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch {
+	case r.cancel == nil:
+	case rulesstore.PauseRequested(cm) && !r.RulesStore.IsPauseRequested():
+		r.cancel(errPaused)
+	case generation != r.rolling:
+		r.cancel(errSuperseded)
+	}
+}
+
+// promote replaces the rules with the staged rules, as asked by the promote
+// annotation of the ConfigMap. The annotation may name the generation of the
+// staged rules instead of "true", making sure that what was previewed is what
+// gets promoted.
+func (r *ConfigMapReconciler) promote(ctx context.Context, cm *corev1.ConfigMap) error {
+	want := cm.Annotations[model.PromoteKey]
+	delete(cm.Annotations, model.PromoteKey)
+	staged, ok := cm.Data[rulesstore.StagedRulesKey]
+	generation := r.RulesStore.GetStagedGeneration()
+
+	eventType, reason, message := corev1.EventTypeNormal, "RulesPromoted", fmt.Sprintf("Promoted staged rules (generation %s)", generation)
+	switch {
+	case !ok:
+		eventType, reason, message = corev1.EventTypeWarning, "PromotionRefused", "There are no staged rules to promote"
+	case want != "true" && want != generation:
+		eventType, reason, message = corev1.EventTypeWarning, "PromotionRefused",
+			fmt.Sprintf("Staged rules are generation %s, not %s", generation, want)
+	default:
+		cm.Data["rules"] = staged
+		delete(cm.Data, rulesstore.StagedRulesKey)
+	}
+	if err := r.Update(ctx, cm); err != nil {
+		if apierrors.IsConflict(err) {
+			// Another replica promoted the rules first; its update is reconciled next.
+			return nil
+		}
+		return fmt.Errorf("failed to update ConfigMap: %w", err)
+	}
+	ctrl.LoggerFrom(ctx).Info(message)
+	r.Recorder.Event(cm, eventType, reason, message)
+	return nil
+}
+
+// previewStagedRules computes the changes that promoting the staged rules
+// would make to each Ingress, and keeps them in the StagedReport.
+func (r *ConfigMapReconciler) previewStagedRules(ctx context.Context, cm *corev1.ConfigMap) error {
+	staged := r.RulesStore.GetStagedRules()
+	if staged == nil || r.Previewer == nil {
+		r.StagedReport.Replace(nil)
+		return nil
+	}
+	generation := r.RulesStore.GetStagedGeneration()
+
+	var ingressList networkingv1.IngressList
+	if err := r.List(ctx, &ingressList); err != nil {
+		return fmt.Errorf("failed to list ingresses: %w", err)
+	}
+	var namespaceList corev1.NamespaceList
+	if err := r.List(ctx, &namespaceList); err != nil {
+		return fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	namespaces := make(map[string]*corev1.Namespace, len(namespaceList.Items))
+	for i := range namespaceList.Items {
+		namespaces[namespaceList.Items[i].Name] = &namespaceList.Items[i]
+	}
+
+	var changes []dryrun.Change
+	previewed := 0
+	for _, ing := range ingressList.Items {
+		namespace, ok := namespaces[ing.Namespace]
+		if !ok || !r.Scope.Includes(namespace) {
+			continue
+		}
+		previewed++
+		change, err := r.Previewer.PreviewRules(ctx, &ing, namespace, staged, generation)
+		if err != nil {
+			change = dryrun.Change{Namespace: ing.Namespace, Name: ing.Name, Generation: generation, Reason: err.Error()}
+		} else if len(change.Added)+len(change.Changed)+len(change.Removed) == 0 {
+			continue
+		}
+		changes = append(changes, change)
+	}
+	r.StagedReport.Replace(changes)
+	r.Recorder.Eventf(cm, corev1.EventTypeNormal, "StagedRulesPreviewed",
+		"Promoting staged rules (generation %s) would change %d of %d Ingresses", generation, len(changes), previewed)
+	return nil
+}
+
+// reconcileMissing applies the MissingPolicy once the ConfigMap is gone. The
+// watch on ConfigMaps brings the rules back as soon as it is recreated.
+func (r *ConfigMapReconciler) reconcileMissing(ctx context.Context) (ctrl.Result, error) {
+	logger := ctrl.LoggerFrom(ctx)
+	logger.Info("ConfigMap not found, applying missing policy", "policy", r.MissingPolicy)
+
+	r.RulesStore.MarkMissing(r.MissingPolicy)
+	metrics.RulesLoaded.Set(float64(len(*r.RulesStore.GetRules())))
+	if r.MissingPolicy != model.MissingPolicyEmpty {
+		return ctrl.Result{}, nil
+	}
+
+	if err := r.annotateAllIngresses(ctx); err != nil {
+		var healthErr *rollout.HealthError
+		if errors.As(err, &healthErr) {
+			logger.Error(err, "Rollout aborted")
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, fmt.Errorf("failed to annotateAllIngresses: %w", err)
+	}
+	return ctrl.Result{}, nil
+}
+
 func (r *ConfigMapReconciler) annotateAllIngresses(ctx context.Context) error {
 	var ingressList networkingv1.IngressList
 
@@ -96,16 +422,138 @@ func (r *ConfigMapReconciler) annotateAllIngresses(ctx context.Context) error {
 		return fmt.Errorf("failed to list ingresses: %w", err)
 	}
 
+	pausedNamespaces, canaryNamespaces, excludedNamespaces, err := r.classifyNamespaces(ctx)
+	if err != nil {
+		return err
+	}
+	pauseRequested := r.RulesStore.IsPauseRequested()
+
+	ingresses := make(map[types.NamespacedName]networkingv1.Ingress, len(ingressList.Items))
+	keys := make([]types.NamespacedName, 0, len(ingressList.Items))
 	for _, ing := range ingressList.Items {
-		if err := r.annotateIngress(ctx, ing); err != nil {
-			return fmt.Errorf("failed to annotateIngress: %w", err)
+		if excludedNamespaces[ing.Namespace] {
+			continue
 		}
+		nn := client.ObjectKeyFromObject(&ing)
+		ingresses[nn] = ing
+		keys = append(keys, nn)
+	}
+	apply := func(ctx context.Context, nn types.NamespacedName) error {
+		ing := ingresses[nn]
+		hold := r.DryRun || pauseRequested || pausedNamespaces[ing.Namespace] || model.IsPaused(ing.Annotations)
+		return r.annotateIngress(ctx, ing, hold)
 	}
 
-	return nil
+	id := r.rolloutID()
+	gate := r.Rollout.Gate()
+	if gate == nil {
+		return r.rollback(ctx, r.Rollout.Run(ctx, id, keys, apply), apply)
+	}
+
+	waves := r.Rollout.PlanWaves(keys, func(nn types.NamespacedName) bool { return canaryNamespaces[nn.Namespace] })
+	check := append(rollout.HealthChecks{rollout.NewLoadBalancerCheck(r.Client, ingressList.Items)}, r.HealthChecks...)
+	err = r.Rollout.RunWaves(ctx, id, waves, apply, check)
+	return r.rollback(ctx, err, apply)
+}
+
+// rolloutID identifies the rollout of the loaded rules and settings, so that
+// a restart resumes the rollout of the same change instead of starting over.
+// Cleanup and pause change what is applied without changing the rules
+// generation, so toggling them starts a new rollout.
+func (r *ConfigMapReconciler) rolloutID() string {
+	id := r.RulesStore.GetGeneration()
+	if r.RulesStore.IsCleanupEnabled() {
+		id += "+cleanup"
+	}
+	if r.RulesStore.IsPauseRequested() {
+		id += "+paused"
+	}
+	return id
+}
+
+// rollbackError reports a rollout rolled back to the previous rules.
+type rollbackError struct {
+	err        error
+	generation string
+}
+
+func (e *rollbackError) Error() string {
+	return fmt.Sprintf("%v; rolled back to generation %s", e.err, e.generation)
+}
+
+func (e *rollbackError) Unwrap() error {
+	return e.err
 }
 
-func (r *ConfigMapReconciler) annotateIngress(ctx context.Context, ing networkingv1.Ingress) error {
+// rollback restores the previous rules after a rollout aborted with a
+// HealthError, and brings the Ingresses done so far back to them. Other
+// errors are returned as they are.
+func (r *ConfigMapReconciler) rollback(ctx context.Context, err error,
+	apply func(context.Context, types.NamespacedName) error) error {
+	var healthErr *rollout.HealthError
+	if !errors.As(err, &healthErr) {
+		return err
+	}
+	if !r.RulesStore.Rollback() {
+		if r.Rollout.Gate() == nil {
+			return fmt.Errorf("%w; the previous rules are not known", err)
+		}
+		return fmt.Errorf("%w; Ingresses not updated yet are held until the rules change", err)
+	}
+	reason := "unhealthy"
+	var rateErr *rollout.FailureRateError
+	if errors.As(err, &rateErr) {
+		reason = "failure_rate"
+	}
+	metrics.RulesRollbacks.WithLabelValues(reason).Inc()
+
+	r.Rollout.Gate().Open()
+	for _, nn := range healthErr.Done {
+		if err := apply(ctx, nn); err != nil {
+			ctrl.LoggerFrom(ctx).Error(err, "Failed to roll back Ingress", "ingress", nn)
+		}
+	}
+	return &rollbackError{err: err, generation: r.RulesStore.GetGeneration()}
+}
+
+// classifyNamespaces returns the names of the Namespaces that pause their
+// Ingresses, of those selected as canaries and of those out of scope.
+func (r *ConfigMapReconciler) classifyNamespaces(ctx context.Context) (paused, canary, excluded map[string]bool, err error) {
+	var namespaceList corev1.NamespaceList
+	if err := r.List(ctx, &namespaceList); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+
+	paused = make(map[string]bool)
+	canary = make(map[string]bool)
+	excluded = make(map[string]bool)
+	for _, namespace := range namespaceList.Items {
+		if !r.Scope.Includes(&namespace) || !r.Shard.Owns(namespace.Name) {
+			excluded[namespace.Name] = true
+			continue
+		}
+		if model.IsPaused(namespace.Annotations) {
+			paused[namespace.Name] = true
+		}
+		if r.CanarySelector != nil && r.CanarySelector.Matches(labels.Set(namespace.Labels)) {
+			canary[namespace.Name] = true
+		}
+	}
+	return paused, canary, excluded, nil
+}
+
+// annotateIngress writes the reconcile trigger annotation to ing, or
+// evaluates it in place when hold is set.
+func (r *ConfigMapReconciler) annotateIngress(ctx context.Context, ing networkingv1.Ingress, hold bool) (err error) {
+	nn := client.ObjectKeyFromObject(&ing)
+	ctx, span := tracing.Start(ctx, "Enqueue Ingress", tracing.IngressAttributes(nn)...)
+	defer func() { tracing.End(span, err) }()
+	if hold {
+		ingresscontroller.Evaluate(ctx, r.IngressReconciler, nn)
+		return nil
+	}
+	r.Triggers.Set(ctx, nn, audit.TriggerConfigMap)
+
 	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		if err := r.Get(ctx, client.ObjectKey{Name: ing.Name, Namespace: ing.Namespace}, &ing); err != nil {
 			return fmt.Errorf("failed to get ingress %s/%s: %w", ing.Namespace, ing.Name, err)
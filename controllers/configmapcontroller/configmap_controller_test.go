@@ -2,20 +2,44 @@ package configmapcontroller
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
 	"testing"
 	"time"
 
 	"github.com/jmnote/tester/testcase"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.uber.org/mock/gomock"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
+	"github.com/kuoss/ingress-annotator/controllers/ingresscontroller"
+	"github.com/kuoss/ingress-annotator/pkg/dryrun"
+	"github.com/kuoss/ingress-annotator/pkg/metrics"
+	"github.com/kuoss/ingress-annotator/pkg/model"
+	"github.com/kuoss/ingress-annotator/pkg/progress"
+	"github.com/kuoss/ingress-annotator/pkg/rollout"
 	"github.com/kuoss/ingress-annotator/pkg/rulesstore"
+	"github.com/kuoss/ingress-annotator/pkg/scope"
+	"github.com/kuoss/ingress-annotator/pkg/shard"
+	"github.com/kuoss/ingress-annotator/pkg/statestore"
 	"github.com/kuoss/ingress-annotator/pkg/testutil/fakeclient"
+	"github.com/kuoss/ingress-annotator/pkg/tracing"
 )
 
 func TestConfigMapReconciler_SetupWithManager(t *testing.T) {
@@ -62,14 +86,18 @@ func TestConfigMapReconciler_Reconcile(t *testing.T) {
 	}
 
 	testCases := []struct {
-		name       string
-		clientOpts *fakeclient.ClientOpts
-		cm         *corev1.ConfigMap
-		newCM      *corev1.ConfigMap
-		nn         types.NamespacedName
-		requestNN  types.NamespacedName
-		want       ctrl.Result
-		wantError  string
+		name          string
+		clientOpts    *fakeclient.ClientOpts
+		cm            *corev1.ConfigMap
+		newCM         *corev1.ConfigMap
+		nn            types.NamespacedName
+		requestNN     types.NamespacedName
+		want          ctrl.Result
+		wantError     string
+		missingPolicy model.MissingPolicy
+		wantRules     *model.Rules
+		wantPaused    bool
+		wantEvents    []string
 	}{
 		{
 			name:       "Requeue on ConfigMap Get error",
@@ -78,17 +106,48 @@ func TestConfigMapReconciler_Reconcile(t *testing.T) {
 			newCM:      createConfigMap("default", "ingress-annotator", "rule1:\n  key1: value1"),
 			nn:         types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
 			requestNN:  types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
-			want:       ctrl.Result{RequeueAfter: 30 * time.Second},
+			want:       ctrl.Result{},
 			wantError:  "failed to get ConfigMap: mocked GetError",
 		},
 		{
-			name:       "Requeue when ConfigMap not found",
+			name:       "Keep rules when ConfigMap not found",
 			clientOpts: &fakeclient.ClientOpts{GetNotFoundError: true},
-			cm:         createConfigMap("default", "ingress-annotator", ""),
-			newCM:      createConfigMap("default", "ingress-annotator", "rule1:\n  key1: value1"),
+			cm:         createConfigMap("default", "ingress-annotator", "rule1:\n  key1: value1"),
 			nn:         types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
 			requestNN:  types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
-			want:       ctrl.Result{RequeueAfter: 30 * time.Second},
+			want:       ctrl.Result{},
+			wantRules:  &model.Rules{"rule1": {"key1": "value1"}},
+		},
+		{
+			name:          "Empty rules when ConfigMap not found",
+			clientOpts:    &fakeclient.ClientOpts{GetNotFoundError: true},
+			missingPolicy: model.MissingPolicyEmpty,
+			cm:            createConfigMap("default", "ingress-annotator", "rule1:\n  key1: value1"),
+			nn:            types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
+			requestNN:     types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
+			want:          ctrl.Result{},
+			wantRules:     &model.Rules{},
+		},
+		{
+			name:          "Empty rules when ConfigMap not found with Ingress list error",
+			clientOpts:    &fakeclient.ClientOpts{GetNotFoundError: true, ListError: true},
+			missingPolicy: model.MissingPolicyEmpty,
+			cm:            createConfigMap("default", "ingress-annotator", "rule1:\n  key1: value1"),
+			nn:            types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
+			requestNN:     types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
+			want:          ctrl.Result{},
+			wantError:     "failed to annotateAllIngresses: failed to list ingresses: mocked ListError",
+		},
+		{
+			name:          "Pause when ConfigMap not found",
+			clientOpts:    &fakeclient.ClientOpts{GetNotFoundError: true},
+			missingPolicy: model.MissingPolicyPause,
+			cm:            createConfigMap("default", "ingress-annotator", "rule1:\n  key1: value1"),
+			nn:            types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
+			requestNN:     types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
+			want:          ctrl.Result{},
+			wantRules:     &model.Rules{"rule1": {"key1": "value1"}},
+			wantPaused:    true,
 		},
 		{
 			name:       "Error during Ingress list should result in requeue",
@@ -99,30 +158,34 @@ func TestConfigMapReconciler_Reconcile(t *testing.T) {
 			requestNN:  types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
 			want:       ctrl.Result{},
 			wantError:  "failed to annotateAllIngresses: failed to list ingresses: mocked ListError",
+			wantEvents: []string{"Normal RulesLoaded Loaded 1 rules (generation b8a831bf6b3c)"},
 		},
 		{
-			name:      "Unmarshal error on invalid ConfigMap data",
-			cm:        createConfigMap("default", "ingress-annotator", "rule1:\n  key1: value1"),
-			newCM:     createConfigMap("default", "ingress-annotator", "invalid rules"),
-			nn:        types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
-			requestNN: types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
-			want:      ctrl.Result{RequeueAfter: 30 * time.Second},
-			wantError: "failed to update rules in rules store: failed to extract rules from configMap: failed to unmarshal rules: yaml: unmarshal errors:\n  line 1: cannot unmarshal !!str `invalid...` into model.Rules",
+			name:       "Unmarshal error on invalid ConfigMap data",
+			cm:         createConfigMap("default", "ingress-annotator", "rule1:\n  key1: value1"),
+			newCM:      createConfigMap("default", "ingress-annotator", "invalid rules"),
+			nn:         types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
+			requestNN:  types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
+			want:       ctrl.Result{},
+			wantError:  "failed to update rules in rules store: failed to extract rules from configMap: failed to unmarshal rules: yaml: unmarshal errors:\n  line 1: cannot unmarshal !!str `invalid...` into model.Rules",
+			wantEvents: []string{"Warning RulesInvalid Failed to load rules: failed to extract rules from configMap: failed to unmarshal rules: yaml: unmarshal errors:\n  line 1: cannot unmarshal !!str `invalid...` into model.Rules"},
 		},
 		{
-			name:      "No requeue when ConfigMap has no changes",
-			cm:        createConfigMap("default", "ingress-annotator", "rule1:\n  key1: value1"),
-			newCM:     createConfigMap("default", "ingress-annotator", "rule1:\n  key1: value1"),
-			nn:        types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
-			requestNN: types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
-			want:      ctrl.Result{},
+			name:       "No requeue when ConfigMap has no changes",
+			cm:         createConfigMap("default", "ingress-annotator", "rule1:\n  key1: value1"),
+			newCM:      createConfigMap("default", "ingress-annotator", "rule1:\n  key1: value1"),
+			nn:         types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
+			requestNN:  types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
+			want:       ctrl.Result{},
+			wantEvents: []string{"Normal RulesLoaded Loaded 1 rules (generation b8a831bf6b3c)"},
 		},
 		{
-			name:      "Process valid ConfigMap without errors or requeue",
-			cm:        createConfigMap("default", "ingress-annotator", "rule1:\n  key1: value1"),
-			nn:        types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
-			requestNN: types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
-			want:      ctrl.Result{},
+			name:       "Process valid ConfigMap without errors or requeue",
+			cm:         createConfigMap("default", "ingress-annotator", "rule1:\n  key1: value1"),
+			nn:         types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
+			requestNN:  types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
+			want:       ctrl.Result{},
+			wantEvents: []string{"Normal RulesLoaded Loaded 1 rules (generation b8a831bf6b3c)"},
 		},
 		{
 			name:      "No errors when request name differs from ConfigMap name",
@@ -141,10 +204,17 @@ func TestConfigMapReconciler_Reconcile(t *testing.T) {
 			client := fakeclient.NewClient(tc.clientOpts, tc.cm)
 			store, err := rulesstore.New(tc.cm)
 			assert.NoError(t, err)
+			missingPolicy := model.MissingPolicyKeep
+			if tc.missingPolicy != "" {
+				missingPolicy = tc.missingPolicy
+			}
+			recorder := record.NewFakeRecorder(10)
 			reconciler := &ConfigMapReconciler{
-				NN:         tc.nn,
-				Client:     client,
-				RulesStore: store,
+				NN:            tc.nn,
+				Client:        client,
+				RulesStore:    store,
+				MissingPolicy: missingPolicy,
+				Recorder:      recorder,
 			}
 
 			if tc.newCM != nil {
@@ -159,6 +229,16 @@ func TestConfigMapReconciler_Reconcile(t *testing.T) {
 				assert.EqualError(t, err, tc.wantError)
 			}
 			assert.Equal(t, tc.want, got)
+			if tc.wantRules != nil {
+				assert.Equal(t, tc.wantRules, store.GetRules())
+			}
+			assert.Equal(t, tc.wantPaused, store.IsPaused())
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			assert.Equal(t, tc.wantEvents, events)
 		})
 	}
 }
@@ -177,22 +257,23 @@ func TestConfigMapReconciler_annotateAllIngresses(t *testing.T) {
 		},
 		{
 			clientOpts: &fakeclient.ClientOpts{GetError: "*"},
-			wantError:  "failed to annotateIngress: failed to get ingress default/ingress1: mocked GetError",
+			wantError:  "failed to update 2 of 2 Ingresses: default/ingress1: failed to get ingress default/ingress1: mocked GetError; default/ingress2: failed to get ingress default/ingress2: mocked GetError",
 		},
 		{
 			clientOpts: &fakeclient.ClientOpts{UpdateError: true},
-			wantError:  "failed to annotateIngress: failed to update ingress default/ingress1: mocked UpdateError",
+			wantError:  "failed to update 2 of 2 Ingresses: default/ingress1: failed to update ingress default/ingress1: mocked UpdateError; default/ingress2: failed to update ingress default/ingress2: mocked UpdateError",
 		},
 		{
 			clientOpts: &fakeclient.ClientOpts{UpdateConflictError: true},
-			wantError:  "failed to annotateIngress: mocked UpdateConflictError: Operation cannot be fulfilled on ingresses.networking.k8s.io \"ingress1\": the object has been modified; please apply your changes to the latest version and try again",
+			wantError:  "failed to update 2 of 2 Ingresses: default/ingress1: mocked UpdateConflictError: Operation cannot be fulfilled on ingresses.networking.k8s.io \"ingress1\": the object has been modified; please apply your changes to the latest version and try again; default/ingress2: mocked UpdateConflictError: Operation cannot be fulfilled on ingresses.networking.k8s.io \"ingress2\": the object has been modified; please apply your changes to the latest version and try again",
 		},
 	}
 	for i, tc := range testCases {
 		t.Run(testcase.Name(i), func(t *testing.T) {
 			client := fakeclient.NewClient(tc.clientOpts, ingress1, ingress2)
 			reconciler := &ConfigMapReconciler{
-				Client: client,
+				Client:     client,
+				RulesStore: rulesstore.NewMissing(model.MissingPolicyKeep),
 			}
 			err := reconciler.annotateAllIngresses(context.TODO())
 			if tc.wantError == "" {
@@ -203,3 +284,1003 @@ func TestConfigMapReconciler_annotateAllIngresses(t *testing.T) {
 		})
 	}
 }
+
+func TestConfigMapReconciler_annotateAllIngresses_Scope(t *testing.T) {
+	teamNamespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team", Labels: map[string]string{"team": "a"}}}
+	otherNamespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other"}}
+	team1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress1", Namespace: "team"}}
+	other1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress1", Namespace: "other"}}
+	s, err := scope.Parse("", "team=a")
+	require.NoError(t, err)
+
+	client := fakeclient.NewClient(nil, teamNamespace, otherNamespace, team1, other1)
+	reconciler := &ConfigMapReconciler{
+		Client:     client,
+		RulesStore: rulesstore.NewMissing(model.MissingPolicyKeep),
+		Scope:      s,
+	}
+	require.NoError(t, reconciler.annotateAllIngresses(context.TODO()))
+
+	var got networkingv1.Ingress
+	require.NoError(t, client.Get(context.TODO(), types.NamespacedName{Namespace: "team", Name: "ingress1"}, &got))
+	assert.Equal(t, "true", got.Annotations[model.ReconcileKey])
+	require.NoError(t, client.Get(context.TODO(), types.NamespacedName{Namespace: "other", Name: "ingress1"}, &got))
+	assert.NotContains(t, got.Annotations, model.ReconcileKey)
+}
+
+func TestConfigMapReconciler_annotateAllIngresses_Shard(t *testing.T) {
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	ingress1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress1", Namespace: "default"}}
+
+	testCases := []struct {
+		members       []string
+		wantTriggered bool
+	}{
+		{
+			members:       []string{"pod-0"},
+			wantTriggered: true,
+		},
+		{
+			members:       []string{"pod-1"},
+			wantTriggered: false,
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i), func(t *testing.T) {
+			client := fakeclient.NewClient(nil, namespace, ingress1.DeepCopy())
+			reconciler := &ConfigMapReconciler{
+				Client:     client,
+				RulesStore: rulesstore.NewMissing(model.MissingPolicyKeep),
+				Shard:      shard.NewFixed("pod-0", tc.members...),
+			}
+			require.NoError(t, reconciler.annotateAllIngresses(context.TODO()))
+
+			var got networkingv1.Ingress
+			require.NoError(t, client.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: "ingress1"}, &got))
+			_, triggered := got.Annotations[model.ReconcileKey]
+			assert.Equal(t, tc.wantTriggered, triggered)
+		})
+	}
+}
+
+func TestConfigMapReconciler_Reconcile_RolloutFailed(t *testing.T) {
+	nn := types.NamespacedName{Namespace: "default", Name: "ingress-annotator"}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: nn.Namespace, Name: nn.Name},
+		Data:       map[string]string{"rules": "rule1:\n  key1: value1"},
+	}
+	ingress1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress1", Namespace: "default"}}
+	ingress2 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress2", Namespace: "default"}}
+	store, err := rulesstore.New(cm)
+	require.NoError(t, err)
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &ConfigMapReconciler{
+		NN:         nn,
+		Client:     fakeclient.NewClient(&fakeclient.ClientOpts{UpdateError: true}, cm, ingress1, ingress2),
+		RulesStore: store,
+		Recorder:   recorder,
+		Rollout:    rollout.New(rollout.Options{BatchSize: 1}, nil),
+	}
+
+	_, err = reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: nn})
+	assert.EqualError(t, err, "failed to annotateAllIngresses: failed to update 2 of 2 Ingresses: "+
+		"default/ingress1: failed to update ingress default/ingress1: mocked UpdateError; "+
+		"default/ingress2: failed to update ingress default/ingress2: mocked UpdateError")
+	close(recorder.Events)
+	var events []string
+	for event := range recorder.Events {
+		events = append(events, event)
+	}
+	assert.Equal(t, []string{
+		"Normal RulesLoaded Loaded 1 rules (generation b8a831bf6b3c)",
+		"Warning RolloutFailed Failed to update 2 of 2 Ingresses",
+	}, events)
+}
+
+func TestConfigMapReconciler_Reconcile_Debounce(t *testing.T) {
+	nn := types.NamespacedName{Namespace: "default", Name: "ingress-annotator"}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: nn.Namespace, Name: nn.Name},
+		Data:       map[string]string{"rules": "rule1:\n  key1: value1"},
+	}
+	store, err := rulesstore.New(cm)
+	require.NoError(t, err)
+	ingress1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress1", Namespace: "default"}}
+	client := fakeclient.NewClient(nil, cm, ingress1)
+	now := time.Now()
+	reconciler := &ConfigMapReconciler{
+		NN:         nn,
+		Client:     client,
+		RulesStore: store,
+		Recorder:   record.NewFakeRecorder(10),
+		Debounce:   10 * time.Second,
+		now:        func() time.Time { return now },
+	}
+	updateRules := func(rules string) {
+		var got corev1.ConfigMap
+		require.NoError(t, client.Get(context.TODO(), nn, &got))
+		got.Data["rules"] = rules
+		require.NoError(t, client.Update(context.TODO(), &got))
+	}
+	triggered := func() bool {
+		var got networkingv1.Ingress
+		require.NoError(t, client.Get(context.TODO(), types.NamespacedName{Namespace: "default", Name: ingress1.Name}, &got))
+		_, ok := got.Annotations[model.ReconcileKey]
+		return ok
+	}
+
+	// Each change of the rules restarts the window.
+	updateRules("rule1:\n  key1: value2")
+	result, err := reconciler.Reconcile(context.TODO(), ctrl.Request{NamespacedName: nn})
+	require.NoError(t, err)
+	assert.Equal(t, ctrl.Result{RequeueAfter: 10 * time.Second}, result)
+
+	now = now.Add(4 * time.Second)
+	updateRules("rule1:\n  key1: value3")
+	result, err = reconciler.Reconcile(context.TODO(), ctrl.Request{NamespacedName: nn})
+	require.NoError(t, err)
+	assert.Equal(t, ctrl.Result{RequeueAfter: 10 * time.Second}, result)
+
+	// Other updates of the ConfigMap do not.
+	now = now.Add(4 * time.Second)
+	result, err = reconciler.Reconcile(context.TODO(), ctrl.Request{NamespacedName: nn})
+	require.NoError(t, err)
+	assert.Equal(t, ctrl.Result{RequeueAfter: 6 * time.Second}, result)
+	assert.False(t, triggered())
+	assert.Equal(t, &model.Rules{"rule1": {"key1": "value1"}}, store.GetRules())
+
+	// The final rules are rolled out once they settle.
+	now = now.Add(6 * time.Second)
+	result, err = reconciler.Reconcile(context.TODO(), ctrl.Request{NamespacedName: nn})
+	require.NoError(t, err)
+	assert.Equal(t, ctrl.Result{}, result)
+	assert.True(t, triggered())
+	assert.Equal(t, &model.Rules{"rule1": {"key1": "value3"}}, store.GetRules())
+}
+
+func TestConfigMapReconciler_Reconcile_DebounceKeepsIngresses(t *testing.T) {
+	nn := types.NamespacedName{Namespace: "default", Name: "ingress-annotator"}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: nn.Namespace, Name: nn.Name},
+		Data:       map[string]string{"rules": "rule1:\n  key1: value1"},
+	}
+	store, err := rulesstore.New(cm)
+	require.NoError(t, err)
+	ingressNN := types.NamespacedName{Namespace: "default", Name: "ingress1"}
+	ingress1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: ingressNN.Namespace, Name: ingressNN.Name,
+		Annotations: map[string]string{model.RulesKey: "rule1"}}}
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	client := fakeclient.NewClient(nil, cm, namespace, ingress1)
+	reconciler := &ConfigMapReconciler{
+		NN:         nn,
+		Client:     client,
+		RulesStore: store,
+		Recorder:   record.NewFakeRecorder(10),
+		Debounce:   10 * time.Second,
+	}
+	ingressReconciler := &ingresscontroller.IngressReconciler{
+		Client:     client,
+		RulesStore: store,
+		StateStore: &statestore.AnnotationStateStore{},
+		Recorder:   record.NewFakeRecorder(10),
+	}
+	annotations := func() map[string]string {
+		var got networkingv1.Ingress
+		require.NoError(t, client.Get(context.TODO(), ingressNN, &got))
+		return got.Annotations
+	}
+
+	_, err = ingressReconciler.Reconcile(context.TODO(), ctrl.Request{NamespacedName: ingressNN})
+	require.NoError(t, err)
+	want := annotations()
+	assert.Equal(t, "value1", want["key1"])
+
+	var got corev1.ConfigMap
+	require.NoError(t, client.Get(context.TODO(), nn, &got))
+	got.Data["rules"] = "rule1:\n  key1: value2"
+	require.NoError(t, client.Update(context.TODO(), &got))
+	result, err := reconciler.Reconcile(context.TODO(), ctrl.Request{NamespacedName: nn})
+	require.NoError(t, err)
+	assert.Equal(t, ctrl.Result{RequeueAfter: 10 * time.Second}, result)
+
+	// An Ingress reconciled while the rules settle keeps the loaded rules.
+	_, err = ingressReconciler.Reconcile(context.TODO(), ctrl.Request{NamespacedName: ingressNN})
+	require.NoError(t, err)
+	assert.Equal(t, want, annotations())
+}
+
+func TestConfigMapReconciler_Reconcile_Checkpoint(t *testing.T) {
+	nn := types.NamespacedName{Namespace: "default", Name: "ingress-annotator"}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: nn.Namespace, Name: nn.Name},
+		Data:       map[string]string{"rules": "rule1:\n  key1: value1"},
+	}
+	store, err := rulesstore.New(cm)
+	require.NoError(t, err)
+	ingressNN := types.NamespacedName{Namespace: "default", Name: "ingress1"}
+	ingress1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: ingressNN.Namespace, Name: ingressNN.Name}}
+	client := fakeclient.NewClient(nil, cm, ingress1)
+	checkpoints := &rollout.ConfigMapCheckpointStore{
+		Client: client,
+		NN:     types.NamespacedName{Namespace: nn.Namespace, Name: nn.Name + "-rollout"},
+	}
+	reconciler := &ConfigMapReconciler{
+		NN:         nn,
+		Client:     client,
+		RulesStore: store,
+		Recorder:   record.NewFakeRecorder(20),
+		Rollout:    rollout.New(rollout.Options{}, checkpoints),
+	}
+
+	testCases := []struct {
+		name          string
+		settings      map[string]string
+		wantTriggered bool
+		wantID        string
+	}{
+		{
+			name:          "New rules are rolled out",
+			wantTriggered: true,
+			wantID:        "b8a831bf6b3c",
+		},
+		{
+			name:          "Rules already rolled out are not",
+			wantTriggered: false,
+			wantID:        "b8a831bf6b3c",
+		},
+		{
+			name:          "Enabling cleanup rolls out again",
+			settings:      map[string]string{"cleanup": "true"},
+			wantTriggered: true,
+			wantID:        "b8a831bf6b3c+cleanup",
+		},
+		{
+			name:          "Pausing evaluates Ingresses in place",
+			settings:      map[string]string{"paused": "true"},
+			wantTriggered: false,
+			wantID:        "b8a831bf6b3c+paused",
+		},
+		{
+			name:          "Resuming rolls out again",
+			wantTriggered: true,
+			wantID:        "b8a831bf6b3c",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			var got corev1.ConfigMap
+			require.NoError(t, client.Get(context.TODO(), nn, &got))
+			got.Data = map[string]string{"rules": "rule1:\n  key1: value1"}
+			for k, v := range tc.settings {
+				got.Data[k] = v
+			}
+			require.NoError(t, client.Update(context.TODO(), &got))
+
+			_, err := reconciler.Reconcile(context.TODO(), ctrl.Request{NamespacedName: nn})
+			require.NoError(t, err)
+
+			var ing networkingv1.Ingress
+			require.NoError(t, client.Get(context.TODO(), ingressNN, &ing))
+			_, triggered := ing.Annotations[model.ReconcileKey]
+			assert.Equal(t, tc.wantTriggered, triggered)
+			checkpoint, err := checkpoints.Load(context.TODO())
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantID, checkpoint.ID)
+
+			// The IngressReconciler removes the trigger.
+			delete(ing.Annotations, model.ReconcileKey)
+			require.NoError(t, client.Update(context.TODO(), &ing))
+		})
+	}
+}
+
+func TestConfigMapReconciler_Reconcile_Superseded(t *testing.T) {
+	nn := types.NamespacedName{Namespace: "default", Name: "ingress-annotator"}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: nn.Namespace, Name: nn.Name},
+		Data:       map[string]string{"rules": "rule1:\n  key1: value1"},
+	}
+	ingress1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress1", Namespace: "default"}}
+	ingress2 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress2", Namespace: "default"}}
+	store, err := rulesstore.New(cm)
+	require.NoError(t, err)
+	client := fakeclient.NewClient(nil, cm, ingress1, ingress2)
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &ConfigMapReconciler{
+		NN:         nn,
+		Client:     client,
+		RulesStore: store,
+		Recorder:   recorder,
+		// The second Ingress waits 10s for its turn.
+		Rollout: rollout.New(rollout.Options{QPS: 0.1}, nil),
+	}
+
+	type reconcileResult struct {
+		result ctrl.Result
+		err    error
+	}
+	done := make(chan reconcileResult)
+	go func() {
+		result, err := reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: nn})
+		done <- reconcileResult{result, err}
+	}()
+	triggered := func(ing *networkingv1.Ingress) bool {
+		var got networkingv1.Ingress
+		require.NoError(t, client.Get(context.TODO(), types.NamespacedName{Namespace: ing.Namespace, Name: ing.Name}, &got))
+		_, ok := got.Annotations[model.ReconcileKey]
+		return ok
+	}
+	require.Eventually(t, func() bool { return triggered(ingress1) }, 5*time.Second, 10*time.Millisecond)
+
+	newer := cm.DeepCopy()
+	newer.Data["rules"] = "rule1:\n  key1: value2"
+	reconciler.supersede(context.TODO(), event.UpdateEvent{ObjectOld: cm, ObjectNew: newer}, nil)
+	select {
+	case got := <-done:
+		assert.NoError(t, got.err)
+		assert.Equal(t, ctrl.Result{}, got.result)
+	case <-time.After(5 * time.Second):
+		t.Fatal("rollout not cancelled")
+	}
+	assert.False(t, triggered(ingress2))
+
+	close(recorder.Events)
+	var events []string
+	for event := range recorder.Events {
+		events = append(events, event)
+	}
+	assert.Equal(t, []string{
+		"Normal RulesLoaded Loaded 1 rules (generation b8a831bf6b3c)",
+		"Normal RolloutSuperseded Cancelled the rollout of generation b8a831bf6b3c for newer rules",
+	}, events)
+}
+
+func TestConfigMapReconciler_Reconcile_Paused(t *testing.T) {
+	nn := types.NamespacedName{Namespace: "default", Name: "ingress-annotator"}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: nn.Namespace, Name: nn.Name},
+		Data:       map[string]string{"rules": "rule1:\n  key1: value1"},
+	}
+	ingress1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress1", Namespace: "default"}}
+	ingress2 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress2", Namespace: "default"}}
+	store, err := rulesstore.New(cm)
+	require.NoError(t, err)
+	client := fakeclient.NewClient(nil, cm, ingress1, ingress2)
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &ConfigMapReconciler{
+		NN:         nn,
+		Client:     client,
+		RulesStore: store,
+		Recorder:   recorder,
+		// The second Ingress waits 10s for its turn.
+		Rollout: rollout.New(rollout.Options{QPS: 0.1}, nil),
+	}
+
+	type reconcileResult struct {
+		result ctrl.Result
+		err    error
+	}
+	done := make(chan reconcileResult)
+	go func() {
+		result, err := reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: nn})
+		done <- reconcileResult{result, err}
+	}()
+	triggered := func(ing *networkingv1.Ingress) bool {
+		var got networkingv1.Ingress
+		require.NoError(t, client.Get(context.TODO(), types.NamespacedName{Namespace: ing.Namespace, Name: ing.Name}, &got))
+		_, ok := got.Annotations[model.ReconcileKey]
+		return ok
+	}
+	require.Eventually(t, func() bool { return triggered(ingress1) }, 5*time.Second, 10*time.Millisecond)
+
+	// A pause raised during the rollout stops it before the next Ingress.
+	paused := cm.DeepCopy()
+	paused.Data["paused"] = "true"
+	reconciler.supersede(context.TODO(), event.UpdateEvent{ObjectOld: cm, ObjectNew: paused}, nil)
+	select {
+	case got := <-done:
+		assert.NoError(t, got.err)
+		assert.Equal(t, ctrl.Result{}, got.result)
+	case <-time.After(5 * time.Second):
+		t.Fatal("rollout not cancelled")
+	}
+	assert.False(t, triggered(ingress2))
+
+	close(recorder.Events)
+	var events []string
+	for event := range recorder.Events {
+		events = append(events, event)
+	}
+	assert.Equal(t, []string{
+		"Normal RulesLoaded Loaded 1 rules (generation b8a831bf6b3c)",
+		"Normal RolloutPaused Cancelled the rollout of generation b8a831bf6b3c for a pause",
+	}, events)
+}
+
+func TestConfigMapReconciler_supersede(t *testing.T) {
+	newConfigMap := func(rules string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{Data: map[string]string{"rules": rules}}
+	}
+	rolling, err := rulesstore.Generation(newConfigMap("rule1:\n  key1: value1"))
+	require.NoError(t, err)
+
+	pausedConfigMap := func(rules, paused string) *corev1.ConfigMap {
+		cm := newConfigMap(rules)
+		cm.Data["paused"] = paused
+		return cm
+	}
+
+	testCases := []struct {
+		name      string
+		loaded    *corev1.ConfigMap
+		cm        *corev1.ConfigMap
+		wantCause error
+	}{
+		{
+			name: "Same rules keep the rollout",
+			cm:   newConfigMap("rule1: {key1: value1}"),
+		},
+		{
+			name:      "Newer rules cancel the rollout",
+			cm:        newConfigMap("rule1:\n  key1: value2"),
+			wantCause: errSuperseded,
+		},
+		{
+			name: "Invalid rules keep the rollout",
+			cm:   newConfigMap("invalid"),
+		},
+		{
+			name:      "Pause cancels the rollout",
+			cm:        pausedConfigMap("rule1:\n  key1: value1", "true"),
+			wantCause: errPaused,
+		},
+		{
+			name:      "Pause with newer rules cancels the rollout",
+			cm:        pausedConfigMap("rule1:\n  key1: value2", "true"),
+			wantCause: errPaused,
+		},
+		{
+			name:   "Pause already loaded keeps the rollout",
+			loaded: pausedConfigMap("rule1:\n  key1: value1", "true"),
+			cm:     pausedConfigMap("rule1:\n  key1: value1", "true"),
+		},
+		{
+			name: "Invalid pause setting keeps the rollout",
+			cm:   pausedConfigMap("rule1:\n  key1: value1", "maybe"),
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			loaded := tc.loaded
+			if loaded == nil {
+				loaded = newConfigMap("rule1:\n  key1: value1")
+			}
+			store, err := rulesstore.New(loaded)
+			require.NoError(t, err)
+			reconciler := &ConfigMapReconciler{RulesStore: store}
+			// Without a rollout in flight there is nothing to cancel.
+			reconciler.supersede(context.TODO(), event.UpdateEvent{ObjectNew: tc.cm}, nil)
+
+			ctx, done := reconciler.startRollout(context.Background(), rolling)
+			reconciler.supersede(context.TODO(), event.UpdateEvent{ObjectNew: tc.cm}, nil)
+			if tc.wantCause != nil {
+				assert.ErrorIs(t, context.Cause(ctx), tc.wantCause)
+			} else {
+				assert.NoError(t, ctx.Err())
+			}
+
+			// A rollout that is over is no longer cancelled.
+			done()
+			reconciler.supersede(context.TODO(), event.UpdateEvent{ObjectNew: tc.cm}, nil)
+			assert.Nil(t, reconciler.cancel)
+		})
+	}
+}
+
+func TestConfigMapReconciler_annotateAllIngresses_Waves(t *testing.T) {
+	canaryNamespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "canary", Labels: map[string]string{"canary": "true"}}}
+	canary1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress1", Namespace: "canary"}}
+	ingress1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress1", Namespace: "default"}}
+	ingress2 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress2", Namespace: "default"}}
+
+	testCases := []struct {
+		name          string
+		probeStatus   int
+		previousRules bool
+		wantError     string
+		wantTriggered []string
+		wantHeld      []string
+		wantRules     *model.Rules
+	}{
+		{
+			name:          "Healthy waves update all Ingresses",
+			probeStatus:   http.StatusOK,
+			wantTriggered: []string{"canary/ingress1", "default/ingress1", "default/ingress2"},
+			wantRules:     &model.Rules{"rule1": {"key1": "value2"}},
+		},
+		{
+			name:          "Unhealthy canary rolls back",
+			probeStatus:   http.StatusServiceUnavailable,
+			previousRules: true,
+			wantError:     "rollout aborted after wave 1: health probe returned 503 Service Unavailable; rolled back to generation b8a831bf6b3c",
+			wantTriggered: []string{"canary/ingress1"},
+			wantRules:     &model.Rules{"rule1": {"key1": "value1"}},
+		},
+		{
+			name:          "Unhealthy canary without previous rules holds the others",
+			probeStatus:   http.StatusServiceUnavailable,
+			wantError:     "rollout aborted after wave 1: health probe returned 503 Service Unavailable; Ingresses not updated yet are held until the rules change",
+			wantTriggered: []string{"canary/ingress1"},
+			wantHeld:      []string{"default/ingress1", "default/ingress2"},
+			wantRules:     &model.Rules{"rule1": {"key1": "value2"}},
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(tc.probeStatus)
+			}))
+			defer server.Close()
+
+			client := fakeclient.NewClient(nil, canaryNamespace, canary1, ingress1, ingress2)
+			store := rulesstore.NewMissing(model.MissingPolicyKeep)
+			if tc.previousRules {
+				require.NoError(t, store.UpdateRules(&corev1.ConfigMap{Data: map[string]string{"rules": "rule1:\n  key1: value1"}}))
+			}
+			require.NoError(t, store.UpdateRules(&corev1.ConfigMap{Data: map[string]string{"rules": "rule1:\n  key1: value2"}}))
+			engine := rollout.New(rollout.Options{Waves: []int{100}}, nil)
+			reconciler := &ConfigMapReconciler{
+				Client:         client,
+				RulesStore:     store,
+				Rollout:        engine,
+				CanarySelector: labels.SelectorFromSet(labels.Set{"canary": "true"}),
+				HealthChecks:   rollout.HealthChecks{&rollout.ProbeCheck{URL: server.URL, Client: server.Client()}},
+			}
+			err := reconciler.annotateAllIngresses(context.TODO())
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.wantRules, store.GetRules())
+
+			var ingressList networkingv1.IngressList
+			require.NoError(t, client.List(context.TODO(), &ingressList))
+			var triggered, held []string
+			for _, ing := range ingressList.Items {
+				if _, ok := ing.Annotations[model.ReconcileKey]; ok {
+					triggered = append(triggered, ing.Namespace+"/"+ing.Name)
+				}
+				if engine.Gate().Holds(types.NamespacedName{Namespace: ing.Namespace, Name: ing.Name}) {
+					held = append(held, ing.Namespace+"/"+ing.Name)
+				}
+			}
+			assert.Equal(t, tc.wantTriggered, triggered)
+			assert.Equal(t, tc.wantHeld, held)
+		})
+	}
+}
+
+func TestConfigMapReconciler_Reconcile_FailureRateRollback(t *testing.T) {
+	nn := types.NamespacedName{Namespace: "default", Name: "ingress-annotator"}
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: nn.Namespace, Name: nn.Name},
+		Data: map[string]string{"rules": "rule1:\n  key1: value2"}}
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	ingress1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress1", Namespace: "default"}}
+	ingress2 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress2", Namespace: "default"}}
+
+	testCases := []struct {
+		name           string
+		previousRules  bool
+		wantEvents     []string
+		wantRules      *model.Rules
+		wantRollbacks  float64
+		wantRolledBack string
+	}{
+		{
+			name:          "Failures roll back to the previous rules",
+			previousRules: true,
+			wantEvents: []string{
+				"Normal RulesLoaded Loaded 1 rules (generation 782c7e9dd69a)",
+				"Warning RolloutAborted rollout aborted after wave 1: 1 of 1 Ingresses failed to update, last: failed to update ingress default/ingress1: mocked UpdateError; rolled back to generation b8a831bf6b3c",
+				"Warning RulesRolledBack Rolled back to the previous rules (generation b8a831bf6b3c)",
+			},
+			wantRules:      &model.Rules{"rule1": {"key1": "value1"}},
+			wantRollbacks:  1,
+			wantRolledBack: "782c7e9dd69a",
+		},
+		{
+			name: "Failures without previous rules abort the rollout",
+			wantEvents: []string{
+				"Normal RulesLoaded Loaded 1 rules (generation 782c7e9dd69a)",
+				"Warning RolloutAborted rollout aborted after wave 1: 1 of 1 Ingresses failed to update, last: failed to update ingress default/ingress1: mocked UpdateError; the previous rules are not known",
+			},
+			wantRules: &model.Rules{"rule1": {"key1": "value2"}},
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			client := fakeclient.NewClient(&fakeclient.ClientOpts{UpdateError: true}, cm, namespace, ingress1, ingress2)
+			store := rulesstore.NewMissing(model.MissingPolicyKeep)
+			if tc.previousRules {
+				require.NoError(t, store.UpdateRules(&corev1.ConfigMap{Data: map[string]string{"rules": "rule1:\n  key1: value1"}}))
+			}
+			recorder := record.NewFakeRecorder(10)
+			reconciler := &ConfigMapReconciler{
+				NN:         nn,
+				Client:     client,
+				RulesStore: store,
+				Recorder:   recorder,
+				Rollout:    rollout.New(rollout.Options{MaxFailureRatio: 0.5}, nil),
+			}
+			rollbacks := promtestutil.ToFloat64(metrics.RulesRollbacks.WithLabelValues("failure_rate"))
+
+			// Retrying would not help, so the aborted rollout is not requeued.
+			_, err := reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: nn})
+			require.NoError(t, err)
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			assert.Equal(t, tc.wantEvents, events)
+			assert.Equal(t, tc.wantRules, store.GetRules())
+			assert.Equal(t, tc.wantRolledBack, store.GetRolledBackGeneration())
+			assert.Equal(t, rollbacks+tc.wantRollbacks, promtestutil.ToFloat64(metrics.RulesRollbacks.WithLabelValues("failure_rate")))
+
+			// Loading the ConfigMap again keeps the rollback.
+			recorder.Events = make(chan string, 10)
+			_, err = reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: nn})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantRules, store.GetRules())
+		})
+	}
+}
+
+// webhookClient rejects the updates of Ingresses setting key1 to value2,
+// like an admission webhook of the ingress controller would.
+type webhookClient struct {
+	client.Client
+}
+
+func (c webhookClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	if _, ok := obj.(*networkingv1.Ingress); ok && obj.GetAnnotations()["key1"] == "value2" {
+		return errors.New("admission webhook denied the request: invalid key1")
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+func TestConfigMapReconciler_Reconcile_RejectedUpdateRollback(t *testing.T) {
+	nn := types.NamespacedName{Namespace: "default", Name: "ingress-annotator"}
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: nn.Namespace, Name: nn.Name},
+		Data: map[string]string{"rules": "rule1:\n  key1: value2"}}
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	var objs []client.Object
+	for _, name := range []string{"ingress1", "ingress2", "ingress3", "ingress4"} {
+		objs = append(objs, &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default",
+			Annotations: map[string]string{model.RulesKey: "rule1"}}})
+	}
+	c := fakeclient.NewClient(nil, append(objs, cm, namespace)...)
+	store := rulesstore.NewMissing(model.MissingPolicyKeep)
+	require.NoError(t, store.UpdateRules(&corev1.ConfigMap{Data: map[string]string{"rules": "rule1:\n  key1: value1"}}))
+	tracker := progress.NewTracker()
+	ingressReconciler := &ingresscontroller.IngressReconciler{
+		Client:     webhookClient{c},
+		RulesStore: store,
+		StateStore: &statestore.AnnotationStateStore{},
+		Recorder:   record.NewFakeRecorder(100),
+		Progress:   tracker,
+	}
+	// reconcileIngress runs the reconciles the trigger of an Ingress enqueues.
+	reconcileIngress := func(nn types.NamespacedName) {
+		for {
+			result, _ := ingressReconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: nn})
+			if !result.Requeue {
+				return
+			}
+		}
+	}
+	recorder := record.NewFakeRecorder(10)
+	reconciler := &ConfigMapReconciler{
+		NN:         nn,
+		Client:     c,
+		RulesStore: store,
+		Recorder:   recorder,
+		Rollout: rollout.New(rollout.Options{BatchSize: 2, MaxFailureRatio: 0.5, Failures: func(keys []types.NamespacedName) map[string]error {
+			// The triggered Ingresses are reconciled before the failures are counted.
+			for _, key := range keys {
+				reconcileIngress(key)
+			}
+			return tracker.Failures(store.GetGeneration(), keys)
+		}}, nil),
+	}
+
+	// The trigger annotations are written, but the updates applying the rules
+	// are rejected: the rollout stops after the first batch and is rolled back.
+	_, err := reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: nn})
+	require.NoError(t, err)
+	close(recorder.Events)
+	var events []string
+	for event := range recorder.Events {
+		events = append(events, event)
+	}
+	assert.Equal(t, []string{
+		"Normal RulesLoaded Loaded 1 rules (generation 782c7e9dd69a)",
+		"Warning RolloutAborted rollout aborted after wave 1: 2 of 2 Ingresses failed to update, last: admission webhook denied the request: invalid key1; rolled back to generation b8a831bf6b3c",
+		"Warning RulesRolledBack Rolled back to the previous rules (generation b8a831bf6b3c)",
+	}, events)
+	assert.Equal(t, &model.Rules{"rule1": {"key1": "value1"}}, store.GetRules())
+
+	// The Ingresses are triggered again, and get the previous rules.
+	ingressNN := types.NamespacedName{Namespace: "default", Name: "ingress1"}
+	reconcileIngress(ingressNN)
+	var ing networkingv1.Ingress
+	require.NoError(t, c.Get(context.Background(), ingressNN, &ing))
+	assert.Equal(t, "value1", ing.Annotations["key1"])
+}
+
+type fakePreviewer struct{}
+
+func (fakePreviewer) PreviewRules(_ context.Context, ing *networkingv1.Ingress, _ *corev1.Namespace,
+	_ *model.Rules, generation string) (dryrun.Change, error) {
+	switch ing.Name {
+	case "ingress1":
+		return dryrun.Change{Namespace: ing.Namespace, Name: ing.Name, Generation: generation,
+			Added: map[string]string{"key2": "value2"}}, nil
+	case "ingress3":
+		return dryrun.Change{}, errors.New("mocked error")
+	}
+	return dryrun.Change{Namespace: ing.Namespace, Name: ing.Name, Generation: generation}, nil
+}
+
+func TestConfigMapReconciler_Reconcile_StagedRules(t *testing.T) {
+	nn := types.NamespacedName{Namespace: "default", Name: "ingress-annotator"}
+	namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	ingress1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress1", Namespace: "default"}}
+	ingress2 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress2", Namespace: "default"}}
+	ingress3 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress3", Namespace: "default"}}
+	staged := "rule1:\n  key2: value2"
+	stagedGeneration := "814db929417a"
+
+	testCases := []struct {
+		name        string
+		data        map[string]string
+		promote     string
+		dryRun      bool
+		wantData    map[string]string
+		wantEvents  []string
+		wantChanges []dryrun.Change
+	}{
+		{
+			name:     "Staged rules are previewed",
+			data:     map[string]string{"rules": "rule1:\n  key1: value1", "rules-staged": staged},
+			wantData: map[string]string{"rules": "rule1:\n  key1: value1", "rules-staged": staged},
+			wantEvents: []string{
+				"Normal RulesLoaded Loaded 1 rules (generation b8a831bf6b3c)",
+				"Normal StagedRulesPreviewed Promoting staged rules (generation " + stagedGeneration + ") would change 2 of 3 Ingresses",
+			},
+			wantChanges: []dryrun.Change{
+				{Namespace: "default", Name: "ingress1", Generation: stagedGeneration, Added: map[string]string{"key2": "value2"}},
+				{Namespace: "default", Name: "ingress3", Generation: stagedGeneration, Reason: "mocked error"},
+			},
+		},
+		{
+			name:     "No staged rules",
+			data:     map[string]string{"rules": "rule1:\n  key1: value1"},
+			wantData: map[string]string{"rules": "rule1:\n  key1: value1"},
+			wantEvents: []string{
+				"Normal RulesLoaded Loaded 1 rules (generation b8a831bf6b3c)",
+			},
+		},
+		{
+			name:     "Promote",
+			data:     map[string]string{"rules": "rule1:\n  key1: value1", "rules-staged": staged},
+			promote:  "true",
+			wantData: map[string]string{"rules": staged},
+			wantEvents: []string{
+				"Normal RulesLoaded Loaded 1 rules (generation b8a831bf6b3c)",
+				"Normal RulesPromoted Promoted staged rules (generation " + stagedGeneration + ")",
+			},
+		},
+		{
+			name:     "Promote previewed generation",
+			data:     map[string]string{"rules": "rule1:\n  key1: value1", "rules-staged": staged},
+			promote:  stagedGeneration,
+			wantData: map[string]string{"rules": staged},
+			wantEvents: []string{
+				"Normal RulesLoaded Loaded 1 rules (generation b8a831bf6b3c)",
+				"Normal RulesPromoted Promoted staged rules (generation " + stagedGeneration + ")",
+			},
+		},
+		{
+			name:     "Promote other generation",
+			data:     map[string]string{"rules": "rule1:\n  key1: value1", "rules-staged": staged},
+			promote:  "0123456789ab",
+			wantData: map[string]string{"rules": "rule1:\n  key1: value1", "rules-staged": staged},
+			wantEvents: []string{
+				"Normal RulesLoaded Loaded 1 rules (generation b8a831bf6b3c)",
+				"Warning PromotionRefused Staged rules are generation " + stagedGeneration + ", not 0123456789ab",
+			},
+		},
+		{
+			name:     "Promote without staged rules",
+			data:     map[string]string{"rules": "rule1:\n  key1: value1"},
+			promote:  "true",
+			wantData: map[string]string{"rules": "rule1:\n  key1: value1"},
+			wantEvents: []string{
+				"Normal RulesLoaded Loaded 1 rules (generation b8a831bf6b3c)",
+				"Warning PromotionRefused There are no staged rules to promote",
+			},
+		},
+		{
+			name:     "Promote in dry run",
+			data:     map[string]string{"rules": "rule1:\n  key1: value1", "rules-staged": staged},
+			promote:  "true",
+			dryRun:   true,
+			wantData: map[string]string{"rules": "rule1:\n  key1: value1", "rules-staged": staged},
+			wantEvents: []string{
+				"Normal RulesLoaded Loaded 1 rules (generation b8a831bf6b3c)",
+				"Normal DryRun Dry run; staged rules (generation " + stagedGeneration + ") not promoted",
+				"Normal StagedRulesPreviewed Promoting staged rules (generation " + stagedGeneration + ") would change 2 of 3 Ingresses",
+			},
+			wantChanges: []dryrun.Change{
+				{Namespace: "default", Name: "ingress1", Generation: stagedGeneration, Added: map[string]string{"key2": "value2"}},
+				{Namespace: "default", Name: "ingress3", Generation: stagedGeneration, Reason: "mocked error"},
+			},
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: nn.Namespace, Name: nn.Name}, Data: tc.data}
+			if tc.promote != "" {
+				cm.Annotations = map[string]string{model.PromoteKey: tc.promote}
+			}
+			client := fakeclient.NewClient(nil, cm, namespace, ingress1, ingress2, ingress3)
+			recorder := record.NewFakeRecorder(10)
+			report := dryrun.NewReport()
+			report.Record(dryrun.Change{Namespace: "default", Name: "stale"})
+			reconciler := &ConfigMapReconciler{
+				NN:           nn,
+				Client:       client,
+				RulesStore:   rulesstore.NewMissing(model.MissingPolicyKeep),
+				Recorder:     recorder,
+				Previewer:    fakePreviewer{},
+				StagedReport: report,
+				DryRun:       tc.dryRun,
+			}
+
+			_, err := reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: nn})
+			require.NoError(t, err)
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			assert.Equal(t, tc.wantEvents, events)
+
+			var got corev1.ConfigMap
+			require.NoError(t, client.Get(context.Background(), nn, &got))
+			assert.Equal(t, tc.wantData, got.Data)
+			if tc.dryRun {
+				assert.Contains(t, got.Annotations, model.PromoteKey)
+			} else {
+				assert.NotContains(t, got.Annotations, model.PromoteKey)
+			}
+			if tc.promote == "" || tc.dryRun {
+				if tc.wantChanges == nil {
+					tc.wantChanges = []dryrun.Change{}
+				}
+				assert.Equal(t, tc.wantChanges, report.Changes())
+			}
+		})
+	}
+}
+
+func TestConfigMapReconciler_annotateAllIngresses_Hold(t *testing.T) {
+	ingress1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress1", Namespace: "default"}}
+	ingress2 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress2", Namespace: "paused"}}
+	ingress3 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress3", Namespace: "default",
+		Annotations: map[string]string{model.PausedKey: "true"}}}
+	pausedNamespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "paused",
+		Annotations: map[string]string{model.PausedKey: "true"}}}
+	all := []string{"default/ingress1", "default/ingress3", "paused/ingress2"}
+
+	testCases := []struct {
+		name          string
+		dryRun        bool
+		configMapData map[string]string
+		reconcileErr  error
+		wantEvaluated []string
+		wantTriggered []string
+	}{
+		{
+			name:          "Paused Namespaces and Ingresses are evaluated in place",
+			wantEvaluated: []string{"default/ingress3", "paused/ingress2"},
+			wantTriggered: []string{"default/ingress1"},
+		},
+		{
+			name:          "Dry run evaluates all Ingresses in place",
+			dryRun:        true,
+			wantEvaluated: all,
+		},
+		{
+			name:          "Paused ConfigMap evaluates all Ingresses in place",
+			configMapData: map[string]string{"rules": "", "paused": "true"},
+			wantEvaluated: all,
+		},
+		{
+			name:          "Evaluation errors do not stop the rollout",
+			dryRun:        true,
+			reconcileErr:  errors.New("mocked error"),
+			wantEvaluated: all,
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			client := fakeclient.NewClient(nil, pausedNamespace, ingress1, ingress2, ingress3)
+			store := rulesstore.NewMissing(model.MissingPolicyKeep)
+			if tc.configMapData != nil {
+				assert.NoError(t, store.UpdateRules(&corev1.ConfigMap{Data: tc.configMapData}))
+			}
+			var evaluated []string
+			reconciler := &ConfigMapReconciler{
+				Client:     client,
+				RulesStore: store,
+				DryRun:     tc.dryRun,
+				IngressReconciler: reconcile.Func(func(_ context.Context, req ctrl.Request) (ctrl.Result, error) {
+					evaluated = append(evaluated, req.String())
+					return ctrl.Result{}, tc.reconcileErr
+				}),
+			}
+			assert.NoError(t, reconciler.annotateAllIngresses(context.TODO()))
+			sort.Strings(evaluated)
+			assert.Equal(t, tc.wantEvaluated, evaluated)
+
+			var ingressList networkingv1.IngressList
+			assert.NoError(t, client.List(context.TODO(), &ingressList))
+			var triggered []string
+			for _, ing := range ingressList.Items {
+				if _, ok := ing.Annotations[model.ReconcileKey]; ok {
+					triggered = append(triggered, ing.Namespace+"/"+ing.Name)
+				}
+			}
+			assert.Equal(t, tc.wantTriggered, triggered)
+		})
+	}
+}
+
+func TestConfigMapReconciler_Tracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(previous)
+
+	nn := types.NamespacedName{Namespace: "default", Name: "ingress-annotator"}
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: nn.Namespace, Name: nn.Name},
+		Data:       map[string]string{"rules": "rule2:\n  key2: value2\nrule1:\n  key1: value1"},
+	}
+	ingress := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress1", Namespace: "default"}}
+	client := fakeclient.NewClient(nil, cm, ingress)
+	store, err := rulesstore.New(cm)
+	assert.NoError(t, err)
+
+	reconciler := &ConfigMapReconciler{
+		NN:         nn,
+		Client:     client,
+		RulesStore: store,
+		Recorder:   record.NewFakeRecorder(10),
+	}
+	_, err = reconciler.Reconcile(context.Background(), ctrl.Request{NamespacedName: nn})
+	assert.NoError(t, err)
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+	enqueue, reconcile := spans[0], spans[1]
+	assert.Equal(t, "Enqueue Ingress", enqueue.Name)
+	assert.Equal(t, "ConfigMap reconcile", reconcile.Name)
+	assert.Equal(t, reconcile.SpanContext.SpanID(), enqueue.Parent.SpanID())
+	assert.Contains(t, enqueue.Attributes, tracing.AttrIngress.String("ingress1"))
+	assert.Contains(t, reconcile.Attributes, tracing.AttrRulesGeneration.String(store.GetGeneration()))
+	assert.Contains(t, reconcile.Attributes, tracing.AttrRuleNames.StringSlice([]string{"rule1", "rule2"}))
+}
@@ -19,18 +19,46 @@ package ingresscontroller
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/trace"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/kuoss/ingress-annotator/pkg/audit"
+	"github.com/kuoss/ingress-annotator/pkg/backoff"
+	"github.com/kuoss/ingress-annotator/pkg/dryrun"
+	"github.com/kuoss/ingress-annotator/pkg/metrics"
 	"github.com/kuoss/ingress-annotator/pkg/model"
+	"github.com/kuoss/ingress-annotator/pkg/progress"
+	"github.com/kuoss/ingress-annotator/pkg/rollout"
 	"github.com/kuoss/ingress-annotator/pkg/rulesstore"
+	"github.com/kuoss/ingress-annotator/pkg/scope"
+	"github.com/kuoss/ingress-annotator/pkg/shard"
+	"github.com/kuoss/ingress-annotator/pkg/statestore"
+	"github.com/kuoss/ingress-annotator/pkg/tracing"
+	"github.com/kuoss/ingress-annotator/pkg/trigger"
 	"github.com/kuoss/ingress-annotator/pkg/util"
 )
 
@@ -39,32 +67,170 @@ type ingressScope struct {
 	namespace          *corev1.Namespace
 	ingress            *networkingv1.Ingress
 	updatedAnnotations model.Annotations
+	previousState      *model.ManagedState
+	state              *model.ManagedState
+	ruleNames          []string
+	unknownRules       []string
+	conflicts          []string
+	// heldBy is why changes are reported instead of written, if they are.
+	heldBy string
+	// heldBack is set when there were changes to hold back.
+	heldBack bool
+	// rules and generation replace those of the RulesStore, if set.
+	rules      *model.Rules
+	generation string
+	// preview computes the annotations without recording Events or metrics.
+	preview bool
 }
 
 type IngressReconciler struct {
 	client.Client
-	RulesStore rulesstore.IRulesStore
+	RulesStore     rulesstore.IRulesStore
+	StateStore     statestore.IStateStore
+	ConflictPolicy model.ConflictPolicy
+	Recorder       record.EventRecorder
+	Progress       *progress.Tracker
+	// DryRun computes the annotations without writing them; the changes that
+	// are held back are logged, recorded as Events and kept in DryRunReport.
+	DryRun       bool
+	DryRunReport *dryrun.Report
+	// Audit logs every change written to an Ingress.
+	Audit *audit.Logger
+	// Gate holds back the Ingresses a rollout in waves has not reached yet.
+	Gate *rollout.Gate
+	// Scope restricts the annotator to the Ingresses of some namespaces.
+	Scope *scope.Scope
+	// Shard restricts the reconciler to the namespaces of this replica when
+	// replicas share the namespaces.
+	Shard *shard.Shard
+	// Backoff paces the retries of failed reconciles, and Retries gives up
+	// on the Ingresses that keep failing.
+	Backoff *backoff.Policy
+	Retries *backoff.Retries
+	// Triggers holds what triggered the reconcile of each Ingress, for the
+	// audit log and the parent span of the reconcile.
+	Triggers *trigger.Triggers
 }
 
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 // +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;update;patch
 // +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses/finalizers,verbs=update
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *IngressReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&networkingv1.Ingress{}).
-		Complete(r)
+	inShard := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return r.Shard.Owns(obj.GetNamespace())
+	})
+	opts := controller.Options{RateLimiter: r.Backoff.RateLimiter()}
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&networkingv1.Ingress{}, builder.WithPredicates(relevantChange, inShard))
+	if r.Shard != nil {
+		// Every replica reconciles its own shard, including the namespaces
+		// it takes over from replicas that left. The Ingresses of the
+		// namespaces it hands over are reconciled once more to be forgotten.
+		opts.NeedLeaderElection = ptr.To(false)
+		b = b.WatchesRawSource(source.Channel(r.Shard.Gained(), handler.EnqueueRequestsFromMapFunc(r.ingressesInNamespace))).
+			WatchesRawSource(source.Channel(r.Shard.Lost(), handler.EnqueueRequestsFromMapFunc(r.ingressesInNamespace)))
+	}
+	return b.WithOptions(opts).Complete(r)
+}
+
+// forget drops what this replica reports about the Ingress nn.
+func (r *IngressReconciler) forget(nn types.NamespacedName) {
+	metrics.Tracker.Delete(nn)
+	r.Progress.Forget(nn)
+	r.DryRunReport.Forget(nn)
+}
+
+// ingressesInNamespace maps a Namespace to the requests of its Ingresses.
+func (r *IngressReconciler) ingressesInNamespace(ctx context.Context, obj client.Object) []reconcile.Request {
+	var ingressList networkingv1.IngressList
+	if err := r.List(ctx, &ingressList, client.InNamespace(obj.GetName())); err != nil {
+		ctrl.LoggerFrom(ctx).Error(err, "Failed to list Ingresses", "namespace", obj.GetName())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(ingressList.Items))
+	for _, ing := range ingressList.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&ing)})
+	}
+	return requests
+}
+
+// relevantChange filters out the updates of an Ingress that leave its
+// annotations, labels, class and hosts as they were, such as the status
+// updates of the ingress controller.
+var relevantChange = predicate.Funcs{
+	UpdateFunc: func(e event.UpdateEvent) bool {
+		oldIng, ok := e.ObjectOld.(*networkingv1.Ingress)
+		if !ok {
+			return true
+		}
+		newIng, ok := e.ObjectNew.(*networkingv1.Ingress)
+		if !ok {
+			return true
+		}
+		return !maps.Equal(oldIng.Annotations, newIng.Annotations) ||
+			!maps.Equal(oldIng.Labels, newIng.Labels) ||
+			classOf(oldIng) != classOf(newIng) ||
+			!slices.Equal(hostsOf(oldIng), hostsOf(newIng))
+	},
 }
 
-func (r *IngressReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func classOf(ing *networkingv1.Ingress) string {
+	if ing.Spec.IngressClassName == nil {
+		return ""
+	}
+	return *ing.Spec.IngressClassName
+}
+
+func hostsOf(ing *networkingv1.Ingress) []string {
+	var hosts []string
+	for _, rule := range ing.Spec.Rules {
+		hosts = append(hosts, rule.Host)
+	}
+	return hosts
+}
+
+func (r *IngressReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
+	// The trigger is kept until the Ingress has been reconciled, or given up on.
+	defer func() {
+		if err == nil && !result.Requeue || errors.Is(err, reconcile.TerminalError(nil)) {
+			r.Triggers.Forget(req.NamespacedName)
+		}
+	}()
+	defer func() { result, err = r.retry(req.NamespacedName, result, err) }()
+	defer metrics.ObserveReconcile("ingress", time.Now())
+	// Continue the trace of the rollout that enqueued this Ingress, if any.
+	ctx, span := tracing.Start(r.Triggers.Context(ctx, req.NamespacedName), "Ingress reconcile",
+		tracing.IngressAttributes(req.NamespacedName)...)
+	defer func() { tracing.End(span, err) }()
 	logger := ctrl.LoggerFrom(ctx)
 
+	// The namespace may have moved to another replica since the request was
+	// queued, or was handed over; its new owner reports the Ingress from now on.
+	if !r.Shard.Owns(req.Namespace) {
+		logger.V(1).Info("Namespace belongs to another shard, skipping Ingress")
+		r.forget(req.NamespacedName)
+		return ctrl.Result{}, nil
+	}
+	// Writes are paused until rules are available; the ConfigMap reconciler
+	// triggers all Ingresses again once they are.
+	if r.RulesStore.IsPaused() {
+		logger.Info("Rules are not available, skipping Ingress")
+		return ctrl.Result{}, nil
+	}
+
 	// Fetch Ingress resource
 	var ingress networkingv1.Ingress
 	if err := r.Get(ctx, req.NamespacedName, &ingress); err != nil {
 		if apierrors.IsNotFound(err) {
-			return ctrl.Result{}, nil
+			r.forget(req.NamespacedName)
+			if r.DryRun {
+				return ctrl.Result{}, nil
+			}
+			return ctrl.Result{}, r.StateStore.Delete(ctx, req.NamespacedName)
 		}
 		return ctrl.Result{}, err
 	}
@@ -74,8 +240,19 @@ func (r *IngressReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		return ctrl.Result{}, nil
 	}
 
+	// Fetch Namespace resource
+	var namespace corev1.Namespace
+	if err := r.Get(ctx, client.ObjectKey{Name: ingress.Namespace}, &namespace); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !r.Scope.Includes(&namespace) {
+		logger.V(1).Info("Namespace is out of scope, skipping Ingress")
+		return ctrl.Result{}, nil
+	}
+	heldBy := r.holdReason(&namespace, &ingress)
+
 	// ensure remove annotation key 'reconcile'
-	if _, exists := ingress.Annotations[model.ReconcileKey]; exists {
+	if _, exists := ingress.Annotations[model.ReconcileKey]; exists && heldBy == "" {
 		delete(ingress.Annotations, model.ReconcileKey)
 		if err := r.Update(ctx, &ingress); err != nil {
 			return ctrl.Result{}, err
@@ -83,10 +260,10 @@ func (r *IngressReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		return ctrl.Result{Requeue: true}, nil
 	}
 
-	// Fetch Namespace resource
-	var namespace corev1.Namespace
-	if err := r.Get(ctx, client.ObjectKey{Name: ingress.Namespace}, &namespace); err != nil {
-		return ctrl.Result{}, client.IgnoreNotFound(err)
+	// Load the state of previously applied annotations
+	state, err := r.StateStore.Load(ctx, &ingress)
+	if err != nil {
+		return ctrl.Result{}, err
 	}
 
 	// Initialize ingressScope
@@ -95,33 +272,441 @@ func (r *IngressReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ct
 		namespace:          &namespace,
 		ingress:            &ingress,
 		updatedAnnotations: copyAnnotations(ingress.Annotations), // Copy to avoid mutating original map
+		previousState:      state,
+		heldBy:             heldBy,
 	}
 
 	// Reconcile Ingress
 	return r.reconcileIngress(ctx, scope)
 }
 
-func (r *IngressReconciler) reconcileIngress(ctx context.Context, scope *ingressScope) (ctrl.Result, error) {
+func (r *IngressReconciler) reconcileIngress(ctx context.Context, scope *ingressScope) (_ ctrl.Result, err error) {
+	defer func() { r.recordProgress(scope, err) }()
+
 	originalAnnotations := copyAnnotations(scope.updatedAnnotations)
 	r.removeManagedAnnotations(scope)
-	r.addNewAnnotations(scope)
+	if err := r.addNewAnnotations(scope); err != nil {
+		scope.logger.Error(err, "Failed to apply rules to Ingress")
+		r.Recorder.Event(scope.ingress, corev1.EventTypeWarning, "AnnotationConflict", err.Error())
+		if scope.heldBy == "" {
+			r.updateStatusAnnotation(ctx, scope, originalAnnotations, err)
+		}
+		return ctrl.Result{}, err
+	}
+	setStatusAnnotation(scope, scope.updatedAnnotations, r.RulesStore.GetGeneration(), nil)
+
+	trace.SpanFromContext(ctx).SetAttributes(
+		tracing.AttrRulesGeneration.String(r.RulesStore.GetGeneration()),
+		tracing.AttrRuleNames.StringSlice(appliedRuleNames(scope.state)),
+	)
+
+	if scope.heldBy != "" {
+		r.reportHeldBack(scope, originalAnnotations)
+		return ctrl.Result{}, nil
+	}
+	r.DryRunReport.Forget(client.ObjectKeyFromObject(scope.ingress))
+
+	// Record the new state before the Ingress is updated, so that a failed
+	// update never leaves applied annotations without an owner.
+	scope.ingress.Annotations = scope.updatedAnnotations
+	if err := r.StateStore.Save(ctx, scope.ingress, scope.state); err != nil {
+		scope.logger.Error(err, "Failed to save managed state")
+		r.Recorder.Eventf(scope.ingress, corev1.EventTypeWarning, "UpdateFailed", "Failed to save managed state: %v", err)
+		return ctrl.Result{}, err
+	}
 
 	// Early exit if there are no changes to annotations.
-	if annotationsEqual(originalAnnotations, scope.updatedAnnotations) {
+	if annotationsEqual(originalAnnotations, scope.ingress.Annotations) {
+		metrics.Tracker.Set(client.ObjectKeyFromObject(scope.ingress), appliedRules(scope.state))
 		return ctrl.Result{}, nil
 	}
 
 	// Update the Ingress resource with new annotations.
-	scope.ingress.Annotations = scope.updatedAnnotations
-	if err := r.Update(ctx, scope.ingress); err != nil {
+	updateCtx, updateSpan := tracing.Start(ctx, "Update Ingress")
+	err = r.Update(updateCtx, scope.ingress)
+	tracing.End(updateSpan, err)
+	if err != nil {
 		scope.logger.Error(err, "Failed to update Ingress with new annotations")
-		return ctrl.Result{RequeueAfter: 30 * time.Second}, err
+		r.Recorder.Eventf(scope.ingress, corev1.EventTypeWarning, "UpdateFailed", "Failed to update annotations: %v", err)
+		return ctrl.Result{}, err
 	}
+	metrics.Tracker.Set(client.ObjectKeyFromObject(scope.ingress), appliedRules(scope.state))
 
 	scope.logger.Info("Successfully reconciled Ingress with new annotations")
+	added, changed, removed := diffAnnotations(originalAnnotations, scope.ingress.Annotations)
+	nn := client.ObjectKeyFromObject(scope.ingress)
+	entry := auditRecord(nn, originalAnnotations, scope.ingress.Annotations, added, changed, removed)
+	entry.Trigger = r.Triggers.Get(nn).Cause
+	entry.Generation = r.RulesStore.GetGeneration()
+	entry.Rules = appliedRuleNames(scope.state)
+	if err := r.Audit.Log(ctx, entry); err != nil {
+		scope.logger.Error(err, "Failed to write audit record")
+	}
+	metrics.AnnotationWrites.WithLabelValues("added").Add(float64(len(added)))
+	metrics.AnnotationWrites.WithLabelValues("changed").Add(float64(len(changed)))
+	metrics.AnnotationWrites.WithLabelValues("removed").Add(float64(len(removed)))
+	if message := describeChanges(added, changed, removed); message != "" {
+		r.Recorder.Eventf(scope.ingress, corev1.EventTypeNormal, "AnnotationsUpdated",
+			"Applied rules [%s] (generation %s): %s",
+			strings.Join(appliedRuleNames(scope.state), ", "), r.RulesStore.GetGeneration(), message)
+	}
 	return ctrl.Result{}, nil
 }
 
+// retry gives up on an Ingress once its reconciles failed more than
+// MaxRetries times in a row: it is marked failed and left as it is until it
+// or the rules change, instead of being retried forever.
+func (r *IngressReconciler) retry(nn types.NamespacedName, result ctrl.Result, err error) (ctrl.Result, error) {
+	defer func() { metrics.FailedIngresses.Set(float64(r.Retries.GivenUp())) }()
+	if err == nil {
+		if !result.Requeue {
+			r.Retries.Succeeded(nn)
+		}
+		return result, nil
+	}
+	if r.Retries.Failed(nn) {
+		return result, err
+	}
+	err = fmt.Errorf("retries exhausted: %w", err)
+	r.Progress.Fail(nn, r.RulesStore.GetGeneration(), err.Error())
+	return ctrl.Result{}, reconcile.TerminalError(err)
+}
+
+// setStatusAnnotation writes the IngressStatus to annotations, or removes it
+// when the Ingress does not reference any rules.
+func setStatusAnnotation(scope *ingressScope, annotations map[string]string, generation string, err error) {
+	if len(scope.ruleNames) == 0 {
+		delete(annotations, model.StatusKey)
+		return
+	}
+	status := model.IngressStatus{
+		Generation: generation,
+		Unresolved: scope.unknownRules,
+		Conflicts:  scope.conflicts,
+	}
+	for _, ruleName := range scope.ruleNames {
+		if !slices.Contains(scope.unknownRules, ruleName) {
+			status.Rules = append(status.Rules, ruleName)
+		}
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	annotations[model.StatusKey] = string(util.MustMarshalJSON(status))
+}
+
+// updateStatusAnnotation records err in the status annotation when the rules
+// could not be applied, leaving the other annotations as they were.
+func (r *IngressReconciler) updateStatusAnnotation(ctx context.Context, scope *ingressScope, originalAnnotations map[string]string, err error) {
+	annotations := copyAnnotations(originalAnnotations)
+	setStatusAnnotation(scope, annotations, r.RulesStore.GetGeneration(), err)
+	if annotationsEqual(originalAnnotations, annotations) {
+		return
+	}
+	scope.ingress.Annotations = annotations
+	if err := r.Update(ctx, scope.ingress); err != nil {
+		scope.logger.Error(err, "Failed to update Ingress status annotation")
+	}
+}
+
+// Reasons for holding back the changes to an Ingress.
+const (
+	heldByDryRun    = "Dry run"
+	heldByConfigMap = "Paused by rules ConfigMap"
+	heldByNamespace = "Paused by Namespace"
+	heldByIngress   = "Paused by Ingress"
+	heldByRollout   = "Awaiting rollout wave"
+)
+
+// holdReason returns why the changes to an Ingress are reported instead of
+// written, or "" if they are written.
+func (r *IngressReconciler) holdReason(namespace *corev1.Namespace, ing *networkingv1.Ingress) string {
+	switch {
+	case r.DryRun:
+		return heldByDryRun
+	case r.RulesStore.IsPauseRequested():
+		return heldByConfigMap
+	case model.IsPaused(namespace.Annotations):
+		return heldByNamespace
+	case model.IsPaused(ing.Annotations):
+		return heldByIngress
+	case r.Gate.Holds(client.ObjectKeyFromObject(ing)):
+		return heldByRollout
+	}
+	return ""
+}
+
+// Evaluate runs the IngressReconciler r in place during a dry run or a
+// pause, so that the changes held back are reported. Its errors are only
+// logged, so that one Ingress does not hold up the others.
+func Evaluate(ctx context.Context, r reconcile.Reconciler, nn types.NamespacedName) {
+	if r == nil {
+		return
+	}
+	if _, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: nn}); err != nil {
+		ctrl.LoggerFrom(ctx).Error(err, "Failed to evaluate Ingress", "ingress", nn)
+	}
+}
+
+// reportHeldBack records the changes held back by a dry run or a pause
+// instead of updating the Ingress.
+func (r *IngressReconciler) reportHeldBack(scope *ingressScope, originalAnnotations map[string]string) {
+	nn := client.ObjectKeyFromObject(scope.ingress)
+	added, changed, removed := diffAnnotations(originalAnnotations, scope.updatedAnnotations)
+	message := describeChanges(added, changed, removed)
+	if message == "" {
+		r.DryRunReport.Forget(nn)
+		return
+	}
+	scope.heldBack = true
+
+	ruleNames := appliedRuleNames(scope.state)
+	change := newChange(nn, r.RulesStore.GetGeneration(), ruleNames, scope.updatedAnnotations, added, changed, removed)
+	change.Reason = scope.heldBy
+	r.DryRunReport.Record(change)
+
+	scope.logger.Info("Not updating Ingress", "reason", scope.heldBy, "changes", message)
+	message = fmt.Sprintf("rules [%s] (generation %s): %s", strings.Join(ruleNames, ", "), r.RulesStore.GetGeneration(), message)
+	if scope.heldBy == heldByRollout {
+		// Most Ingresses wait for their wave; the report lists them without an Event each.
+		return
+	}
+	if scope.heldBy != heldByDryRun {
+		r.Recorder.Eventf(scope.ingress, corev1.EventTypeNormal, "Paused", "%s; would apply %s", scope.heldBy, message)
+		return
+	}
+	metrics.DryRunChanges.WithLabelValues("added").Add(float64(len(added)))
+	metrics.DryRunChanges.WithLabelValues("changed").Add(float64(len(changed)))
+	metrics.DryRunChanges.WithLabelValues("removed").Add(float64(len(removed)))
+	r.Recorder.Eventf(scope.ingress, corev1.EventTypeNormal, "DryRun", "Would apply %s", message)
+}
+
+// PreviewRules returns the change that replacing the current rules with rules
+// would make to ing, without writing or recording anything. Both rule sets
+// are applied to the Ingress as it is, so the change does not depend on how
+// far the rollout of the current rules went.
+func (r *IngressReconciler) PreviewRules(ctx context.Context, ing *networkingv1.Ingress, namespace *corev1.Namespace,
+	rules *model.Rules, generation string) (dryrun.Change, error) {
+	state, err := r.StateStore.Load(ctx, ing)
+	if err != nil {
+		return dryrun.Change{}, err
+	}
+	apply := func(rules *model.Rules, generation string) (*ingressScope, error) {
+		scope := &ingressScope{
+			logger:             logr.Discard(),
+			namespace:          namespace,
+			ingress:            ing,
+			updatedAnnotations: copyAnnotations(ing.Annotations),
+			previousState:      state,
+			rules:              rules,
+			generation:         generation,
+			preview:            true,
+		}
+		r.removeManagedAnnotations(scope)
+		return scope, r.addNewAnnotations(scope)
+	}
+
+	current, err := apply(r.RulesStore.GetRules(), r.RulesStore.GetGeneration())
+	if err != nil {
+		return dryrun.Change{}, fmt.Errorf("current rules: %w", err)
+	}
+	proposed, err := apply(rules, generation)
+	if err != nil {
+		return dryrun.Change{}, fmt.Errorf("proposed rules: %w", err)
+	}
+
+	added, changed, removed := diffAnnotations(current.updatedAnnotations, proposed.updatedAnnotations)
+	sort.Strings(removed)
+	return newChange(client.ObjectKeyFromObject(ing), generation, appliedRuleNames(proposed.state),
+		proposed.updatedAnnotations, added, changed, removed), nil
+}
+
+// newChange describes the annotations added, changed and removed on the
+// Ingress nn, with the values they take in after.
+func newChange(nn types.NamespacedName, generation string, ruleNames []string, after map[string]string,
+	added, changed, removed []string) dryrun.Change {
+	change := dryrun.Change{
+		Namespace:  nn.Namespace,
+		Name:       nn.Name,
+		Generation: generation,
+		Rules:      ruleNames,
+		Removed:    removed,
+	}
+	if len(added) > 0 {
+		change.Added = make(map[string]string)
+		for _, key := range added {
+			change.Added[key] = after[key]
+		}
+	}
+	if len(changed) > 0 {
+		change.Changed = make(map[string]string)
+		for _, key := range changed {
+			change.Changed[key] = after[key]
+		}
+	}
+	return change
+}
+
+// recordProgress records the outcome of a reconcile for the AnnotatorStatus.
+func (r *IngressReconciler) recordProgress(scope *ingressScope, err error) {
+	generation := r.RulesStore.GetGeneration()
+	if scope.heldBack {
+		// The Ingress keeps the annotations of the generation it was last
+		// updated with, so it is still pending.
+		generation = previousStatus(scope.ingress).Generation
+	}
+	result := progress.Result{
+		Generation:   generation,
+		Rules:        scope.ruleNames,
+		UnknownRules: scope.unknownRules,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	r.Progress.Record(client.ObjectKeyFromObject(scope.ingress), result)
+}
+
+// auditRecord describes the annotations added, changed and removed between
+// before and after.
+func auditRecord(nn types.NamespacedName, before, after map[string]string, added, changed, removed []string) audit.Record {
+	entry := audit.Record{
+		Time:      time.Now().UTC(),
+		Namespace: nn.Namespace,
+		Ingress:   nn.Name,
+	}
+	for _, key := range added {
+		entry.Changes = append(entry.Changes, audit.Change{Key: key, Operation: "added", New: after[key]})
+	}
+	for _, key := range changed {
+		entry.Changes = append(entry.Changes, audit.Change{Key: key, Operation: "changed", Old: before[key], New: after[key]})
+	}
+	for _, key := range removed {
+		entry.Changes = append(entry.Changes, audit.Change{Key: key, Operation: "removed", Old: before[key]})
+	}
+	sort.SliceStable(entry.Changes, func(i, j int) bool { return entry.Changes[i].Key < entry.Changes[j].Key })
+	return entry
+}
+
+// diffAnnotations returns the keys added, changed and removed between before
+// and after, leaving out the annotator's own bookkeeping keys.
+func diffAnnotations(before, after map[string]string) (added, changed, removed []string) {
+	for key, value := range after {
+		if isBookkeepingKey(key) {
+			continue
+		}
+		if oldValue, exists := before[key]; !exists {
+			added = append(added, key)
+		} else if oldValue != value {
+			changed = append(changed, key)
+		}
+	}
+	for key := range before {
+		if _, exists := after[key]; !exists && !isBookkeepingKey(key) {
+			removed = append(removed, key)
+		}
+	}
+	return added, changed, removed
+}
+
+// describeChanges summarizes the annotations added, changed and removed.
+func describeChanges(added, changed, removed []string) string {
+	var parts []string
+	for _, change := range []struct {
+		verb string
+		keys []string
+	}{{"added", added}, {"changed", changed}, {"removed", removed}} {
+		if len(change.keys) > 0 {
+			sort.Strings(change.keys)
+			parts = append(parts, fmt.Sprintf("%s %s", change.verb, strings.Join(change.keys, ", ")))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+func isBookkeepingKey(key string) bool {
+	return key == model.ManagedAnnotationsKey || key == model.ReconcileKey || key == model.StatusKey
+}
+
+// appliedRules returns the rules in state with the source of their reference.
+func appliedRules(state *model.ManagedState) map[string]model.Source {
+	rules := make(map[string]model.Source)
+	for _, annotation := range state.Annotations {
+		rules[annotation.Rule] = annotation.Source
+	}
+	return rules
+}
+
+func appliedRuleNames(state *model.ManagedState) []string {
+	ruleNames := []string{}
+	for _, annotation := range state.Annotations {
+		if !slices.Contains(ruleNames, annotation.Rule) {
+			ruleNames = append(ruleNames, annotation.Rule)
+		}
+	}
+	sort.Strings(ruleNames)
+	return ruleNames
+}
+
+// CleanupAll removes every managed annotation from all Ingresses, restoring
+// the values they displaced, and drops the managed state. It is meant to be
+// run when the annotator is uninstalled.
+func (r *IngressReconciler) CleanupAll(ctx context.Context) error {
+	var ingressList networkingv1.IngressList
+	if err := r.List(ctx, &ingressList); err != nil {
+		return fmt.Errorf("failed to list ingresses: %w", err)
+	}
+
+	var errs []error
+	for _, ing := range ingressList.Items {
+		if err := r.cleanupIngress(ctx, ing); err != nil {
+			errs = append(errs, fmt.Errorf("failed to clean up ingress %s/%s: %w", ing.Namespace, ing.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *IngressReconciler) cleanupIngress(ctx context.Context, ing networkingv1.Ingress) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := r.Get(ctx, client.ObjectKeyFromObject(&ing), &ing); err != nil {
+			return client.IgnoreNotFound(err)
+		}
+		state, err := r.StateStore.Load(ctx, &ing)
+		if err != nil {
+			return err
+		}
+
+		scope := &ingressScope{
+			logger:             ctrl.LoggerFrom(ctx),
+			ingress:            &ing,
+			updatedAnnotations: copyAnnotations(ing.Annotations),
+			previousState:      state,
+		}
+		r.removeManagedAnnotations(scope)
+		delete(scope.updatedAnnotations, model.ReconcileKey)
+		delete(scope.updatedAnnotations, model.StatusKey)
+
+		originalAnnotations := copyAnnotations(ing.Annotations)
+		ing.Annotations = scope.updatedAnnotations
+		if err := r.StateStore.Save(ctx, &ing, model.NewManagedState()); err != nil {
+			return err
+		}
+		if annotationsEqual(originalAnnotations, ing.Annotations) {
+			return nil
+		}
+		if err := r.Update(ctx, &ing); err != nil {
+			return err
+		}
+
+		added, changed, removed := diffAnnotations(originalAnnotations, ing.Annotations)
+		entry := auditRecord(client.ObjectKeyFromObject(&ing), originalAnnotations, ing.Annotations, added, changed, removed)
+		entry.Trigger = audit.TriggerCleanup
+		if err := r.Audit.Log(ctx, entry); err != nil {
+			scope.logger.Error(err, "Failed to write audit record")
+		}
+		return nil
+	})
+}
+
 func copyAnnotations(annotations map[string]string) map[string]string {
 	if annotations == nil {
 		return make(map[string]string)
@@ -134,55 +719,132 @@ func copyAnnotations(annotations map[string]string) map[string]string {
 }
 
 func (r *IngressReconciler) removeManagedAnnotations(scope *ingressScope) {
-	managedAnnotations := make(model.Annotations)
-	if value, ok := scope.ingress.Annotations[model.ManagedAnnotationsKey]; ok && value != "" {
-		if err := json.Unmarshal([]byte(value), &managedAnnotations); err != nil {
-			scope.logger.Error(err, "Warning: Failed to unmarshal managed annotations")
+	state := scope.previousState
+
+	for key, managed := range state.Annotations {
+		currentValue, exists := scope.updatedAnnotations[key]
+		if !exists || currentValue != managed.Value {
+			scope.logger.Info("Managed annotation was modified outside the annotator", "key", key)
+			if !scope.preview {
+				metrics.DriftDetections.Inc()
+			}
 		}
-	}
-
-	for key, value := range managedAnnotations {
-		if currentValue, exists := scope.updatedAnnotations[key]; exists && currentValue == value {
-			delete(scope.updatedAnnotations, key)
+		if exists && currentValue == managed.Value {
+			if originalValue, ok := state.Originals[key]; ok {
+				scope.updatedAnnotations[key] = originalValue
+			} else {
+				delete(scope.updatedAnnotations, key)
+			}
 		}
 	}
-	delete(scope.updatedAnnotations, model.ManagedAnnotationsKey)
 }
 
-func (r *IngressReconciler) addNewAnnotations(scope *ingressScope) {
+// addNewAnnotations applies the annotations of the referenced rules. Values
+// already present on the Ingress are handled according to the ConflictPolicy;
+// displaced values are kept so removeManagedAnnotations can restore them.
+func (r *IngressReconciler) addNewAnnotations(scope *ingressScope) error {
 	newAnnotations := r.getNewAnnotations(scope)
-	for key, value := range newAnnotations {
-		scope.updatedAnnotations[key] = value
+	state := model.NewManagedState()
+	var conflicts []string
+	knownConflicts := previousStatus(scope.ingress).Conflicts
+
+	for key, annotation := range newAnnotations {
+		if currentValue, exists := scope.updatedAnnotations[key]; exists {
+			// Values displaced on an earlier reconcile were already counted.
+			if previous, ok := scope.previousState.Originals[key]; currentValue != annotation.Value && (!ok || previous != currentValue) && !scope.preview {
+				metrics.AnnotationConflicts.WithLabelValues(string(r.ConflictPolicy)).Inc()
+			}
+			switch r.ConflictPolicy {
+			case model.ConflictPolicySkipIfPresent:
+				scope.logger.Info("Skipping annotation already present on Ingress", "key", key)
+				if currentValue != annotation.Value {
+					scope.conflicts = append(scope.conflicts, key)
+				}
+				// The conflict is reported once; the status annotation keeps listing it.
+				if currentValue != annotation.Value && !slices.Contains(knownConflicts, key) && !scope.preview {
+					r.Recorder.Eventf(scope.ingress, corev1.EventTypeWarning, "AnnotationConflict",
+						"Annotation %s is already set, skipped rule %s", key, annotation.Rule)
+				}
+				continue
+			case model.ConflictPolicyFail:
+				if currentValue != annotation.Value {
+					conflicts = append(conflicts, key)
+					continue
+				}
+			}
+			state.Originals[key] = currentValue
+		}
+		// Keep the generation in which the annotation was first applied as long as it is unchanged.
+		if previous, ok := scope.previousState.Annotations[key]; ok &&
+			previous.Value == annotation.Value && previous.Rule == annotation.Rule && previous.Source == annotation.Source {
+			annotation.Generation = previous.Generation
+		}
+		state.Annotations[key] = annotation
 	}
-	if len(newAnnotations) == 0 {
-		return
+	sort.Strings(scope.conflicts)
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		scope.conflicts = conflicts
+		return fmt.Errorf("annotations already set on Ingress: %s", strings.Join(conflicts, ", "))
 	}
 
-	b := util.MustMarshalJSON(newAnnotations)
-	scope.updatedAnnotations[model.ManagedAnnotationsKey] = string(b) + "\n"
+	for key, annotation := range state.Annotations {
+		scope.updatedAnnotations[key] = annotation.Value
+	}
+	scope.state = state
+	return nil
 }
 
-func (r *IngressReconciler) getNewAnnotations(scope *ingressScope) model.Annotations {
-	ruleNames := r.getRuleNames(scope)
-	rules := r.RulesStore.GetRules()
-	newAnnotations := make(model.Annotations)
+// previousStatus returns the status annotation of ing written by the last
+// reconcile that updated it, or an empty status if there is none.
+func previousStatus(ing *networkingv1.Ingress) model.IngressStatus {
+	var status model.IngressStatus
+	if err := json.Unmarshal([]byte(ing.Annotations[model.StatusKey]), &status); err != nil {
+		return model.IngressStatus{}
+	}
+	return status
+}
 
-	for _, ruleName := range ruleNames {
-		if annotations, exists := (*rules)[ruleName]; exists {
-			for k, v := range annotations {
-				newAnnotations[k] = v
-			}
-		} else {
-			scope.logger.Info("Warning: no ruleName in rules", "ruleName", ruleName)
+func (r *IngressReconciler) getNewAnnotations(scope *ingressScope) map[string]model.ManagedAnnotation {
+	rules, generation := scope.rules, scope.generation
+	if rules == nil {
+		if r.RulesStore.IsCleanupEnabled() {
+			scope.logger.Info("Cleanup is enabled, removing all managed annotations")
+			return map[string]model.ManagedAnnotation{}
 		}
+		rules, generation = r.RulesStore.GetRules(), r.RulesStore.GetGeneration()
 	}
-	return newAnnotations
-}
 
-func (r *IngressReconciler) getRuleNames(scope *ingressScope) []string {
 	namespaceRuleNames := getRuleNamesFromObject(scope.namespace, model.RulesKey)
 	ingressRuleNames := getRuleNamesFromObject(scope.ingress, model.RulesKey)
-	return mergeRuleNames(namespaceRuleNames, ingressRuleNames)
+	newAnnotations := make(map[string]model.ManagedAnnotation)
+
+	scope.ruleNames = mergeRuleNames(namespaceRuleNames, ingressRuleNames)
+	for _, ruleName := range scope.ruleNames {
+		annotations, exists := (*rules)[ruleName]
+		if !exists {
+			scope.unknownRules = append(scope.unknownRules, ruleName)
+			scope.logger.Info("Warning: no ruleName in rules", "ruleName", ruleName)
+			if !scope.preview {
+				r.Recorder.Eventf(scope.ingress, corev1.EventTypeWarning, "UnknownRule", "Rule %s is not defined", ruleName)
+				metrics.UnknownRuleReferences.Inc()
+			}
+			continue
+		}
+		source := model.SourceIngress
+		if slices.Contains(namespaceRuleNames, ruleName) {
+			source = model.SourceNamespace
+		}
+		for k, v := range annotations {
+			newAnnotations[k] = model.ManagedAnnotation{
+				Value:      v,
+				Rule:       ruleName,
+				Source:     source,
+				Generation: generation,
+			}
+		}
+	}
+	return newAnnotations
 }
 
 func annotationsEqual(a, b map[string]string) bool {
@@ -2,21 +2,39 @@ package ingresscontroller
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
 	"github.com/jmnote/tester/testcase"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"go.uber.org/mock/gomock"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
+	"github.com/kuoss/ingress-annotator/pkg/audit"
+	"github.com/kuoss/ingress-annotator/pkg/backoff"
+	"github.com/kuoss/ingress-annotator/pkg/dryrun"
+	"github.com/kuoss/ingress-annotator/pkg/metrics"
 	"github.com/kuoss/ingress-annotator/pkg/model"
+	"github.com/kuoss/ingress-annotator/pkg/progress"
+	"github.com/kuoss/ingress-annotator/pkg/rollout"
+	"github.com/kuoss/ingress-annotator/pkg/shard"
+	"github.com/kuoss/ingress-annotator/pkg/statestore"
 	"github.com/kuoss/ingress-annotator/pkg/testutil/fakeclient"
 	"github.com/kuoss/ingress-annotator/pkg/testutil/mocks"
+	"github.com/kuoss/ingress-annotator/pkg/tracing"
+	"github.com/kuoss/ingress-annotator/pkg/trigger"
 )
 
 func TestIngressReconciler_SetupWithManager(t *testing.T) {
@@ -29,27 +47,97 @@ func TestIngressReconciler_SetupWithManager(t *testing.T) {
 	reconciler := &IngressReconciler{
 		Client:     client,
 		RulesStore: store,
+		StateStore: &statestore.AnnotationStateStore{},
 	}
 
 	err := reconciler.SetupWithManager(fakeclient.NewManager())
 	assert.NoError(t, err)
 }
 
+func TestRelevantChange(t *testing.T) {
+	className := "nginx"
+	otherClassName := "traefik"
+	base := networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "my-ingress",
+			Annotations: map[string]string{model.RulesKey: "rule1"}, Labels: map[string]string{"app": "web"}},
+		Spec: networkingv1.IngressSpec{IngressClassName: &className,
+			Rules: []networkingv1.IngressRule{{Host: "a.example.com"}}},
+	}
+
+	testCases := []struct {
+		name   string
+		update func(ing *networkingv1.Ingress)
+		want   bool
+	}{
+		{
+			name: "Status",
+			update: func(ing *networkingv1.Ingress) {
+				ing.Status.LoadBalancer.Ingress = []networkingv1.IngressLoadBalancerIngress{{IP: "10.0.0.1"}}
+			},
+		},
+		{
+			name:   "Backend",
+			update: func(ing *networkingv1.Ingress) { ing.Spec.DefaultBackend = &networkingv1.IngressBackend{} },
+		},
+		{
+			name:   "Annotations",
+			update: func(ing *networkingv1.Ingress) { ing.Annotations = map[string]string{model.RulesKey: "rule2"} },
+			want:   true,
+		},
+		{
+			name:   "Labels",
+			update: func(ing *networkingv1.Ingress) { ing.Labels = nil },
+			want:   true,
+		},
+		{
+			name:   "Class",
+			update: func(ing *networkingv1.Ingress) { ing.Spec.IngressClassName = &otherClassName },
+			want:   true,
+		},
+		{
+			name: "Hosts",
+			update: func(ing *networkingv1.Ingress) {
+				ing.Spec.Rules = append(ing.Spec.Rules, networkingv1.IngressRule{Host: "b.example.com"})
+			},
+			want: true,
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			newIng := base.DeepCopy()
+			tc.update(newIng)
+			assert.Equal(t, tc.want, relevantChange.Update(event.UpdateEvent{ObjectOld: &base, ObjectNew: newIng}))
+		})
+	}
+
+	assert.True(t, relevantChange.Create(event.CreateEvent{Object: &base}))
+	assert.True(t, relevantChange.Delete(event.DeleteEvent{Object: &base}))
+}
+
 func TestIngressReconciler_Reconcile(t *testing.T) {
 	mockCtrl := gomock.NewController(t)
 	defer mockCtrl.Finish()
 
 	testCases := []struct {
-		name               string
-		clientOpts         *fakeclient.ClientOpts
-		requestNN          *types.NamespacedName
-		ingressAnnotations map[string]string
-		deletionTimestamp  *metav1.Time
-		finalizers         []string
-		wantResult         ctrl.Result
-		wantAnnotations    map[string]string
-		wantError          string
-		wantGetError       string
+		name                 string
+		clientOpts           *fakeclient.ClientOpts
+		conflictPolicy       model.ConflictPolicy
+		namespaceAnnotations map[string]string
+		stateStore           string
+		cleanup              bool
+		paused               bool
+		pauseRequested       bool
+		gate                 *rollout.Gate
+		shardMembers         []string
+		requestNN            *types.NamespacedName
+		ingressAnnotations   map[string]string
+		deletionTimestamp    *metav1.Time
+		finalizers           []string
+		wantResult           ctrl.Result
+		wantAnnotations      map[string]string
+		wantEvents           []string
+		wantError            string
+		wantGetError         string
 	}{
 		{
 			name:       "IngressExistsButNoAnnotations_ShouldReturnDefaultResult",
@@ -127,10 +215,12 @@ func TestIngressReconciler_Reconcile(t *testing.T) {
 			},
 			wantResult: ctrl.Result{},
 			wantAnnotations: map[string]string{
-				"annotator.ingress.kubernetes.io/managed-annotations": "{\"new-key\":\"new-value\"}\n",
+				"annotator.ingress.kubernetes.io/status":              `{"generation":"gen1","rules":["rule1"]}`,
+				"annotator.ingress.kubernetes.io/managed-annotations": "{\"version\":2,\"annotations\":{\"new-key\":{\"value\":\"new-value\",\"rule\":\"rule1\",\"source\":\"ingress\",\"generation\":\"gen1\"}}}\n",
 				"annotator.ingress.kubernetes.io/rules":               "rule1",
 				"new-key":                                             "new-value",
 			},
+			wantEvents: []string{"Normal AnnotationsUpdated Applied rules [rule1] (generation gen1): added new-key"},
 		},
 		{
 			name: "ValidIngressWithMatchingRule_ShouldAddNewAnnotations",
@@ -139,10 +229,12 @@ func TestIngressReconciler_Reconcile(t *testing.T) {
 			},
 			wantResult: ctrl.Result{},
 			wantAnnotations: map[string]string{
-				"annotator.ingress.kubernetes.io/managed-annotations": "{\"new-key\":\"new-value\"}\n",
+				"annotator.ingress.kubernetes.io/status":              `{"generation":"gen1","rules":["rule1"]}`,
+				"annotator.ingress.kubernetes.io/managed-annotations": "{\"version\":2,\"annotations\":{\"new-key\":{\"value\":\"new-value\",\"rule\":\"rule1\",\"source\":\"ingress\",\"generation\":\"gen1\"}}}\n",
 				"annotator.ingress.kubernetes.io/rules":               "rule1",
 				"new-key":                                             "new-value",
 			},
+			wantEvents: []string{"Normal AnnotationsUpdated Applied rules [rule1] (generation gen1): added new-key"},
 		},
 		{
 			name: "ValidIngressWithPreExistingAnnotations_ShouldRetainExistingAnnotations",
@@ -153,7 +245,8 @@ func TestIngressReconciler_Reconcile(t *testing.T) {
 			},
 			wantResult: ctrl.Result{},
 			wantAnnotations: map[string]string{
-				"annotator.ingress.kubernetes.io/managed-annotations": "{\"new-key\":\"new-value\"}\n",
+				"annotator.ingress.kubernetes.io/status":              `{"generation":"gen1","rules":["rule1"]}`,
+				"annotator.ingress.kubernetes.io/managed-annotations": "{\"version\":2,\"annotations\":{\"new-key\":{\"value\":\"new-value\",\"rule\":\"rule1\",\"source\":\"ingress\",\"generation\":\"gen1\"}}}\n",
 				"annotator.ingress.kubernetes.io/rules":               "rule1",
 				"new-key":                                             "new-value",
 			},
@@ -165,8 +258,10 @@ func TestIngressReconciler_Reconcile(t *testing.T) {
 			},
 			wantResult: ctrl.Result{},
 			wantAnnotations: map[string]string{
-				"annotator.ingress.kubernetes.io/rules": "xxx",
+				"annotator.ingress.kubernetes.io/status": `{"generation":"gen1","unresolved":["xxx"]}`,
+				"annotator.ingress.kubernetes.io/rules":  "xxx",
 			},
+			wantEvents: []string{"Warning UnknownRule Rule xxx is not defined"},
 		},
 		{
 			name: "NoChangesDetected_ShouldReturnEarlyWithoutUpdates",
@@ -177,10 +272,297 @@ func TestIngressReconciler_Reconcile(t *testing.T) {
 			},
 			wantResult: ctrl.Result{},
 			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/status":              `{"generation":"gen1","rules":["rule1"]}`,
+				"annotator.ingress.kubernetes.io/managed-annotations": "{\"version\":2,\"annotations\":{\"new-key\":{\"value\":\"new-value\",\"rule\":\"rule1\",\"source\":\"ingress\",\"generation\":\"gen1\"}},\"originals\":{\"new-key\":\"old-value\"}}\n",
+				"annotator.ingress.kubernetes.io/rules":               "rule1",
+				"new-key":                                             "new-value",
+			},
+			wantEvents: []string{"Normal AnnotationsUpdated Applied rules [rule1] (generation gen1): changed new-key"},
+		},
+		{
+			name: "ExistingAnnotationWithOverwritePolicy_ShouldStashOriginalValue",
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/rules": "rule1",
+				"new-key":                               "user-value",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/status":              `{"generation":"gen1","rules":["rule1"]}`,
+				"annotator.ingress.kubernetes.io/managed-annotations": "{\"version\":2,\"annotations\":{\"new-key\":{\"value\":\"new-value\",\"rule\":\"rule1\",\"source\":\"ingress\",\"generation\":\"gen1\"}},\"originals\":{\"new-key\":\"user-value\"}}\n",
+				"annotator.ingress.kubernetes.io/rules":               "rule1",
+				"new-key":                                             "new-value",
+			},
+			wantEvents: []string{"Normal AnnotationsUpdated Applied rules [rule1] (generation gen1): changed new-key"},
+		},
+		{
+			name: "RuleRemoved_ShouldRestoreOriginalValue",
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/managed-annotations": "{\"version\":2,\"annotations\":{\"new-key\":{\"value\":\"new-value\",\"rule\":\"rule1\",\"source\":\"ingress\",\"generation\":\"gen1\"}},\"originals\":{\"new-key\":\"user-value\"}}\n",
+				"new-key": "new-value",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"new-key": "user-value",
+			},
+			wantEvents: []string{"Normal AnnotationsUpdated Applied rules [] (generation gen1): changed new-key"},
+		},
+		{
+			name: "ManagedStateV2WithoutChanges_ShouldKeepGeneration",
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/status":              `{"generation":"gen1","rules":["rule1"]}`,
+				"annotator.ingress.kubernetes.io/managed-annotations": "{\"version\":2,\"annotations\":{\"new-key\":{\"value\":\"new-value\",\"rule\":\"rule1\",\"source\":\"ingress\",\"generation\":\"gen0\"}}}\n",
+				"annotator.ingress.kubernetes.io/rules":               "rule1",
+				"new-key":                                             "new-value",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/status":              `{"generation":"gen1","rules":["rule1"]}`,
+				"annotator.ingress.kubernetes.io/managed-annotations": "{\"version\":2,\"annotations\":{\"new-key\":{\"value\":\"new-value\",\"rule\":\"rule1\",\"source\":\"ingress\",\"generation\":\"gen0\"}}}\n",
+				"annotator.ingress.kubernetes.io/rules":               "rule1",
+				"new-key":                                             "new-value",
+			},
+		},
+		{
+			name: "RuleFromNamespace_ShouldRecordNamespaceSource",
+			namespaceAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/rules": "rule1",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/status":              `{"generation":"gen1","rules":["rule1"]}`,
+				"annotator.ingress.kubernetes.io/managed-annotations": "{\"version\":2,\"annotations\":{\"new-key\":{\"value\":\"new-value\",\"rule\":\"rule1\",\"source\":\"namespace\",\"generation\":\"gen1\"}}}\n",
+				"new-key": "new-value",
+			},
+			wantEvents: []string{"Normal AnnotationsUpdated Applied rules [rule1] (generation gen1): added new-key"},
+		},
+		{
+			name: "ManagedStateV2RuleRemoved_ShouldRestoreOriginalValue",
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/managed-annotations": "{\"version\":2,\"annotations\":{\"new-key\":{\"value\":\"new-value\",\"rule\":\"rule1\",\"source\":\"ingress\",\"generation\":\"gen0\"}},\"originals\":{\"new-key\":\"user-value\"}}\n",
+				"new-key": "new-value",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"new-key": "user-value",
+			},
+			wantEvents: []string{"Normal AnnotationsUpdated Applied rules [] (generation gen1): changed new-key"},
+		},
+		{
+			name:       "ConfigMapStateStore_ShouldMoveManagedStateOutOfIngress",
+			stateStore: statestore.TypeConfigMap,
+			ingressAnnotations: map[string]string{
 				"annotator.ingress.kubernetes.io/managed-annotations": "{\"new-key\":\"new-value\"}\n",
 				"annotator.ingress.kubernetes.io/rules":               "rule1",
 				"new-key":                                             "new-value",
 			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/status": `{"generation":"gen1","rules":["rule1"]}`,
+				"annotator.ingress.kubernetes.io/rules":  "rule1",
+				"new-key":                                "new-value",
+			},
+		},
+		{
+			name: "NamespaceRulesAnnotationRemoved_ShouldRestoreOriginalValue",
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/managed-annotations": "{\"version\":2,\"annotations\":{\"new-key\":{\"value\":\"new-value\",\"rule\":\"rule1\",\"source\":\"namespace\",\"generation\":\"gen0\"}},\"originals\":{\"new-key\":\"user-value\"}}\n",
+				"new-key": "new-value",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"new-key": "user-value",
+			},
+			wantEvents: []string{"Normal AnnotationsUpdated Applied rules [] (generation gen1): changed new-key"},
+		},
+		{
+			name:    "CleanupEnabled_ShouldRemoveManagedAnnotations",
+			cleanup: true,
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/managed-annotations": "{\"version\":2,\"annotations\":{\"new-key\":{\"value\":\"new-value\",\"rule\":\"rule1\",\"source\":\"ingress\",\"generation\":\"gen0\"}},\"originals\":{\"new-key\":\"user-value\"}}\n",
+				"annotator.ingress.kubernetes.io/rules":               "rule1",
+				"new-key":                                             "new-value",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/rules": "rule1",
+				"new-key":                               "user-value",
+			},
+			wantEvents: []string{"Normal AnnotationsUpdated Applied rules [] (generation gen1): changed new-key"},
+		},
+		{
+			name:   "RulesPaused_ShouldNotUpdateIngress",
+			paused: true,
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/reconcile": "true",
+				"annotator.ingress.kubernetes.io/rules":     "rule1",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/reconcile": "true",
+				"annotator.ingress.kubernetes.io/rules":     "rule1",
+			},
+		},
+		{
+			name:           "PausedByConfigMap_ShouldReportWithoutUpdating",
+			pauseRequested: true,
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/reconcile": "true",
+				"annotator.ingress.kubernetes.io/rules":     "rule1",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/reconcile": "true",
+				"annotator.ingress.kubernetes.io/rules":     "rule1",
+			},
+			wantEvents: []string{"Normal Paused Paused by rules ConfigMap; would apply rules [rule1] (generation gen1): added new-key"},
+		},
+		{
+			name:                 "PausedByNamespace_ShouldReportWithoutUpdating",
+			namespaceAnnotations: map[string]string{"annotator.ingress.kubernetes.io/paused": "true"},
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/rules": "rule1",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/rules": "rule1",
+			},
+			wantEvents: []string{"Normal Paused Paused by Namespace; would apply rules [rule1] (generation gen1): added new-key"},
+		},
+		{
+			name: "PausedByIngress_ShouldReportWithoutUpdating",
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/paused": "true",
+				"annotator.ingress.kubernetes.io/rules":  "rule1",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/paused": "true",
+				"annotator.ingress.kubernetes.io/rules":  "rule1",
+			},
+			wantEvents: []string{"Normal Paused Paused by Ingress; would apply rules [rule1] (generation gen1): added new-key"},
+		},
+		{
+			name: "HeldByRolloutGate_ShouldWaitWithoutEvents",
+			gate: rollout.NewGate(),
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/rules": "rule1",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/rules": "rule1",
+			},
+		},
+		{
+			name:         "NamespaceOfAnotherShard_ShouldSkipIngress",
+			shardMembers: []string{"pod-1"},
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/rules": "rule1",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/rules": "rule1",
+			},
+		},
+		{
+			name:         "NamespaceOfThisShard_ShouldApplyRules",
+			shardMembers: []string{"pod-0"},
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/rules": "rule1",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/managed-annotations": "{\"version\":2,\"annotations\":{\"new-key\":{\"value\":\"new-value\",\"rule\":\"rule1\",\"source\":\"ingress\",\"generation\":\"gen1\"}}}\n",
+				"annotator.ingress.kubernetes.io/rules":               "rule1",
+				"annotator.ingress.kubernetes.io/status":              `{"generation":"gen1","rules":["rule1"]}`,
+				"new-key":                                             "new-value",
+			},
+			wantEvents: []string{"Normal AnnotationsUpdated Applied rules [rule1] (generation gen1): added new-key"},
+		},
+		{
+			name: "ResumedIngress_ShouldApplyRules",
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/paused": "false",
+				"annotator.ingress.kubernetes.io/rules":  "rule1",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/managed-annotations": "{\"version\":2,\"annotations\":{\"new-key\":{\"value\":\"new-value\",\"rule\":\"rule1\",\"source\":\"ingress\",\"generation\":\"gen1\"}}}\n",
+				"annotator.ingress.kubernetes.io/paused":              "false",
+				"annotator.ingress.kubernetes.io/rules":               "rule1",
+				"annotator.ingress.kubernetes.io/status":              `{"generation":"gen1","rules":["rule1"]}`,
+				"new-key":                                             "new-value",
+			},
+			wantEvents: []string{"Normal AnnotationsUpdated Applied rules [rule1] (generation gen1): added new-key"},
+		},
+		{
+			name:           "ExistingAnnotationWithSkipIfPresentPolicy_ShouldKeepExistingValue",
+			conflictPolicy: model.ConflictPolicySkipIfPresent,
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/rules": "rule1",
+				"new-key":                               "user-value",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/status": `{"generation":"gen1","rules":["rule1"],"conflicts":["new-key"]}`,
+				"annotator.ingress.kubernetes.io/rules":  "rule1",
+				"new-key":                                "user-value",
+			},
+			wantEvents: []string{"Warning AnnotationConflict Annotation new-key is already set, skipped rule rule1"},
+		},
+		{
+			name:           "KnownConflictWithSkipIfPresentPolicy_ShouldNotRepeatEvent",
+			conflictPolicy: model.ConflictPolicySkipIfPresent,
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/status": `{"generation":"gen1","rules":["rule1"],"conflicts":["new-key"]}`,
+				"annotator.ingress.kubernetes.io/rules":  "rule1",
+				"new-key":                                "user-value",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/status": `{"generation":"gen1","rules":["rule1"],"conflicts":["new-key"]}`,
+				"annotator.ingress.kubernetes.io/rules":  "rule1",
+				"new-key":                                "user-value",
+			},
+		},
+		{
+			name:           "SameValueWithSkipIfPresentPolicy_ShouldNotReportConflict",
+			conflictPolicy: model.ConflictPolicySkipIfPresent,
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/rules": "rule1",
+				"new-key":                               "new-value",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/status": `{"generation":"gen1","rules":["rule1"]}`,
+				"annotator.ingress.kubernetes.io/rules":  "rule1",
+				"new-key":                                "new-value",
+			},
+		},
+		{
+			name:           "ExistingAnnotationWithFailPolicy_ShouldReturnError",
+			conflictPolicy: model.ConflictPolicyFail,
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/rules": "rule1",
+				"new-key":                               "user-value",
+			},
+			wantResult: ctrl.Result{},
+			wantError:  "annotations already set on Ingress: new-key",
+			wantEvents: []string{"Warning AnnotationConflict annotations already set on Ingress: new-key"},
+		},
+		{
+			name:           "SameValueWithFailPolicy_ShouldAdoptAnnotation",
+			conflictPolicy: model.ConflictPolicyFail,
+			ingressAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/rules": "rule1",
+				"new-key":                               "new-value",
+			},
+			wantResult: ctrl.Result{},
+			wantAnnotations: map[string]string{
+				"annotator.ingress.kubernetes.io/status":              `{"generation":"gen1","rules":["rule1"]}`,
+				"annotator.ingress.kubernetes.io/managed-annotations": "{\"version\":2,\"annotations\":{\"new-key\":{\"value\":\"new-value\",\"rule\":\"rule1\",\"source\":\"ingress\",\"generation\":\"gen1\"}},\"originals\":{\"new-key\":\"new-value\"}}\n",
+				"annotator.ingress.kubernetes.io/rules":               "rule1",
+				"new-key":                                             "new-value",
+			},
 		},
 		{
 			name:       "ClientGetError_ShouldReturnError",
@@ -207,14 +589,15 @@ func TestIngressReconciler_Reconcile(t *testing.T) {
 			wantGetError: "mocked GetNotFoundError: Resource \"my-ingress\" not found",
 		},
 		{
-			name:       "ClientUpdateError_ShouldRequeueAfterError",
+			name:       "ClientUpdateError_ShouldReturnError",
 			clientOpts: &fakeclient.ClientOpts{UpdateError: true},
 			ingressAnnotations: map[string]string{
 				"annotator.ingress.kubernetes.io/managed-annotations": "{\"new-key\":\"new-value\"}\n",
 				"annotator.ingress.kubernetes.io/rules":               "rule1",
 			},
-			wantResult: ctrl.Result{RequeueAfter: 30 * time.Second},
+			wantResult: ctrl.Result{},
 			wantError:  "mocked UpdateError",
+			wantEvents: []string{"Warning UpdateFailed Failed to update annotations: mocked UpdateError"},
 		},
 	}
 
@@ -226,7 +609,7 @@ func TestIngressReconciler_Reconcile(t *testing.T) {
 				nn = *tc.requestNN
 			}
 
-			namespace := &corev1.Namespace{ObjectMeta: ctrl.ObjectMeta{Name: "default"}}
+			namespace := &corev1.Namespace{ObjectMeta: ctrl.ObjectMeta{Name: "default", Annotations: tc.namespaceAnnotations}}
 			ingress := &networkingv1.Ingress{
 				ObjectMeta: ctrl.ObjectMeta{
 					Namespace:         "default",
@@ -239,19 +622,38 @@ func TestIngressReconciler_Reconcile(t *testing.T) {
 			client := fakeclient.NewClient(tc.clientOpts, namespace, ingress)
 
 			// Mock the rules store
-			rules := &model.Rules{"rule1": {"new-key": "new-value"}}
-			store := mocks.NewMockIRulesStore(mockCtrl)
-			store.EXPECT().GetRules().Return(rules).AnyTimes()
+			store := mocks.NewRulesStore(mockCtrl, mocks.RulesStoreOpts{Cleanup: tc.cleanup, Paused: tc.paused, PauseRequested: tc.pauseRequested})
 
+			stateStoreType := statestore.TypeAnnotation
+			if tc.stateStore != "" {
+				stateStoreType = tc.stateStore
+			}
+			stateStore, err := statestore.New(stateStoreType, client)
+			assert.NoError(t, err)
+
+			recorder := record.NewFakeRecorder(10)
 			reconciler := &IngressReconciler{
-				Client:     client,
-				RulesStore: store,
+				Client:         client,
+				RulesStore:     store,
+				StateStore:     stateStore,
+				ConflictPolicy: tc.conflictPolicy,
+				Recorder:       recorder,
+				Gate:           tc.gate,
+			}
+			if tc.shardMembers != nil {
+				reconciler.Shard = shard.NewFixed("pod-0", tc.shardMembers...)
 			}
 
 			// Run the Reconcile method
 			got, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
 
 			assert.Equal(t, tc.wantResult, got)
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			assert.Equal(t, tc.wantEvents, events)
 
 			if tc.wantError != "" {
 				assert.EqualError(t, err, tc.wantError)
@@ -472,3 +874,699 @@ func TestMergeRuleNames(t *testing.T) {
 		})
 	}
 }
+
+func TestIngressReconciler_CleanupAll(t *testing.T) {
+	ingress1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default",
+		Name:      "ingress1",
+		Annotations: map[string]string{
+			"annotator.ingress.kubernetes.io/managed-annotations": "{\"version\":2,\"annotations\":{\"new-key\":{\"value\":\"new-value\"}},\"originals\":{\"new-key\":\"user-value\"}}\n",
+			"annotator.ingress.kubernetes.io/reconcile":           "true",
+			"annotator.ingress.kubernetes.io/rules":               "rule1",
+			"new-key":                                             "new-value",
+		},
+	}}
+	ingress2 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "default",
+		Name:        "ingress2",
+		Annotations: map[string]string{"example-key": "example-value"},
+	}}
+
+	testCases := []struct {
+		name            string
+		clientOpts      *fakeclient.ClientOpts
+		wantAnnotations map[string]map[string]string
+		wantRecords     []audit.Record
+		wantError       string
+	}{
+		{
+			name: "strips managed annotations",
+			wantAnnotations: map[string]map[string]string{
+				"ingress1": {"annotator.ingress.kubernetes.io/rules": "rule1", "new-key": "user-value"},
+				"ingress2": {"example-key": "example-value"},
+			},
+			wantRecords: []audit.Record{{
+				Namespace: "default",
+				Ingress:   "ingress1",
+				Trigger:   audit.TriggerCleanup,
+				Changes:   []audit.Change{{Key: "new-key", Operation: "changed", Old: "new-value", New: "user-value"}},
+			}},
+		},
+		{
+			name:       "list error",
+			clientOpts: &fakeclient.ClientOpts{ListError: true},
+			wantError:  "failed to list ingresses: mocked ListError",
+		},
+		{
+			name:       "update error",
+			clientOpts: &fakeclient.ClientOpts{UpdateError: true},
+			wantError:  "failed to clean up ingress default/ingress1: mocked UpdateError",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			ctx := context.Background()
+			client := fakeclient.NewClient(tc.clientOpts, ingress1.DeepCopy(), ingress2.DeepCopy())
+			sink := &auditSink{}
+			reconciler := &IngressReconciler{
+				Client:     client,
+				StateStore: &statestore.AnnotationStateStore{},
+				Audit:      &audit.Logger{Sink: sink},
+			}
+
+			err := reconciler.CleanupAll(ctx)
+			assert.Equal(t, tc.wantRecords, sink.records)
+			if tc.wantError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.wantError)
+			}
+			for name, want := range tc.wantAnnotations {
+				var ing networkingv1.Ingress
+				assert.NoError(t, client.Get(ctx, types.NamespacedName{Namespace: "default", Name: name}, &ing))
+				assert.Equal(t, want, ing.Annotations)
+			}
+		})
+	}
+}
+
+// auditSink keeps the audit records, without their time.
+type auditSink struct {
+	records []audit.Record
+}
+
+func (s *auditSink) Write(_ context.Context, record audit.Record) error {
+	record.Time = time.Time{}
+	s.records = append(s.records, record)
+	return nil
+}
+
+func TestIngressReconciler_Audit(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	nn := types.NamespacedName{Namespace: "default", Name: "my-ingress"}
+	testCases := []struct {
+		name        string
+		trigger     audit.Trigger
+		clientOpts  *fakeclient.ClientOpts
+		givenUp     bool
+		wantRecords []audit.Record
+	}{
+		{
+			name: "Ingress edit",
+			wantRecords: []audit.Record{{
+				Namespace: "default", Ingress: "my-ingress", Trigger: audit.TriggerIngress, Generation: "gen1", Rules: []string{"rule1"},
+				Changes: []audit.Change{
+					{Key: "added-key", Operation: "added", New: "added-value"},
+					{Key: "new-key", Operation: "changed", Old: "user-value", New: "new-value"},
+				},
+			}},
+		},
+		{
+			name:    "Rules change",
+			trigger: audit.TriggerConfigMap,
+			wantRecords: []audit.Record{{
+				Namespace: "default", Ingress: "my-ingress", Trigger: audit.TriggerConfigMap, Generation: "gen1", Rules: []string{"rule1"},
+				Changes: []audit.Change{
+					{Key: "added-key", Operation: "added", New: "added-value"},
+					{Key: "new-key", Operation: "changed", Old: "user-value", New: "new-value"},
+				},
+			}},
+		},
+		{
+			name:       "Failed updates are not logged",
+			trigger:    audit.TriggerNamespace,
+			clientOpts: &fakeclient.ClientOpts{UpdateError: true},
+		},
+		{
+			name:       "Ingresses given up on forget the trigger",
+			trigger:    audit.TriggerNamespace,
+			clientOpts: &fakeclient.ClientOpts{UpdateError: true},
+			givenUp:    true,
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			ctx := context.Background()
+			namespace := &corev1.Namespace{ObjectMeta: ctrl.ObjectMeta{Name: "default"}}
+			ingress := &networkingv1.Ingress{ObjectMeta: ctrl.ObjectMeta{
+				Namespace:   nn.Namespace,
+				Name:        nn.Name,
+				Annotations: map[string]string{model.RulesKey: "rule1", "new-key": "user-value"},
+			}}
+			client := fakeclient.NewClient(tc.clientOpts, namespace, ingress)
+
+			store := mocks.NewRulesStore(mockCtrl, mocks.RulesStoreOpts{Rules: &model.Rules{"rule1": {"new-key": "new-value", "added-key": "added-value"}}})
+
+			triggers := trigger.New()
+			if tc.trigger != "" {
+				triggers.Set(ctx, nn, tc.trigger)
+			}
+			// One retry, which the previous failure used up.
+			retries := backoff.NewRetries(1)
+			if tc.givenUp {
+				retries.Failed(nn)
+			}
+			sink := &auditSink{}
+			reconciler := &IngressReconciler{
+				Client:     client,
+				RulesStore: store,
+				StateStore: &statestore.AnnotationStateStore{},
+				Recorder:   record.NewFakeRecorder(10),
+				Audit:      &audit.Logger{Sink: sink},
+				Retries:    retries,
+				Triggers:   triggers,
+			}
+			_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+			assert.Equal(t, tc.wantRecords, sink.records)
+
+			// The trigger is kept until the Ingress has been reconciled, or given up on.
+			if err != nil && !tc.givenUp {
+				assert.Equal(t, tc.trigger, triggers.Get(nn).Cause)
+			} else {
+				assert.Equal(t, audit.TriggerIngress, triggers.Get(nn).Cause)
+			}
+		})
+	}
+}
+
+func TestIngressReconciler_Metrics(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	ctx := context.Background()
+	nn := types.NamespacedName{Namespace: "default", Name: "metrics-ingress"}
+	namespace := &corev1.Namespace{ObjectMeta: ctrl.ObjectMeta{Name: "default"}}
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: ctrl.ObjectMeta{
+			Namespace:   nn.Namespace,
+			Name:        nn.Name,
+			Annotations: map[string]string{model.RulesKey: "metrics-rule, unknown-rule"},
+		},
+	}
+	client := fakeclient.NewClient(nil, namespace, ingress)
+
+	store := mocks.NewRulesStore(mockCtrl, mocks.RulesStoreOpts{Rules: &model.Rules{"metrics-rule": {"metrics-key": "value"}}})
+
+	reconciler := &IngressReconciler{
+		Client:     client,
+		RulesStore: store,
+		StateStore: &statestore.AnnotationStateStore{},
+		Recorder:   record.NewFakeRecorder(10),
+	}
+
+	added := promtestutil.ToFloat64(metrics.AnnotationWrites.WithLabelValues("added"))
+	unknown := promtestutil.ToFloat64(metrics.UnknownRuleReferences)
+
+	_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+	assert.NoError(t, err)
+	assert.Equal(t, added+1, promtestutil.ToFloat64(metrics.AnnotationWrites.WithLabelValues("added")))
+	assert.Equal(t, unknown+1, promtestutil.ToFloat64(metrics.UnknownRuleReferences))
+	assert.Equal(t, float64(1), promtestutil.ToFloat64(metrics.ManagedIngresses.WithLabelValues("metrics-rule")))
+	assert.Equal(t, float64(1), promtestutil.ToFloat64(metrics.IngressRulesInfo.WithLabelValues("default", "metrics-ingress", "metrics-rule", "ingress")))
+
+	// Drift: the managed annotation is changed outside the annotator.
+	drift := promtestutil.ToFloat64(metrics.DriftDetections)
+	assert.NoError(t, client.Get(ctx, nn, ingress))
+	ingress.Annotations["metrics-key"] = "edited"
+	assert.NoError(t, client.Update(ctx, ingress))
+	_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+	assert.NoError(t, err)
+	assert.Equal(t, drift+1, promtestutil.ToFloat64(metrics.DriftDetections))
+
+	series := promtestutil.CollectAndCount(metrics.ManagedIngresses)
+	infoSeries := promtestutil.CollectAndCount(metrics.IngressRulesInfo)
+	assert.NoError(t, client.Delete(ctx, ingress))
+	_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+	assert.NoError(t, err)
+	assert.Equal(t, series-1, promtestutil.CollectAndCount(metrics.ManagedIngresses))
+	assert.Equal(t, infoSeries-1, promtestutil.CollectAndCount(metrics.IngressRulesInfo))
+}
+
+func TestIngressReconciler_ShardHandover(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	ctx := context.Background()
+	nn := types.NamespacedName{Namespace: "default", Name: "handover-ingress"}
+	namespace := &corev1.Namespace{ObjectMeta: ctrl.ObjectMeta{Name: "default"}}
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: ctrl.ObjectMeta{
+			Namespace:   nn.Namespace,
+			Name:        nn.Name,
+			Annotations: map[string]string{model.RulesKey: "handover-rule"},
+		},
+	}
+	client := fakeclient.NewClient(nil, namespace, ingress)
+	store := mocks.NewRulesStore(mockCtrl, mocks.RulesStoreOpts{Rules: &model.Rules{"handover-rule": {"handover-key": "value"}}})
+
+	tracker := progress.NewTracker()
+	reconciler := &IngressReconciler{
+		Client:     client,
+		RulesStore: store,
+		StateStore: &statestore.AnnotationStateStore{},
+		Recorder:   record.NewFakeRecorder(10),
+		Progress:   tracker,
+		Shard:      shard.NewFixed("pod-0", "pod-0"),
+	}
+	_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+	assert.NoError(t, err)
+	assert.Len(t, tracker.Snapshot(), 1)
+	infoSeries := promtestutil.CollectAndCount(metrics.IngressRulesInfo)
+
+	// Once the namespace is handed over, its new owner reports the Ingress.
+	reconciler.Shard = shard.NewFixed("pod-0")
+	_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+	assert.NoError(t, err)
+	assert.Empty(t, tracker.Snapshot())
+	assert.Equal(t, infoSeries-1, promtestutil.CollectAndCount(metrics.IngressRulesInfo))
+}
+
+func TestEvaluate(t *testing.T) {
+	nn := types.NamespacedName{Namespace: "default", Name: "my-ingress"}
+	var got []types.NamespacedName
+	r := reconcile.Func(func(_ context.Context, req ctrl.Request) (ctrl.Result, error) {
+		got = append(got, req.NamespacedName)
+		return ctrl.Result{}, errors.New("mocked error")
+	})
+
+	// Errors are only logged.
+	Evaluate(context.Background(), r, nn)
+	assert.Equal(t, []types.NamespacedName{nn}, got)
+
+	// Nothing is evaluated without a reconciler.
+	Evaluate(context.Background(), nil, nn)
+	assert.Equal(t, []types.NamespacedName{nn}, got)
+}
+
+func TestIngressReconciler_MetricsUpdateRejected(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	ctx := context.Background()
+	nn := types.NamespacedName{Namespace: "default", Name: "rejected-ingress"}
+	namespace := &corev1.Namespace{ObjectMeta: ctrl.ObjectMeta{Name: "default"}}
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: ctrl.ObjectMeta{
+			Namespace:   nn.Namespace,
+			Name:        nn.Name,
+			Annotations: map[string]string{model.RulesKey: "rejected-rule"},
+		},
+	}
+	client := fakeclient.NewClient(&fakeclient.ClientOpts{UpdateError: true}, namespace, ingress)
+
+	store := mocks.NewRulesStore(mockCtrl, mocks.RulesStoreOpts{Rules: &model.Rules{"rejected-rule": {"rejected-key": "value"}}})
+
+	reconciler := &IngressReconciler{
+		Client:     client,
+		RulesStore: store,
+		StateStore: &statestore.AnnotationStateStore{},
+		Recorder:   record.NewFakeRecorder(10),
+	}
+
+	// The rules of a rejected update are not reported as applied.
+	infoSeries := promtestutil.CollectAndCount(metrics.IngressRulesInfo)
+	_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+	assert.EqualError(t, err, "mocked UpdateError")
+	assert.Equal(t, infoSeries, promtestutil.CollectAndCount(metrics.IngressRulesInfo))
+}
+
+func TestIngressReconciler_Tracing(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(previous)
+
+	ctx := context.Background()
+	nn := types.NamespacedName{Namespace: "default", Name: "traced-ingress"}
+	namespace := &corev1.Namespace{ObjectMeta: ctrl.ObjectMeta{Name: "default"}}
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: ctrl.ObjectMeta{
+			Namespace:   nn.Namespace,
+			Name:        nn.Name,
+			Annotations: map[string]string{model.RulesKey: "rule1", model.ReconcileKey: "true"},
+		},
+	}
+	client := fakeclient.NewClient(nil, namespace, ingress)
+
+	store := mocks.NewRulesStore(mockCtrl, mocks.RulesStoreOpts{})
+
+	reconciler := &IngressReconciler{
+		Client:     client,
+		RulesStore: store,
+		StateStore: &statestore.AnnotationStateStore{},
+		Recorder:   record.NewFakeRecorder(10),
+		Triggers:   trigger.New(),
+	}
+
+	// The rollout that enqueued the Ingress.
+	enqueueCtx, enqueueSpan := tracing.Start(ctx, "Enqueue Ingress")
+	reconciler.Triggers.Set(enqueueCtx, nn, audit.TriggerConfigMap)
+	enqueueSpan.End()
+
+	// The first reconcile removes the reconcile key, the second applies the rules.
+	result, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+	assert.NoError(t, err)
+	assert.True(t, result.Requeue)
+	_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+	assert.NoError(t, err)
+
+	spans := exporter.GetSpans()
+	assert.Equal(t, []string{"Enqueue Ingress", "Ingress reconcile", "Update Ingress", "Ingress reconcile"},
+		[]string{spans[0].Name, spans[1].Name, spans[2].Name, spans[3].Name})
+	traceID := spans[0].SpanContext.TraceID()
+	for _, span := range spans {
+		assert.Equal(t, traceID, span.SpanContext.TraceID(), span.Name)
+	}
+	assert.Equal(t, spans[0].SpanContext.SpanID(), spans[1].Parent.SpanID())
+	assert.Equal(t, spans[0].SpanContext.SpanID(), spans[3].Parent.SpanID())
+	assert.Equal(t, spans[3].SpanContext.SpanID(), spans[2].Parent.SpanID())
+	assert.Contains(t, spans[3].Attributes, tracing.AttrRulesGeneration.String("gen1"))
+	assert.Contains(t, spans[3].Attributes, tracing.AttrRuleNames.StringSlice([]string{"rule1"}))
+}
+
+func TestIngressReconciler_Progress(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	ctx := context.Background()
+	nn := types.NamespacedName{Namespace: "default", Name: "my-ingress"}
+	namespace := &corev1.Namespace{ObjectMeta: ctrl.ObjectMeta{Name: "default", Annotations: map[string]string{model.RulesKey: "rule1"}}}
+	ingress := &networkingv1.Ingress{
+		ObjectMeta: ctrl.ObjectMeta{
+			Namespace:   nn.Namespace,
+			Name:        nn.Name,
+			Annotations: map[string]string{model.RulesKey: "unknown-rule", "new-key": "foreign-value"},
+		},
+	}
+
+	testCases := []struct {
+		name           string
+		conflictPolicy model.ConflictPolicy
+		pauseRequested bool
+		gate           *rollout.Gate
+		status         string
+		want           progress.Result
+		wantStatus     string
+	}{
+		{
+			name:       "Success",
+			want:       progress.Result{Generation: "gen1", Rules: []string{"rule1", "unknown-rule"}, UnknownRules: []string{"unknown-rule"}},
+			wantStatus: `{"generation":"gen1","rules":["rule1"],"unresolved":["unknown-rule"]}`,
+		},
+		{
+			name:           "Failure",
+			conflictPolicy: model.ConflictPolicyFail,
+			want: progress.Result{Generation: "gen1", Rules: []string{"rule1", "unknown-rule"}, UnknownRules: []string{"unknown-rule"},
+				Error: "annotations already set on Ingress: new-key"},
+			wantStatus: `{"generation":"gen1","rules":["rule1"],"unresolved":["unknown-rule"],"conflicts":["new-key"],"error":"annotations already set on Ingress: new-key"}`,
+		},
+		{
+			name:       "Held by rollout keeps the generation applied",
+			gate:       rollout.NewGate(),
+			status:     `{"generation":"gen0","rules":["rule1"]}`,
+			want:       progress.Result{Generation: "gen0", Rules: []string{"rule1", "unknown-rule"}, UnknownRules: []string{"unknown-rule"}},
+			wantStatus: `{"generation":"gen0","rules":["rule1"]}`,
+		},
+		{
+			name:           "Held by pause before any update",
+			pauseRequested: true,
+			want:           progress.Result{Rules: []string{"rule1", "unknown-rule"}, UnknownRules: []string{"unknown-rule"}},
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			ing := ingress.DeepCopy()
+			if tc.status != "" {
+				ing.Annotations[model.StatusKey] = tc.status
+			}
+			client := fakeclient.NewClient(nil, namespace, ing)
+			store := mocks.NewRulesStore(mockCtrl, mocks.RulesStoreOpts{PauseRequested: tc.pauseRequested})
+
+			tracker := progress.NewTracker()
+			reconciler := &IngressReconciler{
+				Client:         client,
+				RulesStore:     store,
+				StateStore:     &statestore.AnnotationStateStore{},
+				ConflictPolicy: tc.conflictPolicy,
+				Recorder:       record.NewFakeRecorder(10),
+				Progress:       tracker,
+				Gate:           tc.gate,
+			}
+			_, _ = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+			assert.Equal(t, map[types.NamespacedName]progress.Result{nn: tc.want}, tracker.Snapshot())
+
+			var updated networkingv1.Ingress
+			assert.NoError(t, client.Get(ctx, nn, &updated))
+			assert.Equal(t, tc.wantStatus, updated.Annotations[model.StatusKey])
+
+			// Deleted Ingresses are forgotten.
+			assert.NoError(t, client.Delete(ctx, ingress.DeepCopy()))
+			_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+			assert.NoError(t, err)
+			assert.Empty(t, tracker.Snapshot())
+		})
+	}
+}
+
+func TestIngressReconciler_Reconcile_DryRun(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	nn := types.NamespacedName{Namespace: "default", Name: "my-ingress"}
+	testCases := []struct {
+		name               string
+		conflictPolicy     model.ConflictPolicy
+		ingressAnnotations map[string]string
+		wantError          string
+		wantChanges        []dryrun.Change
+		wantEvents         []string
+	}{
+		{
+			name:               "Rules to apply are reported",
+			ingressAnnotations: map[string]string{model.RulesKey: "rule1", "old-key": "old-value"},
+			wantChanges: []dryrun.Change{{Namespace: "default", Name: "my-ingress", Generation: "gen1", Rules: []string{"rule1"},
+				Added: map[string]string{"new-key": "new-value"}, Reason: "Dry run"}},
+			wantEvents: []string{"Normal DryRun Would apply rules [rule1] (generation gen1): added new-key"},
+		},
+		{
+			name:               "Overwritten values are reported",
+			ingressAnnotations: map[string]string{model.RulesKey: "rule1", "new-key": "user-value", model.ReconcileKey: "true"},
+			wantChanges: []dryrun.Change{{Namespace: "default", Name: "my-ingress", Generation: "gen1", Rules: []string{"rule1"},
+				Changed: map[string]string{"new-key": "new-value"}, Reason: "Dry run"}},
+			wantEvents: []string{"Normal DryRun Would apply rules [rule1] (generation gen1): changed new-key"},
+		},
+		{
+			name:               "Up to date Ingress is not reported",
+			ingressAnnotations: map[string]string{model.RulesKey: "rule1", "new-key": "new-value"},
+			wantChanges:        []dryrun.Change{},
+		},
+		{
+			name:               "Conflicts do not write the status annotation",
+			conflictPolicy:     model.ConflictPolicyFail,
+			ingressAnnotations: map[string]string{model.RulesKey: "rule1", "new-key": "user-value"},
+			wantError:          "annotations already set on Ingress: new-key",
+			wantChanges:        []dryrun.Change{},
+			wantEvents:         []string{"Warning AnnotationConflict annotations already set on Ingress: new-key"},
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			ctx := context.Background()
+			namespace := &corev1.Namespace{ObjectMeta: ctrl.ObjectMeta{Name: "default"}}
+			ingress := &networkingv1.Ingress{ObjectMeta: ctrl.ObjectMeta{Namespace: nn.Namespace, Name: nn.Name, Annotations: tc.ingressAnnotations}}
+			client := fakeclient.NewClient(&fakeclient.ClientOpts{UpdateError: true}, namespace, ingress)
+
+			store := mocks.NewRulesStore(mockCtrl, mocks.RulesStoreOpts{})
+
+			stateStore, err := statestore.New(statestore.TypeConfigMap, client)
+			assert.NoError(t, err)
+			recorder := record.NewFakeRecorder(10)
+			report := dryrun.NewReport()
+			reconciler := &IngressReconciler{
+				Client:         client,
+				RulesStore:     store,
+				StateStore:     stateStore,
+				ConflictPolicy: tc.conflictPolicy,
+				Recorder:       recorder,
+				DryRun:         true,
+				DryRunReport:   report,
+			}
+
+			// Any write would fail with the mocked UpdateError.
+			got, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, ctrl.Result{}, got)
+			assert.Equal(t, tc.wantChanges, report.Changes())
+
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			assert.Equal(t, tc.wantEvents, events)
+
+			var updated networkingv1.Ingress
+			assert.NoError(t, client.Get(ctx, nn, &updated))
+			assert.Equal(t, tc.ingressAnnotations, updated.Annotations)
+			var states corev1.ConfigMapList
+			assert.NoError(t, client.List(ctx, &states))
+			assert.Empty(t, states.Items)
+
+			// Deleted Ingresses are dropped from the report.
+			assert.NoError(t, client.Delete(ctx, &updated))
+			_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+			assert.NoError(t, err)
+			assert.Empty(t, report.Changes())
+		})
+	}
+}
+
+func TestIngressReconciler_PreviewRules(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	testCases := []struct {
+		name               string
+		conflictPolicy     model.ConflictPolicy
+		ingressAnnotations map[string]string
+		rules              *model.Rules
+		want               dryrun.Change
+		wantError          string
+	}{
+		{
+			name:               "Same rules change nothing",
+			ingressAnnotations: map[string]string{model.RulesKey: "rule1", "new-key": "new-value"},
+			rules:              &model.Rules{"rule1": {"new-key": "new-value"}},
+			want:               dryrun.Change{Namespace: "default", Name: "my-ingress", Generation: "gen2", Rules: []string{"rule1"}},
+		},
+		{
+			name:               "Added and changed annotations",
+			ingressAnnotations: map[string]string{model.RulesKey: "rule1"},
+			rules:              &model.Rules{"rule1": {"new-key": "other-value", "extra-key": "extra-value"}},
+			want: dryrun.Change{Namespace: "default", Name: "my-ingress", Generation: "gen2", Rules: []string{"rule1"},
+				Added:   map[string]string{"extra-key": "extra-value"},
+				Changed: map[string]string{"new-key": "other-value"}},
+		},
+		{
+			name:               "Removed annotations",
+			ingressAnnotations: map[string]string{model.RulesKey: "rule1"},
+			rules:              &model.Rules{"rule1": {}},
+			want: dryrun.Change{Namespace: "default", Name: "my-ingress", Generation: "gen2", Rules: []string{},
+				Removed: []string{"new-key"}},
+		},
+		{
+			name:               "Conflict with the current rules",
+			conflictPolicy:     model.ConflictPolicyFail,
+			ingressAnnotations: map[string]string{model.RulesKey: "rule1", "new-key": "user-value"},
+			rules:              &model.Rules{"rule1": {"new-key": "new-value"}},
+			wantError:          "current rules: annotations already set on Ingress: new-key",
+		},
+		{
+			name:               "Conflict with the proposed rules",
+			conflictPolicy:     model.ConflictPolicyFail,
+			ingressAnnotations: map[string]string{model.RulesKey: "rule1", "user-key": "user-value"},
+			rules:              &model.Rules{"rule1": {"user-key": "new-value"}},
+			wantError:          "proposed rules: annotations already set on Ingress: user-key",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			ctx := context.Background()
+			namespace := &corev1.Namespace{ObjectMeta: ctrl.ObjectMeta{Name: "default"}}
+			ingress := &networkingv1.Ingress{ObjectMeta: ctrl.ObjectMeta{Namespace: "default", Name: "my-ingress", Annotations: tc.ingressAnnotations}}
+			client := fakeclient.NewClient(&fakeclient.ClientOpts{UpdateError: true}, namespace, ingress)
+
+			store := mocks.NewRulesStore(mockCtrl, mocks.RulesStoreOpts{})
+
+			stateStore, err := statestore.New(statestore.TypeConfigMap, client)
+			assert.NoError(t, err)
+			recorder := record.NewFakeRecorder(10)
+			reconciler := &IngressReconciler{
+				Client:         client,
+				RulesStore:     store,
+				StateStore:     stateStore,
+				ConflictPolicy: tc.conflictPolicy,
+				Recorder:       recorder,
+			}
+
+			got, err := reconciler.PreviewRules(ctx, ingress, namespace, tc.rules, "gen2")
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tc.want, got)
+			}
+			// A preview neither writes nor records events.
+			assert.Empty(t, recorder.Events)
+			assert.Equal(t, tc.ingressAnnotations, ingress.Annotations)
+		})
+	}
+}
+
+func TestIngressReconciler_ingressesInNamespace(t *testing.T) {
+	namespace := &corev1.Namespace{ObjectMeta: ctrl.ObjectMeta{Name: "default"}}
+	ingress1 := &networkingv1.Ingress{ObjectMeta: ctrl.ObjectMeta{Namespace: "default", Name: "ingress1"}}
+	ingress2 := &networkingv1.Ingress{ObjectMeta: ctrl.ObjectMeta{Namespace: "default", Name: "ingress2"}}
+	other := &networkingv1.Ingress{ObjectMeta: ctrl.ObjectMeta{Namespace: "other", Name: "ingress1"}}
+
+	// The Namespaces a replica takes over are mapped to their Ingresses.
+	reconciler := &IngressReconciler{Client: fakeclient.NewClient(nil, ingress1, ingress2, other)}
+	assert.Equal(t, []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Namespace: "default", Name: "ingress1"}},
+		{NamespacedName: types.NamespacedName{Namespace: "default", Name: "ingress2"}},
+	}, reconciler.ingressesInNamespace(context.Background(), namespace))
+}
+
+func TestIngressReconciler_Retries(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	ctx := context.Background()
+	nn := types.NamespacedName{Namespace: "default", Name: "my-ingress"}
+	namespace := &corev1.Namespace{ObjectMeta: ctrl.ObjectMeta{Name: "default"}}
+	ingress := &networkingv1.Ingress{ObjectMeta: ctrl.ObjectMeta{Namespace: nn.Namespace, Name: nn.Name,
+		Annotations: map[string]string{model.RulesKey: "rule1"}}}
+
+	store := mocks.NewRulesStore(mockCtrl, mocks.RulesStoreOpts{Rules: &model.Rules{"rule1": {"key1": "value1"}}})
+
+	tracker := progress.NewTracker()
+	reconciler := &IngressReconciler{
+		Client:     fakeclient.NewClient(&fakeclient.ClientOpts{UpdateError: true}, namespace, ingress),
+		RulesStore: store,
+		StateStore: &statestore.AnnotationStateStore{},
+		Recorder:   record.NewFakeRecorder(10),
+		Progress:   tracker,
+		Retries:    backoff.NewRetries(2),
+	}
+
+	// The first failures are retried.
+	for i := 0; i < 2; i++ {
+		_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+		assert.EqualError(t, err, "mocked UpdateError")
+		assert.False(t, errors.Is(err, reconcile.TerminalError(nil)))
+	}
+	assert.Equal(t, float64(0), promtestutil.ToFloat64(metrics.FailedIngresses))
+
+	// Then the Ingress is marked failed.
+	_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+	assert.EqualError(t, err, "terminal error: retries exhausted: mocked UpdateError")
+	assert.True(t, errors.Is(err, reconcile.TerminalError(nil)))
+	assert.Equal(t, "retries exhausted: mocked UpdateError", tracker.Snapshot()[nn].Error)
+	assert.Equal(t, float64(1), promtestutil.ToFloat64(metrics.FailedIngresses))
+
+	// Until it is reconciled successfully.
+	reconciler.Client = fakeclient.NewClient(nil, namespace, ingress)
+	_, err = reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+	assert.NoError(t, err)
+	assert.Empty(t, tracker.Snapshot()[nn].Error)
+	assert.Equal(t, float64(0), promtestutil.ToFloat64(metrics.FailedIngresses))
+}
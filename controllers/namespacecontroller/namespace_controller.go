@@ -19,15 +19,31 @@ package namespacecontroller
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"github.com/kuoss/ingress-annotator/controllers/ingresscontroller"
+	"github.com/kuoss/ingress-annotator/pkg/audit"
+	"github.com/kuoss/ingress-annotator/pkg/backoff"
+	"github.com/kuoss/ingress-annotator/pkg/metrics"
 	"github.com/kuoss/ingress-annotator/pkg/model"
+	"github.com/kuoss/ingress-annotator/pkg/rollout"
+	"github.com/kuoss/ingress-annotator/pkg/rulesstore"
+	"github.com/kuoss/ingress-annotator/pkg/scope"
+	"github.com/kuoss/ingress-annotator/pkg/shard"
+	"github.com/kuoss/ingress-annotator/pkg/tracing"
+	"github.com/kuoss/ingress-annotator/pkg/trigger"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
+	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 )
 
@@ -35,60 +51,150 @@ import (
 type NamespaceReconciler struct {
 	client.Client
 	IngressReconciler reconcile.Reconciler
+	RulesStore        rulesstore.IRulesStore
 	Recorder          record.EventRecorder
+	// DryRun evaluates Ingresses with IngressReconciler instead of writing
+	// the reconcile trigger annotation to them, as do pauses.
+	DryRun bool
+	// Gate holds back the Ingresses a rollout in waves has not reached yet;
+	// they are evaluated in place too.
+	Gate *rollout.Gate
+	// Scope restricts the annotator to the Ingresses of some namespaces.
+	Scope *scope.Scope
+	// Shard restricts the reconciler to the namespaces of this replica when
+	// replicas share the namespaces.
+	Shard *shard.Shard
+	// Backoff paces the retries of failed reconciles.
+	Backoff *backoff.Policy
+	// Triggers holds the triggers of the Ingress reconciles, shared with the
+	// IngressReconciler.
+	Triggers *trigger.Triggers
 }
 
 // +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch;update;patch
 // +kubebuilder:rbac:groups=core,resources=namespaces/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=core,resources=namespaces/finalizers,verbs=update
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *NamespaceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	opts := controller.Options{RateLimiter: r.Backoff.RateLimiter()}
+	if r.Shard != nil {
+		opts.NeedLeaderElection = ptr.To(false)
+	}
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Namespace{}).
+		For(&corev1.Namespace{}, builder.WithPredicates(rulesChange(r.Scope))).
+		WithOptions(opts).
 		Complete(r)
 }
 
-func (r *NamespaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
-	logger := ctrl.LoggerFrom(ctx).WithValues("namespace", req.Namespace)
+// rulesKeys are the Namespace annotations that affect its Ingresses.
+var rulesKeys = []string{model.RulesKey, model.PausedKey}
+
+// rulesChange only lets through the Namespaces in scope whose rules or
+// pause annotations change, or that come into scope. Namespaces without
+// them are skipped when created, as rollouts of the rules ConfigMap cover
+// Ingresses that were never annotated.
+func rulesChange(s *scope.Scope) predicate.Funcs {
+	return predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			namespace, ok := e.Object.(*corev1.Namespace)
+			return ok && s.Includes(namespace) && hasRulesKeys(namespace.Annotations)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldNamespace, ok := e.ObjectOld.(*corev1.Namespace)
+			if !ok {
+				return false
+			}
+			newNamespace, ok := e.ObjectNew.(*corev1.Namespace)
+			if !ok || !s.Includes(newNamespace) {
+				return false
+			}
+			if !s.Includes(oldNamespace) {
+				return true
+			}
+			for _, key := range rulesKeys {
+				if oldNamespace.Annotations[key] != newNamespace.Annotations[key] {
+					return true
+				}
+			}
+			return false
+		},
+		DeleteFunc: func(event.DeleteEvent) bool {
+			return false
+		},
+	}
+}
+
+func hasRulesKeys(annotations map[string]string) bool {
+	for _, key := range rulesKeys {
+		if _, ok := annotations[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *NamespaceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (_ ctrl.Result, err error) {
+	defer metrics.ObserveReconcile("namespace", time.Now())
+	ctx, span := tracing.Start(ctx, "Namespace reconcile", tracing.AttrNamespace.String(req.Name))
+	defer func() { tracing.End(span, err) }()
+	logger := ctrl.LoggerFrom(ctx).WithValues("namespace", req.Name)
 
 	namespace := &corev1.Namespace{}
-	err := r.Client.Get(ctx, req.NamespacedName, namespace)
+	err = r.Client.Get(ctx, req.NamespacedName, namespace)
 	if err != nil {
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
-	if !namespace.DeletionTimestamp.IsZero() {
+	if !namespace.DeletionTimestamp.IsZero() || !r.Scope.Includes(namespace) || !r.Shard.Owns(namespace.Name) {
 		return ctrl.Result{}, nil
 	}
 
 	logger.Info("Reconciling Namespace")
 
-	if err := r.annotateIngressesInNamespace(ctx, req.Namespace); err != nil {
+	hold := r.DryRun || r.RulesStore.IsPauseRequested() || model.IsPaused(namespace.Annotations)
+	count, err := r.annotateIngressesInNamespace(ctx, req.Name, hold)
+	if err != nil {
 		return ctrl.Result{}, fmt.Errorf("failed to annotateIngressesInNamespace: %w", err)
 	}
+	if count > 0 {
+		r.Recorder.Eventf(namespace, corev1.EventTypeNormal, "RolloutTriggered", "Triggered reconcile of %d Ingresses", count)
+	}
 
 	logger.Info("Reconciled Namespace successfully")
 	return ctrl.Result{}, nil
 }
 
-func (r *NamespaceReconciler) annotateIngressesInNamespace(ctx context.Context, namespace string) error {
+func (r *NamespaceReconciler) annotateIngressesInNamespace(ctx context.Context, namespace string, hold bool) (int, error) {
 	var ingressList networkingv1.IngressList
 
 	if err := r.List(ctx, &ingressList, client.InNamespace(namespace)); err != nil {
-		return fmt.Errorf("failed to list ingresses: %w", err)
+		return 0, fmt.Errorf("failed to list ingresses: %w", err)
 	}
 
-	for _, ing := range ingressList.Items {
-		if err := r.annotateIngress(ctx, ing); err != nil {
-			return fmt.Errorf("failed to annotateIngress: %w", err)
+	for i, ing := range ingressList.Items {
+		held := hold || model.IsPaused(ing.Annotations) || r.Gate.Holds(client.ObjectKeyFromObject(&ing))
+		if err := r.annotateIngress(ctx, ing, held); err != nil {
+			return i, fmt.Errorf("failed to annotateIngress: %w", err)
 		}
 	}
 
-	return nil
+	return len(ingressList.Items), nil
 }
 
-func (r *NamespaceReconciler) annotateIngress(ctx context.Context, ing networkingv1.Ingress) error {
+// annotateIngress writes the reconcile trigger annotation to ing, or
+// evaluates it in place when hold is set.
+func (r *NamespaceReconciler) annotateIngress(ctx context.Context, ing networkingv1.Ingress, hold bool) (err error) {
+	nn := client.ObjectKeyFromObject(&ing)
+	ctx, span := tracing.Start(ctx, "Enqueue Ingress", tracing.IngressAttributes(nn)...)
+	defer func() { tracing.End(span, err) }()
+	if hold {
+		ingresscontroller.Evaluate(ctx, r.IngressReconciler, nn)
+		return nil
+	}
+	r.Triggers.Set(ctx, nn, audit.TriggerNamespace)
+
 	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		if err := r.Get(ctx, client.ObjectKey{Name: ing.Name, Namespace: ing.Namespace}, &ing); err != nil {
 			return fmt.Errorf("failed to get ingress %s/%s: %w", ing.Namespace, ing.Name, err)
@@ -2,6 +2,7 @@ package namespacecontroller
 
 import (
 	"context"
+	"errors"
 	"testing"
 	"time"
 
@@ -13,9 +14,19 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
+	"github.com/kuoss/ingress-annotator/pkg/audit"
+	"github.com/kuoss/ingress-annotator/pkg/model"
+	"github.com/kuoss/ingress-annotator/pkg/rollout"
+	"github.com/kuoss/ingress-annotator/pkg/rulesstore"
+	"github.com/kuoss/ingress-annotator/pkg/scope"
+	"github.com/kuoss/ingress-annotator/pkg/shard"
 	"github.com/kuoss/ingress-annotator/pkg/testutil/fakeclient"
+	"github.com/kuoss/ingress-annotator/pkg/trigger"
 )
 
 func TestNamespaceReconciler_SetupWithManager(t *testing.T) {
@@ -28,6 +39,98 @@ func TestNamespaceReconciler_SetupWithManager(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestRulesChange(t *testing.T) {
+	testCases := []struct {
+		name           string
+		selector       string
+		oldAnnotations map[string]string
+		newAnnotations map[string]string
+		oldLabels      map[string]string
+		newLabels      map[string]string
+		want           bool
+	}{
+		{
+			name:           "Rules added",
+			newAnnotations: map[string]string{model.RulesKey: "rule1"},
+			want:           true,
+		},
+		{
+			name:           "Rules changed",
+			oldAnnotations: map[string]string{model.RulesKey: "rule1"},
+			newAnnotations: map[string]string{model.RulesKey: "rule1,rule2"},
+			want:           true,
+		},
+		{
+			name:           "Rules removed",
+			oldAnnotations: map[string]string{model.RulesKey: "rule1"},
+			want:           true,
+		},
+		{
+			name:           "Paused",
+			oldAnnotations: map[string]string{model.RulesKey: "rule1"},
+			newAnnotations: map[string]string{model.RulesKey: "rule1", model.PausedKey: "true"},
+			want:           true,
+		},
+		{
+			name:           "Other annotation",
+			oldAnnotations: map[string]string{model.RulesKey: "rule1"},
+			newAnnotations: map[string]string{model.RulesKey: "rule1", "example.com/owner": "team-a"},
+		},
+		{
+			name:           "Labels",
+			oldAnnotations: map[string]string{model.RulesKey: "rule1"},
+			newAnnotations: map[string]string{model.RulesKey: "rule1"},
+			newLabels:      map[string]string{"team": "a"},
+		},
+		{
+			name:           "Coming into scope",
+			selector:       "tenant=a",
+			oldAnnotations: map[string]string{model.RulesKey: "rule1"},
+			newAnnotations: map[string]string{model.RulesKey: "rule1"},
+			newLabels:      map[string]string{"tenant": "a"},
+			want:           true,
+		},
+		{
+			name:           "Rules changed in scope",
+			selector:       "tenant=a",
+			oldAnnotations: map[string]string{model.RulesKey: "rule1"},
+			newAnnotations: map[string]string{model.RulesKey: "rule2"},
+			oldLabels:      map[string]string{"tenant": "a"},
+			newLabels:      map[string]string{"tenant": "a"},
+			want:           true,
+		},
+		{
+			name:           "Rules changed out of scope",
+			selector:       "tenant=a",
+			oldAnnotations: map[string]string{model.RulesKey: "rule1"},
+			newAnnotations: map[string]string{model.RulesKey: "rule2"},
+		},
+		{
+			name:           "Leaving scope",
+			selector:       "tenant=a",
+			oldAnnotations: map[string]string{model.RulesKey: "rule1"},
+			newAnnotations: map[string]string{model.RulesKey: "rule2"},
+			oldLabels:      map[string]string{"tenant": "a"},
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			s, err := scope.Parse("", tc.selector)
+			require.NoError(t, err)
+			oldNamespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Annotations: tc.oldAnnotations, Labels: tc.oldLabels}}
+			newNamespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Annotations: tc.newAnnotations, Labels: tc.newLabels}}
+			assert.Equal(t, tc.want, rulesChange(s).Update(event.UpdateEvent{ObjectOld: oldNamespace, ObjectNew: newNamespace}))
+		})
+	}
+
+	withRules := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Annotations: map[string]string{model.RulesKey: "rule1"}}}
+	withoutRules := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	assert.True(t, rulesChange(nil).Create(event.CreateEvent{Object: withRules}))
+	assert.False(t, rulesChange(nil).Create(event.CreateEvent{Object: withoutRules}))
+	assert.False(t, rulesChange(nil).Delete(event.DeleteEvent{Object: withRules}))
+	assert.False(t, rulesChange(&scope.Scope{Namespaces: []string{"other"}}).Create(event.CreateEvent{Object: withRules}))
+}
+
 func TestNamespaceReconciler_Reconcile(t *testing.T) {
 	scheme := runtime.NewScheme()
 	require.NoError(t, corev1.AddToScheme(scheme))
@@ -36,12 +139,26 @@ func TestNamespaceReconciler_Reconcile(t *testing.T) {
 	tests := []struct {
 		namespace  *corev1.Namespace
 		clientOpts *fakeclient.ClientOpts
+		shard      *shard.Shard
 		wantResult ctrl.Result
 		wantError  string
+		wantEvents []string
 	}{
 		{
 			namespace:  &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-namespace"}},
 			wantResult: ctrl.Result{},
+			wantEvents: []string{"Normal RolloutTriggered Triggered reconcile of 1 Ingresses"},
+		},
+		{
+			namespace:  &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-namespace"}},
+			shard:      shard.NewFixed("pod-0", "pod-0"),
+			wantResult: ctrl.Result{},
+			wantEvents: []string{"Normal RolloutTriggered Triggered reconcile of 1 Ingresses"},
+		},
+		{
+			namespace:  &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-namespace"}},
+			shard:      shard.NewFixed("pod-0", "pod-1"),
+			wantResult: ctrl.Result{},
 		},
 		{
 			namespace:  &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-namespace", DeletionTimestamp: &metav1.Time{Time: time.Now()}, Finalizers: []string{"test-finalizer"}}},
@@ -81,8 +198,12 @@ func TestNamespaceReconciler_Reconcile(t *testing.T) {
 	for i, tt := range tests {
 		t.Run(testcase.Name(i, tt.namespace), func(t *testing.T) {
 			client := fakeclient.NewClient(tt.clientOpts, tt.namespace, ingress)
+			recorder := record.NewFakeRecorder(10)
 			r := &NamespaceReconciler{
-				Client: client,
+				Client:     client,
+				RulesStore: rulesstore.NewMissing(model.MissingPolicyKeep),
+				Recorder:   recorder,
+				Shard:      tt.shard,
 			}
 
 			req := ctrl.Request{NamespacedName: types.NamespacedName{Name: "test-namespace"}}
@@ -94,6 +215,12 @@ func TestNamespaceReconciler_Reconcile(t *testing.T) {
 				assert.EqualError(t, err, tt.wantError)
 			}
 			assert.Equal(t, tt.wantResult, result)
+			close(recorder.Events)
+			var events []string
+			for event := range recorder.Events {
+				events = append(events, event)
+			}
+			assert.Equal(t, tt.wantEvents, events)
 		})
 	}
 }
@@ -137,15 +264,107 @@ func TestNamespaceReconciler_annotateIngress(t *testing.T) {
 		t.Run(testcase.Name(i, tt.name), func(t *testing.T) {
 			client := fakeclient.NewClient(tt.clientOpts, tt.ingress)
 			r := &NamespaceReconciler{
-				Client: client,
+				Client:   client,
+				Triggers: trigger.New(),
 			}
 
-			err := r.annotateIngress(context.TODO(), *tt.ingress)
+			nn := types.NamespacedName{Namespace: tt.ingress.Namespace, Name: tt.ingress.Name}
+
+			err := r.annotateIngress(context.TODO(), *tt.ingress, false)
 			if tt.wantError != "" {
 				require.EqualError(t, err, tt.wantError)
 			} else {
 				require.NoError(t, err)
 			}
+			// The cause is recorded for the audit log of the Ingress reconcile.
+			assert.Equal(t, audit.TriggerNamespace, r.Triggers.Get(nn).Cause)
+		})
+	}
+}
+
+func TestNamespaceReconciler_Reconcile_Hold(t *testing.T) {
+	ingress1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress1", Namespace: "test-namespace"}}
+	ingress2 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Name: "ingress2", Namespace: "test-namespace",
+		Annotations: map[string]string{model.PausedKey: "true"}}}
+	all := []string{"test-namespace/ingress1", "test-namespace/ingress2"}
+
+	tests := []struct {
+		name                 string
+		dryRun               bool
+		configMapData        map[string]string
+		namespaceAnnotations map[string]string
+		gate                 *rollout.Gate
+		reconcileErr         error
+		wantEvaluated        []string
+		wantTriggered        []string
+	}{
+		{
+			name:          "paused Ingress is evaluated in place",
+			wantEvaluated: []string{"test-namespace/ingress2"},
+			wantTriggered: []string{"test-namespace/ingress1"},
+		},
+		{
+			name:          "dry run",
+			dryRun:        true,
+			wantEvaluated: all,
+		},
+		{
+			name:          "paused by ConfigMap",
+			configMapData: map[string]string{"rules": "", "paused": "true"},
+			wantEvaluated: all,
+		},
+		{
+			name:                 "paused by Namespace",
+			namespaceAnnotations: map[string]string{model.PausedKey: "true"},
+			wantEvaluated:        all,
+		},
+		{
+			name:          "held by rollout gate",
+			gate:          rollout.NewGate(),
+			wantEvaluated: all,
+		},
+		{
+			name:                 "evaluation error is only logged",
+			namespaceAnnotations: map[string]string{model.PausedKey: "true"},
+			reconcileErr:         errors.New("mocked error"),
+			wantEvaluated:        all,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(testcase.Name(i, tt.name), func(t *testing.T) {
+			namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-namespace", Annotations: tt.namespaceAnnotations}}
+			client := fakeclient.NewClient(nil, namespace, ingress1, ingress2)
+			store := rulesstore.NewMissing(model.MissingPolicyKeep)
+			if tt.configMapData != nil {
+				require.NoError(t, store.UpdateRules(&corev1.ConfigMap{Data: tt.configMapData}))
+			}
+			var evaluated []string
+			r := &NamespaceReconciler{
+				Client:     client,
+				RulesStore: store,
+				Recorder:   record.NewFakeRecorder(10),
+				DryRun:     tt.dryRun,
+				Gate:       tt.gate,
+				IngressReconciler: reconcile.Func(func(_ context.Context, req ctrl.Request) (ctrl.Result, error) {
+					evaluated = append(evaluated, req.String())
+					return ctrl.Result{}, tt.reconcileErr
+				}),
+			}
+
+			_, err := r.Reconcile(context.TODO(), ctrl.Request{NamespacedName: types.NamespacedName{Name: "test-namespace"}})
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantEvaluated, evaluated)
+
+			var ingressList networkingv1.IngressList
+			require.NoError(t, client.List(context.TODO(), &ingressList))
+			var triggered []string
+			for _, ing := range ingressList.Items {
+				if _, ok := ing.Annotations[model.ReconcileKey]; ok {
+					triggered = append(triggered, ing.Namespace+"/"+ing.Name)
+				}
+			}
+			assert.Equal(t, tt.wantTriggered, triggered)
 		})
 	}
 }
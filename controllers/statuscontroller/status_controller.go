@@ -0,0 +1,312 @@
+/*
+Copyright 2024.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package statuscontroller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	"github.com/kuoss/ingress-annotator/api/v1alpha1"
+	"github.com/kuoss/ingress-annotator/pkg/dryrun"
+	"github.com/kuoss/ingress-annotator/pkg/model"
+	"github.com/kuoss/ingress-annotator/pkg/progress"
+	"github.com/kuoss/ingress-annotator/pkg/rulesstore"
+	"github.com/kuoss/ingress-annotator/pkg/scope"
+	"github.com/kuoss/ingress-annotator/pkg/shard"
+)
+
+const (
+	// progressingRequeue is how often the status is refreshed while Ingresses are pending.
+	progressingRequeue = 5 * time.Second
+	// maxUnknownRuleReferences caps the Ingresses listed in the status.
+	maxUnknownRuleReferences = 50
+)
+
+// StatusReconciler maintains the AnnotatorStatus named NN, summarizing the
+// progress of applying the rules to Ingresses.
+type StatusReconciler struct {
+	client.Client
+	NN         types.NamespacedName
+	RulesStore rulesstore.IRulesStore
+	Progress   *progress.Tracker
+	// StagedReport holds the preview of the staged rules, if any.
+	StagedReport *dryrun.Report
+	// Scope restricts the Ingresses summarized to those of some namespaces.
+	Scope *scope.Scope
+	// Shard is the share of namespaces of this replica when replicas share
+	// the namespaces. The Ingresses of other shards are summarized from
+	// their status annotation, as their progress is only known to the
+	// replica that reconciled them.
+	Shard *shard.Shard
+}
+
+// +kubebuilder:rbac:groups=annotator.kuoss.io,resources=annotatorstatuses,verbs=get;list;watch;create;update;patch
+// +kubebuilder:rbac:groups=annotator.kuoss.io,resources=annotatorstatuses/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *StatusReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	enqueueStatus := handler.EnqueueRequestsFromMapFunc(func(context.Context, client.Object) []reconcile.Request {
+		return []reconcile.Request{{NamespacedName: r.NN}}
+	})
+	isRulesConfigMap := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return obj.GetNamespace() == r.NN.Namespace && obj.GetName() == r.NN.Name
+	})
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("annotatorstatus").
+		For(&v1alpha1.AnnotatorStatus{}).
+		Watches(&networkingv1.Ingress{}, enqueueStatus).
+		Watches(&corev1.ConfigMap{}, enqueueStatus, builder.WithPredicates(isRulesConfigMap)).
+		Complete(r)
+}
+
+func (r *StatusReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	if req.NamespacedName != r.NN {
+		return ctrl.Result{}, nil
+	}
+
+	var ingressList networkingv1.IngressList
+	if err := r.List(ctx, &ingressList); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to list ingresses: %w", err)
+	}
+	ingresses, err := r.inScope(ctx, ingressList.Items)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	status := r.summarize(ingresses)
+
+	var annotatorStatus v1alpha1.AnnotatorStatus
+	if err := r.Get(ctx, r.NN, &annotatorStatus); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return ctrl.Result{}, fmt.Errorf("failed to get AnnotatorStatus: %w", err)
+		}
+		annotatorStatus = v1alpha1.AnnotatorStatus{
+			ObjectMeta: metav1.ObjectMeta{Namespace: r.NN.Namespace, Name: r.NN.Name},
+		}
+		if err := r.Create(ctx, &annotatorStatus); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to create AnnotatorStatus: %w", err)
+		}
+	}
+
+	// Merge into the existing conditions so transition times only move on transitions.
+	conditions := annotatorStatus.Status.Conditions
+	for _, condition := range status.Conditions {
+		meta.SetStatusCondition(&conditions, condition)
+	}
+	status.Conditions = conditions
+
+	if !equality.Semantic.DeepEqual(annotatorStatus.Status, status) {
+		annotatorStatus.Status = status
+		if err := r.Status().Update(ctx, &annotatorStatus); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update AnnotatorStatus: %w", err)
+		}
+	}
+
+	if status.Ingresses.Pending > 0 {
+		return ctrl.Result{RequeueAfter: progressingRequeue}, nil
+	}
+	return ctrl.Result{}, nil
+}
+
+// inScope returns the ingresses of the namespaces in scope.
+func (r *StatusReconciler) inScope(ctx context.Context, ingresses []networkingv1.Ingress) ([]networkingv1.Ingress, error) {
+	if r.Scope == nil {
+		return ingresses, nil
+	}
+	var namespaceList corev1.NamespaceList
+	if err := r.List(ctx, &namespaceList); err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	included := make(map[string]bool, len(namespaceList.Items))
+	for _, namespace := range namespaceList.Items {
+		included[namespace.Name] = r.Scope.Includes(&namespace)
+	}
+	var filtered []networkingv1.Ingress
+	for _, ing := range ingresses {
+		if included[ing.Namespace] {
+			filtered = append(filtered, ing)
+		}
+	}
+	return filtered, nil
+}
+
+// annotatedResult reads the Result of an Ingress from its status annotation.
+// An Ingress without one references no rules, so nothing is pending for it.
+func annotatedResult(ing *networkingv1.Ingress, generation string) (progress.Result, bool) {
+	value, ok := ing.Annotations[model.StatusKey]
+	if !ok {
+		return progress.Result{Generation: generation}, true
+	}
+	var status model.IngressStatus
+	if err := json.Unmarshal([]byte(value), &status); err != nil {
+		return progress.Result{}, false
+	}
+	return progress.Result{
+		Generation:   status.Generation,
+		Rules:        append(slices.Clone(status.Rules), status.Unresolved...),
+		UnknownRules: status.Unresolved,
+		Error:        status.Error,
+	}, true
+}
+
+func (r *StatusReconciler) summarize(ingresses []networkingv1.Ingress) v1alpha1.AnnotatorStatusStatus {
+	generation := r.RulesStore.GetGeneration()
+	results := r.Progress.Snapshot()
+	status := v1alpha1.AnnotatorStatusStatus{RulesGeneration: generation}
+	referenced := make(map[string]bool)
+	unknownCount := 0
+
+	for _, ing := range ingresses {
+		status.Ingresses.Total++
+		result, ok := results[client.ObjectKeyFromObject(&ing)]
+		if !r.Shard.Owns(ing.Namespace) {
+			result, ok = annotatedResult(&ing, generation)
+		}
+		switch {
+		case !ok || result.Generation != generation:
+			status.Ingresses.Pending++
+		case result.Error != "":
+			status.Ingresses.Failed++
+		default:
+			status.Ingresses.UpToDate++
+		}
+		if !ok {
+			continue
+		}
+		for _, rule := range result.Rules {
+			referenced[rule] = true
+		}
+		if len(result.UnknownRules) > 0 {
+			unknownCount++
+			status.UnknownRuleReferences = append(status.UnknownRuleReferences, v1alpha1.IngressReference{
+				Namespace: ing.Namespace,
+				Name:      ing.Name,
+				Rules:     result.UnknownRules,
+			})
+		}
+	}
+	sort.Slice(status.UnknownRuleReferences, func(i, j int) bool {
+		a, b := status.UnknownRuleReferences[i], status.UnknownRuleReferences[j]
+		return a.Namespace < b.Namespace || (a.Namespace == b.Namespace && a.Name < b.Name)
+	})
+	if len(status.UnknownRuleReferences) > maxUnknownRuleReferences {
+		status.UnknownRuleReferences = status.UnknownRuleReferences[:maxUnknownRuleReferences]
+	}
+
+	for _, rule := range r.RulesStore.GetRules().Names() {
+		if !referenced[rule] {
+			status.UnusedRules = append(status.UnusedRules, rule)
+		}
+	}
+
+	if stagedGeneration := r.RulesStore.GetStagedGeneration(); stagedGeneration != "" {
+		status.StagedRules = &v1alpha1.StagedRules{Generation: stagedGeneration}
+		for _, change := range r.StagedReport.Changes() {
+			if change.Generation == stagedGeneration {
+				status.StagedRules.ChangedIngresses++
+			}
+		}
+	}
+
+	status.Conditions = r.conditions(status.Ingresses, unknownCount)
+	return status
+}
+
+func (r *StatusReconciler) conditions(counts v1alpha1.IngressCounts, unknownCount int) []metav1.Condition {
+	progressing := metav1.Condition{
+		Type:    v1alpha1.ConditionProgressing,
+		Status:  metav1.ConditionFalse,
+		Reason:  "RolloutComplete",
+		Message: fmt.Sprintf("%d of %d Ingresses are up to date", counts.UpToDate, counts.Total),
+	}
+	if counts.Pending > 0 {
+		progressing.Status = metav1.ConditionTrue
+		progressing.Reason = "RolloutInProgress"
+		progressing.Message = fmt.Sprintf("%d of %d Ingresses are pending", counts.Pending, counts.Total)
+	}
+
+	degraded := metav1.Condition{
+		Type:    v1alpha1.ConditionDegraded,
+		Status:  metav1.ConditionFalse,
+		Reason:  "AsExpected",
+		Message: "No problems detected",
+	}
+	var problems []string
+	if counts.Failed > 0 {
+		degraded.Reason = "IngressesFailed"
+		problems = append(problems, fmt.Sprintf("%d Ingresses failed", counts.Failed))
+	}
+	if unknownCount > 0 {
+		if len(problems) == 0 {
+			degraded.Reason = "UnknownRules"
+		}
+		problems = append(problems, fmt.Sprintf("%d Ingresses reference unknown rules", unknownCount))
+	}
+	if err := r.RulesStore.LastReadError(); err != nil {
+		if len(problems) == 0 {
+			degraded.Reason = "RulesUnreadable"
+		}
+		problems = append(problems, fmt.Sprintf("rules ConfigMap unreadable: %v", err))
+	}
+	if generation := r.RulesStore.GetRolledBackGeneration(); generation != "" {
+		if len(problems) == 0 {
+			degraded.Reason = "RulesRolledBack"
+		}
+		problems = append(problems, fmt.Sprintf("rules generation %s were rolled back", generation))
+	}
+	if len(problems) > 0 {
+		degraded.Status = metav1.ConditionTrue
+		degraded.Message = strings.Join(problems, "; ")
+	}
+
+	ready := metav1.Condition{
+		Type:    v1alpha1.ConditionReady,
+		Status:  metav1.ConditionTrue,
+		Reason:  "RolloutComplete",
+		Message: "All Ingresses are up to date",
+	}
+	switch {
+	case r.RulesStore.IsPaused():
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, "RulesNotLoaded", "Rules are not loaded"
+	case counts.Failed > 0:
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, "IngressesFailed", degraded.Message
+	case counts.Pending > 0:
+		ready.Status, ready.Reason, ready.Message = metav1.ConditionFalse, "RolloutInProgress", progressing.Message
+	}
+
+	return []metav1.Condition{ready, progressing, degraded}
+}
@@ -0,0 +1,359 @@
+package statuscontroller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmnote/tester/testcase"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/mock/gomock"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/kuoss/ingress-annotator/api/v1alpha1"
+	"github.com/kuoss/ingress-annotator/pkg/dryrun"
+	"github.com/kuoss/ingress-annotator/pkg/model"
+	"github.com/kuoss/ingress-annotator/pkg/progress"
+	"github.com/kuoss/ingress-annotator/pkg/shard"
+	"github.com/kuoss/ingress-annotator/pkg/testutil/fakeclient"
+	"github.com/kuoss/ingress-annotator/pkg/testutil/mocks"
+)
+
+func TestStatusReconciler_SetupWithManager(t *testing.T) {
+	reconciler := &StatusReconciler{
+		Client: fakeclient.NewClient(nil),
+		NN:     types.NamespacedName{Namespace: "default", Name: "ingress-annotator"},
+	}
+	err := reconciler.SetupWithManager(fakeclient.NewManager())
+	assert.NoError(t, err)
+}
+
+func TestStatusReconciler_Reconcile(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	nn := types.NamespacedName{Namespace: "default", Name: "ingress-annotator"}
+	ing1 := types.NamespacedName{Namespace: "ns1", Name: "ing1"}
+	ing2 := types.NamespacedName{Namespace: "ns2", Name: "ing2"}
+	rules := &model.Rules{"rule1": {"key1": "value1"}, "rule2": {"key2": "value2"}}
+
+	testCases := []struct {
+		name           string
+		clientOpts     *fakeclient.ClientOpts
+		requestNN      types.NamespacedName
+		results        map[types.NamespacedName]progress.Result
+		paused         bool
+		readError      error
+		rolledBack     string
+		staged         []dryrun.Change
+		want           ctrl.Result
+		wantError      string
+		wantStatus     *v1alpha1.AnnotatorStatusStatus
+		wantConditions map[string]string
+	}{
+		{
+			name:      "Ignore other requests",
+			requestNN: types.NamespacedName{Namespace: "default", Name: "xxx"},
+			want:      ctrl.Result{},
+		},
+		{
+			name:       "List error",
+			clientOpts: &fakeclient.ClientOpts{ListError: true},
+			requestNN:  nn,
+			wantError:  "failed to list ingresses: mocked ListError",
+		},
+		{
+			name:      "Ingresses not reconciled yet are pending",
+			requestNN: nn,
+			results: map[types.NamespacedName]progress.Result{
+				ing1: {Generation: "gen1", Rules: []string{"rule1"}},
+			},
+			want: ctrl.Result{RequeueAfter: progressingRequeue},
+			wantStatus: &v1alpha1.AnnotatorStatusStatus{
+				RulesGeneration: "gen1",
+				Ingresses:       v1alpha1.IngressCounts{Total: 2, UpToDate: 1, Pending: 1},
+				UnusedRules:     []string{"rule2"},
+			},
+			wantConditions: map[string]string{"Ready": "RolloutInProgress", "Progressing": "RolloutInProgress", "Degraded": "AsExpected"},
+		},
+		{
+			name:      "Ingresses reconciled with an older generation are pending",
+			requestNN: nn,
+			results: map[types.NamespacedName]progress.Result{
+				ing1: {Generation: "gen0", Rules: []string{"rule1"}},
+				ing2: {Generation: "gen1", Rules: []string{"rule2"}},
+			},
+			want: ctrl.Result{RequeueAfter: progressingRequeue},
+			wantStatus: &v1alpha1.AnnotatorStatusStatus{
+				RulesGeneration: "gen1",
+				Ingresses:       v1alpha1.IngressCounts{Total: 2, UpToDate: 1, Pending: 1},
+			},
+			wantConditions: map[string]string{"Ready": "RolloutInProgress", "Progressing": "RolloutInProgress", "Degraded": "AsExpected"},
+		},
+		{
+			name:      "Ingresses held back before their first update are pending",
+			requestNN: nn,
+			results: map[types.NamespacedName]progress.Result{
+				ing1: {Rules: []string{"rule1"}},
+				ing2: {Generation: "gen1", Rules: []string{"rule2"}},
+			},
+			want: ctrl.Result{RequeueAfter: progressingRequeue},
+			wantStatus: &v1alpha1.AnnotatorStatusStatus{
+				RulesGeneration: "gen1",
+				Ingresses:       v1alpha1.IngressCounts{Total: 2, UpToDate: 1, Pending: 1},
+			},
+			wantConditions: map[string]string{"Ready": "RolloutInProgress", "Progressing": "RolloutInProgress", "Degraded": "AsExpected"},
+		},
+		{
+			name:      "All Ingresses up to date",
+			requestNN: nn,
+			results: map[types.NamespacedName]progress.Result{
+				ing1: {Generation: "gen1", Rules: []string{"rule1"}},
+				ing2: {Generation: "gen1", Rules: []string{"rule1", "rule2"}},
+			},
+			want: ctrl.Result{},
+			wantStatus: &v1alpha1.AnnotatorStatusStatus{
+				RulesGeneration: "gen1",
+				Ingresses:       v1alpha1.IngressCounts{Total: 2, UpToDate: 2},
+			},
+			wantConditions: map[string]string{"Ready": "RolloutComplete", "Progressing": "RolloutComplete", "Degraded": "AsExpected"},
+		},
+		{
+			name:      "Failed Ingresses and unknown rules degrade the status",
+			requestNN: nn,
+			results: map[types.NamespacedName]progress.Result{
+				ing1: {Generation: "gen1", Rules: []string{"rule1"}, Error: "mocked error"},
+				ing2: {Generation: "gen1", Rules: []string{"rule2", "xxx"}, UnknownRules: []string{"xxx"}},
+			},
+			want: ctrl.Result{},
+			wantStatus: &v1alpha1.AnnotatorStatusStatus{
+				RulesGeneration: "gen1",
+				Ingresses:       v1alpha1.IngressCounts{Total: 2, UpToDate: 1, Failed: 1},
+				UnknownRuleReferences: []v1alpha1.IngressReference{
+					{Namespace: "ns2", Name: "ing2", Rules: []string{"xxx"}},
+				},
+			},
+			wantConditions: map[string]string{"Ready": "IngressesFailed", "Progressing": "RolloutComplete", "Degraded": "IngressesFailed"},
+		},
+		{
+			name:       "Rolled back rules degrade the status",
+			requestNN:  nn,
+			rolledBack: "gen2",
+			results: map[types.NamespacedName]progress.Result{
+				ing1: {Generation: "gen1", Rules: []string{"rule1"}},
+				ing2: {Generation: "gen1", Rules: []string{"rule2"}},
+			},
+			want: ctrl.Result{},
+			wantStatus: &v1alpha1.AnnotatorStatusStatus{
+				RulesGeneration: "gen1",
+				Ingresses:       v1alpha1.IngressCounts{Total: 2, UpToDate: 2},
+			},
+			wantConditions: map[string]string{"Ready": "RolloutComplete", "Progressing": "RolloutComplete", "Degraded": "RulesRolledBack"},
+		},
+		{
+			name:      "Staged rules count the Ingresses they would change",
+			requestNN: nn,
+			results: map[types.NamespacedName]progress.Result{
+				ing1: {Generation: "gen1", Rules: []string{"rule1"}},
+				ing2: {Generation: "gen1", Rules: []string{"rule2"}},
+			},
+			staged: []dryrun.Change{
+				{Namespace: "ns1", Name: "ing1", Generation: "gen2"},
+				{Namespace: "ns2", Name: "ing2", Generation: "gen0"},
+			},
+			want: ctrl.Result{},
+			wantStatus: &v1alpha1.AnnotatorStatusStatus{
+				RulesGeneration: "gen1",
+				Ingresses:       v1alpha1.IngressCounts{Total: 2, UpToDate: 2},
+				StagedRules:     &v1alpha1.StagedRules{Generation: "gen2", ChangedIngresses: 1},
+			},
+			wantConditions: map[string]string{"Ready": "RolloutComplete", "Progressing": "RolloutComplete", "Degraded": "AsExpected"},
+		},
+		{
+			name:      "Unreadable rules degrade the status",
+			requestNN: nn,
+			readError: errors.New("mocked error"),
+			results: map[types.NamespacedName]progress.Result{
+				ing1: {Generation: "gen1", Rules: []string{"rule1"}},
+				ing2: {Generation: "gen1", Rules: []string{"rule2"}},
+			},
+			want: ctrl.Result{},
+			wantStatus: &v1alpha1.AnnotatorStatusStatus{
+				RulesGeneration: "gen1",
+				Ingresses:       v1alpha1.IngressCounts{Total: 2, UpToDate: 2},
+			},
+			wantConditions: map[string]string{"Ready": "RolloutComplete", "Progressing": "RolloutComplete", "Degraded": "RulesUnreadable"},
+		},
+		{
+			name:      "Paused rules are not ready",
+			requestNN: nn,
+			paused:    true,
+			want:      ctrl.Result{RequeueAfter: progressingRequeue},
+			wantStatus: &v1alpha1.AnnotatorStatusStatus{
+				RulesGeneration: "gen1",
+				Ingresses:       v1alpha1.IngressCounts{Total: 2, Pending: 2},
+				UnusedRules:     []string{"rule1", "rule2"},
+			},
+			wantConditions: map[string]string{"Ready": "RulesNotLoaded", "Progressing": "RolloutInProgress", "Degraded": "AsExpected"},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			ctx := context.Background()
+			client := fakeclient.NewClient(tc.clientOpts,
+				&networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: ing1.Namespace, Name: ing1.Name}},
+				&networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: ing2.Namespace, Name: ing2.Name}},
+			)
+
+			opts := mocks.RulesStoreOpts{Rules: rules, Paused: tc.paused, ReadError: tc.readError, RolledBack: tc.rolledBack}
+			if tc.staged != nil {
+				opts.StagedGeneration = "gen2"
+			}
+			store := mocks.NewRulesStore(mockCtrl, opts)
+			stagedReport := dryrun.NewReport()
+			stagedReport.Replace(tc.staged)
+
+			tracker := progress.NewTracker()
+			for nn, result := range tc.results {
+				tracker.Record(nn, result)
+			}
+
+			reconciler := &StatusReconciler{
+				Client:       client,
+				NN:           nn,
+				RulesStore:   store,
+				Progress:     tracker,
+				StagedReport: stagedReport,
+			}
+			got, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: tc.requestNN})
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+
+			var annotatorStatus v1alpha1.AnnotatorStatus
+			err = client.Get(ctx, nn, &annotatorStatus)
+			if tc.wantStatus == nil {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+
+			conditions := map[string]string{}
+			for _, condition := range annotatorStatus.Status.Conditions {
+				conditions[condition.Type] = condition.Reason
+			}
+			assert.Equal(t, tc.wantConditions, conditions)
+			annotatorStatus.Status.Conditions = nil
+			assert.Equal(t, *tc.wantStatus, annotatorStatus.Status)
+		})
+	}
+}
+
+func TestStatusReconciler_Reconcile_KeepsTransitionTime(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	ctx := context.Background()
+	nn := types.NamespacedName{Namespace: "default", Name: "ingress-annotator"}
+	since := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	existing := &v1alpha1.AnnotatorStatus{
+		ObjectMeta: metav1.ObjectMeta{Namespace: nn.Namespace, Name: nn.Name},
+		Status: v1alpha1.AnnotatorStatusStatus{
+			Conditions: []metav1.Condition{
+				{Type: v1alpha1.ConditionReady, Status: metav1.ConditionTrue, Reason: "Old", LastTransitionTime: since},
+			},
+		},
+	}
+	client := fakeclient.NewClient(nil, existing)
+
+	store := mocks.NewRulesStore(mockCtrl, mocks.RulesStoreOpts{Rules: &model.Rules{}})
+
+	reconciler := &StatusReconciler{Client: client, NN: nn, RulesStore: store, Progress: progress.NewTracker()}
+	_, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+	assert.NoError(t, err)
+
+	var annotatorStatus v1alpha1.AnnotatorStatus
+	assert.NoError(t, client.Get(ctx, nn, &annotatorStatus))
+	ready := meta.FindStatusCondition(annotatorStatus.Status.Conditions, v1alpha1.ConditionReady)
+	assert.Equal(t, "RolloutComplete", ready.Reason)
+	assert.True(t, since.Equal(&ready.LastTransitionTime))
+}
+
+func TestStatusReconciler_Reconcile_Shard(t *testing.T) {
+	mockCtrl := gomock.NewController(t)
+	defer mockCtrl.Finish()
+
+	ctx := context.Background()
+	nn := types.NamespacedName{Namespace: "default", Name: "ingress-annotator"}
+	client := fakeclient.NewClient(nil,
+		&networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "ns1", Name: "ing1",
+			Annotations: map[string]string{model.StatusKey: `{"generation":"gen1","rules":["rule1"],"unresolved":["xxx"]}`}}},
+		&networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "ns2", Name: "ing2",
+			Annotations: map[string]string{model.StatusKey: `{"generation":"gen0","rules":["rule1"]}`}}},
+		&networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "ns3", Name: "ing3"}},
+	)
+
+	store := mocks.NewRulesStore(mockCtrl, mocks.RulesStoreOpts{Rules: &model.Rules{"rule1": {"key1": "value1"}}})
+
+	// The progress recorded before the namespaces moved to another replica is ignored.
+	tracker := progress.NewTracker()
+	tracker.Record(types.NamespacedName{Namespace: "ns2", Name: "ing2"}, progress.Result{Generation: "gen1"})
+
+	reconciler := &StatusReconciler{
+		Client:     client,
+		NN:         nn,
+		RulesStore: store,
+		Progress:   tracker,
+		Shard:      shard.NewFixed("pod-0", "pod-1"),
+	}
+	got, err := reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: nn})
+	assert.NoError(t, err)
+	assert.Equal(t, ctrl.Result{RequeueAfter: progressingRequeue}, got)
+
+	var annotatorStatus v1alpha1.AnnotatorStatus
+	assert.NoError(t, client.Get(ctx, nn, &annotatorStatus))
+	assert.Equal(t, v1alpha1.IngressCounts{Total: 3, UpToDate: 2, Pending: 1}, annotatorStatus.Status.Ingresses)
+	assert.Equal(t, []v1alpha1.IngressReference{{Namespace: "ns1", Name: "ing1", Rules: []string{"xxx"}}},
+		annotatorStatus.Status.UnknownRuleReferences)
+}
+
+func TestAnnotatedResult(t *testing.T) {
+	testCases := []struct {
+		annotations map[string]string
+		want        progress.Result
+		wantOK      bool
+	}{
+		{
+			annotations: nil,
+			want:        progress.Result{Generation: "gen1"},
+			wantOK:      true,
+		},
+		{
+			annotations: map[string]string{model.StatusKey: `{"generation":"gen0","rules":["rule1"],"unresolved":["xxx"],"error":"mocked error"}`},
+			want:        progress.Result{Generation: "gen0", Rules: []string{"rule1", "xxx"}, UnknownRules: []string{"xxx"}, Error: "mocked error"},
+			wantOK:      true,
+		},
+		{
+			annotations: map[string]string{model.StatusKey: `invalid`},
+			want:        progress.Result{},
+			wantOK:      false,
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i), func(t *testing.T) {
+			ing := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Annotations: tc.annotations}}
+			got, ok := annotatedResult(ing, "gen1")
+			assert.Equal(t, tc.want, got)
+			assert.Equal(t, tc.wantOK, ok)
+		})
+	}
+}
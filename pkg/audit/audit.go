@@ -0,0 +1,165 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Trigger is the cause of a change to an Ingress.
+type Trigger string
+
+const (
+	// TriggerConfigMap is a change of the rules ConfigMap.
+	TriggerConfigMap Trigger = "configmap"
+	// TriggerNamespace is a change of the Namespace of the Ingress.
+	TriggerNamespace Trigger = "namespace"
+	// TriggerIngress is an edit of the Ingress itself.
+	TriggerIngress Trigger = "ingress"
+	// TriggerCleanup is the removal of all managed annotations.
+	TriggerCleanup Trigger = "cleanup"
+)
+
+// Redacted replaces the values of sensitive annotations.
+const Redacted = "<redacted>"
+
+// Change is a single annotation written to an Ingress.
+type Change struct {
+	Key       string `json:"key"`
+	Operation string `json:"operation"`
+	Old       string `json:"old,omitempty"`
+	New       string `json:"new,omitempty"`
+}
+
+// Record is one mutation of an Ingress.
+type Record struct {
+	Time       time.Time `json:"time"`
+	Namespace  string    `json:"namespace"`
+	Ingress    string    `json:"ingress"`
+	Trigger    Trigger   `json:"trigger"`
+	Generation string    `json:"generation,omitempty"`
+	Rules      []string  `json:"rules,omitempty"`
+	Changes    []Change  `json:"changes"`
+}
+
+// Sink receives audit Records.
+type Sink interface {
+	Write(ctx context.Context, record Record) error
+}
+
+// NewSink returns the Sink described by spec: "stdout", "file:<path>" or an
+// http(s) URL records are POSTed to. An empty spec returns a nil Sink.
+func NewSink(spec string) (Sink, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case spec == "stdout":
+		return NewWriterSink(os.Stdout), nil
+	case strings.HasPrefix(spec, "file:"):
+		name := strings.TrimPrefix(spec, "file:")
+		file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+		return NewWriterSink(file), nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &WebhookSink{URL: spec, Client: &http.Client{Timeout: 5 * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("invalid audit sink %q: must be stdout, file:<path> or an http(s) URL", spec)
+}
+
+// WriterSink writes Records as JSON lines.
+type WriterSink struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Write(_ context.Context, record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// WebhookSink POSTs each Record as JSON to URL.
+type WebhookSink struct {
+	URL    string
+	Client *http.Client
+}
+
+func (s *WebhookSink) Write(ctx context.Context, record Record) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("audit webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Logger redacts Records and hands them to a Sink. A nil Logger, or one
+// without a Sink, discards them.
+type Logger struct {
+	Sink Sink
+	// Redact lists the annotation keys whose values are never logged, as
+	// path.Match patterns, e.g. "*/auth-secret".
+	Redact []string
+}
+
+// Log writes record to the Sink.
+func (l *Logger) Log(ctx context.Context, record Record) error {
+	if l == nil || l.Sink == nil || len(record.Changes) == 0 {
+		return nil
+	}
+	changes := make([]Change, len(record.Changes))
+	for i, change := range record.Changes {
+		if l.isSensitive(change.Key) {
+			if change.Old != "" {
+				change.Old = Redacted
+			}
+			if change.New != "" {
+				change.New = Redacted
+			}
+		}
+		changes[i] = change
+	}
+	record.Changes = changes
+	return l.Sink.Write(ctx, record)
+}
+
+func (l *Logger) isSensitive(key string) bool {
+	for _, pattern := range l.Redact {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jmnote/tester/testcase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSink struct {
+	records []Record
+	err     error
+}
+
+func (s *fakeSink) Write(_ context.Context, record Record) error {
+	s.records = append(s.records, record)
+	return s.err
+}
+
+func TestNewSink(t *testing.T) {
+	dir := t.TempDir()
+	testCases := []struct {
+		spec      string
+		wantType  string
+		wantError string
+	}{
+		{spec: ""},
+		{spec: "stdout", wantType: "*audit.WriterSink"},
+		{spec: "file:" + filepath.Join(dir, "audit.jsonl"), wantType: "*audit.WriterSink"},
+		{spec: "file:" + filepath.Join(dir, "missing", "audit.jsonl"), wantError: "failed to open audit log: open " + filepath.Join(dir, "missing", "audit.jsonl") + ": no such file or directory"},
+		{spec: "http://localhost:8080/audit", wantType: "*audit.WebhookSink"},
+		{spec: "https://audit.example.com", wantType: "*audit.WebhookSink"},
+		{spec: "syslog", wantError: `invalid audit sink "syslog": must be stdout, file:<path> or an http(s) URL`},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.spec), func(t *testing.T) {
+			got, err := NewSink(tc.spec)
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+				return
+			}
+			assert.NoError(t, err)
+			if tc.wantType == "" {
+				assert.Nil(t, got)
+				return
+			}
+			assert.Equal(t, tc.wantType, fmt.Sprintf("%T", got))
+		})
+	}
+}
+
+func TestWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriterSink(&buf)
+	record := Record{
+		Time:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Namespace: "default",
+		Ingress:   "my-ingress",
+		Trigger:   TriggerConfigMap,
+		Changes:   []Change{{Key: "new-key", Operation: "added", New: "new-value"}},
+	}
+	assert.NoError(t, sink.Write(context.Background(), record))
+	assert.NoError(t, sink.Write(context.Background(), record))
+
+	line := `{"time":"2024-01-02T03:04:05Z","namespace":"default","ingress":"my-ingress","trigger":"configmap","changes":[{"key":"new-key","operation":"added","new":"new-value"}]}` + "\n"
+	assert.Equal(t, line+line, buf.String())
+}
+
+func TestWriterSink_File(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "audit.jsonl")
+	for i := 0; i < 2; i++ {
+		sink, err := NewSink("file:" + name)
+		require.NoError(t, err)
+		assert.NoError(t, sink.Write(context.Background(), Record{Namespace: "default", Ingress: "my-ingress"}))
+	}
+
+	// Records are appended.
+	data, err := os.ReadFile(name)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, bytes.Count(data, []byte("\n")))
+}
+
+func TestWebhookSink(t *testing.T) {
+	testCases := []struct {
+		name      string
+		status    int
+		wantError string
+	}{
+		{name: "Accepted", status: http.StatusNoContent},
+		{name: "Rejected", status: http.StatusBadRequest, wantError: "audit webhook returned 400 Bad Request"},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			var got Record
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+				body, _ := io.ReadAll(r.Body)
+				assert.NoError(t, json.Unmarshal(body, &got))
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			sink := &WebhookSink{URL: server.URL, Client: server.Client()}
+			err := sink.Write(context.Background(), Record{Namespace: "default", Ingress: "my-ingress"})
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, "my-ingress", got.Ingress)
+		})
+	}
+}
+
+func TestLogger(t *testing.T) {
+	record := Record{
+		Namespace: "default",
+		Ingress:   "my-ingress",
+		Changes: []Change{
+			{Key: "example.com/auth-secret", Operation: "changed", Old: "old-secret", New: "new-secret"},
+			{Key: "example.com/token", Operation: "removed", Old: "old-token"},
+			{Key: "new-key", Operation: "added", New: "new-value"},
+		},
+	}
+	sink := &fakeSink{}
+	logger := &Logger{Sink: sink, Redact: []string{"*/auth-secret", "example.com/tok*"}}
+	assert.NoError(t, logger.Log(context.Background(), record))
+	assert.Equal(t, []Record{{
+		Namespace: "default",
+		Ingress:   "my-ingress",
+		Changes: []Change{
+			{Key: "example.com/auth-secret", Operation: "changed", Old: Redacted, New: Redacted},
+			{Key: "example.com/token", Operation: "removed", Old: Redacted},
+			{Key: "new-key", Operation: "added", New: "new-value"},
+		},
+	}}, sink.records)
+	// The caller's record is not modified.
+	assert.Equal(t, "old-secret", record.Changes[0].Old)
+
+	// Records without changes are not logged.
+	assert.NoError(t, logger.Log(context.Background(), Record{Namespace: "default", Ingress: "my-ingress"}))
+	assert.Len(t, sink.records, 1)
+
+	sink.err = errors.New("mocked error")
+	assert.EqualError(t, logger.Log(context.Background(), record), "mocked error")
+}
+
+func TestLogger_Nil(t *testing.T) {
+	record := Record{Changes: []Change{{Key: "new-key", Operation: "added", New: "new-value"}}}
+	var logger *Logger
+	assert.NoError(t, logger.Log(context.Background(), record))
+	assert.NoError(t, (&Logger{}).Log(context.Background(), record))
+}
@@ -0,0 +1,138 @@
+package backoff
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/ratelimiter"
+)
+
+// Options configures how failed reconciles are retried.
+type Options struct {
+	// BaseDelay is the delay before the first retry of an object; it doubles
+	// with every consecutive failure.
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between retries.
+	MaxDelay time.Duration
+	// Jitter adds up to this fraction of each delay at random, so that
+	// objects failing together are not retried together.
+	Jitter float64
+	// MaxRetries is the number of retries after which an Ingress is marked
+	// failed instead of retried; 0 retries forever.
+	MaxRetries int
+}
+
+// Policy hands out the rate limiters of the controller queues.
+type Policy struct {
+	opts Options
+}
+
+// New returns the Policy of opts.
+func New(opts Options) (*Policy, error) {
+	switch {
+	case opts.BaseDelay <= 0:
+		return nil, fmt.Errorf("invalid retry base delay %v: must be positive", opts.BaseDelay)
+	case opts.MaxDelay < opts.BaseDelay:
+		return nil, fmt.Errorf("invalid retry max delay %v: must be at least the base delay %v", opts.MaxDelay, opts.BaseDelay)
+	case opts.Jitter < 0 || opts.Jitter > 1:
+		return nil, fmt.Errorf("invalid retry jitter %v: must be between 0 and 1", opts.Jitter)
+	case opts.MaxRetries < 0:
+		return nil, fmt.Errorf("invalid max retries %d: must not be negative", opts.MaxRetries)
+	}
+	return &Policy{opts: opts}, nil
+}
+
+// RateLimiter returns a new rate limiter for the queue of one controller:
+// an exponential backoff with jitter per object, under the overall limit of
+// 10 qps with bursts of 100 that controller-runtime applies by default.
+// A nil Policy returns nil, leaving the controller-runtime default in place.
+func (p *Policy) RateLimiter() ratelimiter.RateLimiter {
+	if p == nil {
+		return nil
+	}
+	return workqueue.NewMaxOfRateLimiter(
+		&jitter{
+			RateLimiter: workqueue.NewItemExponentialFailureRateLimiter(p.opts.BaseDelay, p.opts.MaxDelay),
+			fraction:    p.opts.Jitter,
+			random:      rand.Float64,
+		},
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(10), 100)},
+	)
+}
+
+// jitter adds a random fraction to the delays of a RateLimiter.
+type jitter struct {
+	workqueue.RateLimiter
+	fraction float64
+	random   func() float64
+}
+
+func (j *jitter) When(item interface{}) time.Duration {
+	delay := j.RateLimiter.When(item)
+	return delay + time.Duration(j.fraction*j.random()*float64(delay))
+}
+
+// Retries counts the consecutive failed reconciles of each Ingress, and
+// gives up on those failing more than a maximum number of times. A nil
+// Retries, or one without a maximum, retries forever.
+type Retries struct {
+	max      int
+	mutex    sync.Mutex
+	failures map[types.NamespacedName]int
+	failed   map[types.NamespacedName]bool
+}
+
+func NewRetries(max int) *Retries {
+	return &Retries{
+		max:      max,
+		failures: make(map[types.NamespacedName]int),
+		failed:   make(map[types.NamespacedName]bool),
+	}
+}
+
+// Failed records a failed reconcile of nn and reports whether it should be
+// retried. Once it should not, nn counts as failed until it succeeds, and
+// its next failure starts a new series of retries.
+func (r *Retries) Failed(nn types.NamespacedName) bool {
+	if r == nil || r.max <= 0 {
+		return true
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.failures[nn]++
+	if r.failures[nn] <= r.max {
+		return true
+	}
+	delete(r.failures, nn)
+	r.failed[nn] = true
+	return false
+}
+
+// Succeeded forgets the failures of nn.
+func (r *Retries) Succeeded(nn types.NamespacedName) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.failures, nn)
+	delete(r.failed, nn)
+}
+
+// GivenUp returns the number of Ingresses marked failed.
+func (r *Retries) GivenUp() int {
+	if r == nil {
+		return 0
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return len(r.failed)
+}
@@ -0,0 +1,129 @@
+package backoff
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jmnote/tester/testcase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestNew(t *testing.T) {
+	testCases := []struct {
+		opts      Options
+		wantError string
+	}{
+		{
+			opts: Options{BaseDelay: time.Second, MaxDelay: time.Minute, Jitter: 0.2, MaxRetries: 10},
+		},
+		{
+			opts:      Options{BaseDelay: 0, MaxDelay: time.Minute},
+			wantError: "invalid retry base delay 0s: must be positive",
+		},
+		{
+			opts:      Options{BaseDelay: time.Minute, MaxDelay: time.Second},
+			wantError: "invalid retry max delay 1s: must be at least the base delay 1m0s",
+		},
+		{
+			opts:      Options{BaseDelay: time.Second, MaxDelay: time.Minute, Jitter: 1.5},
+			wantError: "invalid retry jitter 1.5: must be between 0 and 1",
+		},
+		{
+			opts:      Options{BaseDelay: time.Second, MaxDelay: time.Minute, MaxRetries: -1},
+			wantError: "invalid max retries -1: must not be negative",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i), func(t *testing.T) {
+			policy, err := New(tc.opts)
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+				assert.Nil(t, policy)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NotNil(t, policy.RateLimiter())
+		})
+	}
+}
+
+func TestPolicy_RateLimiter(t *testing.T) {
+	assert.Nil(t, (*Policy)(nil).RateLimiter())
+
+	policy, err := New(Options{BaseDelay: time.Second, MaxDelay: 5 * time.Second})
+	require.NoError(t, err)
+	limiter := policy.RateLimiter()
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		delays = append(delays, limiter.When("item"))
+	}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, delays)
+	assert.Equal(t, 5, limiter.NumRequeues("item"))
+
+	// Objects back off on their own.
+	assert.Equal(t, time.Second, limiter.When("other"))
+	limiter.Forget("item")
+	assert.Equal(t, time.Second, limiter.When("item"))
+
+	// Each controller gets its own.
+	assert.Equal(t, time.Second, policy.RateLimiter().When("item"))
+}
+
+func TestJitter(t *testing.T) {
+	testCases := []struct {
+		fraction float64
+		random   float64
+		want     time.Duration
+	}{
+		{fraction: 0, random: 0.5, want: 10 * time.Second},
+		{fraction: 0.2, random: 0, want: 10 * time.Second},
+		{fraction: 0.2, random: 0.5, want: 11 * time.Second},
+		{fraction: 1, random: 0.99, want: 19900 * time.Millisecond},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i), func(t *testing.T) {
+			j := &jitter{
+				RateLimiter: workqueue.NewItemExponentialFailureRateLimiter(10*time.Second, time.Minute),
+				fraction:    tc.fraction,
+				random:      func() float64 { return tc.random },
+			}
+			assert.Equal(t, tc.want, j.When("item"))
+		})
+	}
+}
+
+func TestRetries(t *testing.T) {
+	nn := types.NamespacedName{Namespace: "default", Name: "ingress1"}
+	other := types.NamespacedName{Namespace: "default", Name: "ingress2"}
+
+	var nilRetries *Retries
+	assert.True(t, nilRetries.Failed(nn))
+	nilRetries.Succeeded(nn)
+	assert.Equal(t, 0, nilRetries.GivenUp())
+
+	unlimited := NewRetries(0)
+	for i := 0; i < 100; i++ {
+		assert.True(t, unlimited.Failed(nn))
+	}
+	assert.Equal(t, 0, unlimited.GivenUp())
+
+	retries := NewRetries(2)
+	assert.True(t, retries.Failed(nn))
+	assert.True(t, retries.Failed(nn))
+	assert.True(t, retries.Failed(other))
+	assert.False(t, retries.Failed(nn), "gives up after 2 retries")
+	assert.Equal(t, 1, retries.GivenUp())
+
+	// A new series of retries starts on the next failure.
+	assert.True(t, retries.Failed(nn))
+	assert.Equal(t, 1, retries.GivenUp())
+
+	retries.Succeeded(nn)
+	assert.Equal(t, 0, retries.GivenUp())
+	assert.True(t, retries.Failed(nn))
+	assert.True(t, retries.Failed(nn))
+	assert.False(t, retries.Failed(nn))
+}
@@ -0,0 +1,71 @@
+// Package cachescope restricts the informer cache of the manager to the
+// objects, and the parts of them, the annotator reads.
+package cachescope
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kuoss/ingress-annotator/api/v1alpha1"
+	"github.com/kuoss/ingress-annotator/pkg/statestore"
+)
+
+// Options returns the cache options of the manager:
+//   - ConfigMaps are only cached in namespace, which holds the rules and the
+//     rollout checkpoint, and, if stateConfigMaps, under the name of the
+//     state ConfigMaps in the namespaces watched;
+//   - Ingresses are only cached in watchNamespaces, if any, and the
+//     AnnotatorStatus in namespace;
+//   - Namespaces are cached without their spec and status;
+//   - no object is cached with its managed fields.
+//
+// ConfigMaps and the AnnotatorStatus are not scoped if namespace is empty.
+func Options(namespace string, stateConfigMaps bool, watchNamespaces []string) cache.Options {
+	opts := cache.Options{
+		DefaultTransform: cache.TransformStripManagedFields(),
+		ByObject: map[client.Object]cache.ByObject{
+			&corev1.Namespace{}: {Transform: StripNamespace},
+		},
+	}
+	if len(watchNamespaces) > 0 {
+		opts.DefaultNamespaces = make(map[string]cache.Config, len(watchNamespaces))
+		for _, name := range watchNamespaces {
+			opts.DefaultNamespaces[name] = cache.Config{}
+		}
+	}
+	if namespace == "" {
+		return opts
+	}
+
+	namespaces := map[string]cache.Config{}
+	if stateConfigMaps {
+		stateConfig := cache.Config{
+			FieldSelector: fields.OneTermEqualSelector("metadata.name", statestore.ConfigMapName),
+		}
+		if len(watchNamespaces) == 0 {
+			namespaces[cache.AllNamespaces] = stateConfig
+		}
+		for _, name := range watchNamespaces {
+			namespaces[name] = stateConfig
+		}
+	}
+	namespaces[namespace] = cache.Config{}
+	opts.ByObject[&corev1.ConfigMap{}] = cache.ByObject{Namespaces: namespaces}
+	if len(watchNamespaces) > 0 {
+		opts.ByObject[&v1alpha1.AnnotatorStatus{}] = cache.ByObject{Namespaces: map[string]cache.Config{namespace: {}}}
+	}
+	return opts
+}
+
+// StripNamespace keeps the metadata of a Namespace, without its managed
+// fields; the annotator only reads its labels and annotations, and never
+// updates it.
+func StripNamespace(in any) (any, error) {
+	if namespace, ok := in.(*corev1.Namespace); ok {
+		namespace.Spec = corev1.NamespaceSpec{}
+		namespace.Status = corev1.NamespaceStatus{}
+	}
+	return cache.TransformStripManagedFields()(in)
+}
@@ -0,0 +1,208 @@
+package cachescope
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jmnote/tester/testcase"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kuoss/ingress-annotator/api/v1alpha1"
+)
+
+func TestOptions(t *testing.T) {
+	testCases := []struct {
+		name            string
+		namespace       string
+		stateConfigMaps bool
+		watchNamespaces []string
+		wantSelectors   map[string]string
+		wantDefaults    []string
+		wantStatus      bool
+	}{
+		{
+			name: "ConfigMaps not scoped without a namespace",
+		},
+		{
+			name:          "ConfigMaps of the namespace",
+			namespace:     "ingress-annotator-system",
+			wantSelectors: map[string]string{"ingress-annotator-system": ""},
+		},
+		{
+			name:            "State ConfigMaps of all namespaces",
+			namespace:       "ingress-annotator-system",
+			stateConfigMaps: true,
+			wantSelectors: map[string]string{
+				"ingress-annotator-system": "",
+				cache.AllNamespaces:        "metadata.name=ingress-annotator-state",
+			},
+		},
+		{
+			name:            "State ConfigMaps of the namespaces watched",
+			namespace:       "ingress-annotator-system",
+			stateConfigMaps: true,
+			watchNamespaces: []string{"team-a", "team-b"},
+			wantSelectors: map[string]string{
+				"ingress-annotator-system": "",
+				"team-a":                   "metadata.name=ingress-annotator-state",
+				"team-b":                   "metadata.name=ingress-annotator-state",
+			},
+			wantDefaults: []string{"team-a", "team-b"},
+			wantStatus:   true,
+		},
+		{
+			name:            "Namespaces watched without a namespace",
+			watchNamespaces: []string{"team-a"},
+			wantDefaults:    []string{"team-a"},
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			opts := Options(tc.namespace, tc.stateConfigMaps, tc.watchNamespaces)
+			assert.NotNil(t, opts.DefaultTransform)
+			var defaults []string
+			for name := range opts.DefaultNamespaces {
+				defaults = append(defaults, name)
+			}
+			sort.Strings(defaults)
+			assert.Equal(t, tc.wantDefaults, defaults)
+
+			var configMaps *cache.ByObject
+			status := false
+			for obj, byObject := range opts.ByObject {
+				switch obj.(type) {
+				case *corev1.Namespace:
+					assert.NotNil(t, byObject.Transform)
+				case *v1alpha1.AnnotatorStatus:
+					assert.Len(t, byObject.Namespaces, 1)
+					assert.Contains(t, byObject.Namespaces, tc.namespace)
+					status = true
+				case *corev1.ConfigMap:
+					configMaps = &byObject
+				default:
+					t.Errorf("unexpected object %T", obj)
+				}
+			}
+			assert.Equal(t, tc.wantStatus, status)
+			if tc.wantSelectors == nil {
+				assert.Nil(t, configMaps)
+				return
+			}
+			selectors := map[string]string{}
+			for namespace, config := range configMaps.Namespaces {
+				selectors[namespace] = ""
+				if config.FieldSelector != nil {
+					selectors[namespace] = config.FieldSelector.String()
+				}
+			}
+			assert.Equal(t, tc.wantSelectors, selectors)
+		})
+	}
+}
+
+func TestStripNamespace(t *testing.T) {
+	namespace := newNamespace()
+	got, err := StripNamespace(namespace)
+	assert.NoError(t, err)
+	assert.Equal(t, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "team-a",
+		Labels:      map[string]string{"canary": "true"},
+		Annotations: map[string]string{"annotator.ingress.kubernetes.io/rules": "rule1"},
+	}}, got)
+
+	// Other objects only lose their managed fields.
+	ing := newIngress()
+	got, err = StripNamespace(ing)
+	assert.NoError(t, err)
+	assert.Nil(t, got.(*networkingv1.Ingress).ManagedFields)
+	assert.NotEmpty(t, got.(*networkingv1.Ingress).Spec.Rules)
+}
+
+func newManagedFields() []metav1.ManagedFieldsEntry {
+	var entries []metav1.ManagedFieldsEntry
+	for _, manager := range []string{"kubectl-client-side-apply", "helm", "ingress-annotator", "nginx-ingress-controller"} {
+		fields := `{"f:metadata":{"f:annotations":{` + strings.Repeat(`"f:example.com/key":{},`, 20) + `".":{}}}}`
+		entries = append(entries, metav1.ManagedFieldsEntry{
+			Manager:    manager,
+			Operation:  metav1.ManagedFieldsOperationUpdate,
+			APIVersion: "networking.k8s.io/v1",
+			FieldsType: "FieldsV1",
+			FieldsV1:   &metav1.FieldsV1{Raw: []byte(fields)},
+		})
+	}
+	return entries
+}
+
+func newNamespace() *corev1.Namespace {
+	return &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:          "team-a",
+			Labels:        map[string]string{"canary": "true"},
+			Annotations:   map[string]string{"annotator.ingress.kubernetes.io/rules": "rule1"},
+			ManagedFields: newManagedFields(),
+		},
+		Spec:   corev1.NamespaceSpec{Finalizers: []corev1.FinalizerName{corev1.FinalizerKubernetes}},
+		Status: corev1.NamespaceStatus{Phase: corev1.NamespaceActive},
+	}
+}
+
+func newIngress() *networkingv1.Ingress {
+	annotations := map[string]string{"annotator.ingress.kubernetes.io/rules": "rule1"}
+	for i := 0; i < 10; i++ {
+		annotations[fmt.Sprintf("nginx.ingress.kubernetes.io/key%d", i)] = "value"
+	}
+	return &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:     "team-a",
+			Name:          "my-ingress",
+			Annotations:   annotations,
+			ManagedFields: newManagedFields(),
+		},
+		Spec: networkingv1.IngressSpec{
+			Rules: []networkingv1.IngressRule{{Host: "my-ingress.example.com"}},
+		},
+	}
+}
+
+// BenchmarkTransform reports the heap retained by cached objects, as
+// retained-B/op, with and without the transforms of Options.
+func BenchmarkTransform(b *testing.B) {
+	benchmarks := []struct {
+		name      string
+		newObject func() client.Object
+		transform toolscache.TransformFunc
+	}{
+		{name: "Ingress/full", newObject: func() client.Object { return newIngress() }},
+		{name: "Ingress/stripped", newObject: func() client.Object { return newIngress() }, transform: cache.TransformStripManagedFields()},
+		{name: "Namespace/full", newObject: func() client.Object { return newNamespace() }},
+		{name: "Namespace/stripped", newObject: func() client.Object { return newNamespace() }, transform: StripNamespace},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			objects := make([]any, b.N)
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			for i := range objects {
+				var obj any = bm.newObject()
+				if bm.transform != nil {
+					obj, _ = bm.transform(obj)
+				}
+				objects[i] = obj
+			}
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(b.N), "retained-B/op")
+			runtime.KeepAlive(objects)
+		})
+	}
+}
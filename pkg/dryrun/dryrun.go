@@ -0,0 +1,105 @@
+package dryrun
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// Path is where the Report is served on the metrics server.
+	Path = "/debug/dry-run"
+	// StagedPath is where the preview of the staged rules is served.
+	StagedPath = "/debug/staged"
+)
+
+// Change is an update of an Ingress that was held back by a dry run or a pause.
+type Change struct {
+	Namespace  string   `json:"namespace"`
+	Name       string   `json:"name"`
+	Generation string   `json:"generation"`
+	Rules      []string `json:"rules,omitempty"`
+	// Added and Changed map the annotation keys to the values that would be written.
+	Added   map[string]string `json:"added,omitempty"`
+	Changed map[string]string `json:"changed,omitempty"`
+	Removed []string          `json:"removed,omitempty"`
+	// Reason is why the change was held back: a dry run or a pause.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Report keeps the pending Change of every Ingress the annotator would
+// update, were it not for a dry run or a pause. A nil Report records nothing.
+type Report struct {
+	mutex   sync.Mutex
+	changes map[types.NamespacedName]Change
+}
+
+func NewReport() *Report {
+	return &Report{changes: make(map[types.NamespacedName]Change)}
+}
+
+// Record stores the pending Change of an Ingress.
+func (r *Report) Record(change Change) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.changes[types.NamespacedName{Namespace: change.Namespace, Name: change.Name}] = change
+}
+
+// Replace drops all pending changes and records changes instead.
+func (r *Report) Replace(changes []Change) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.changes = make(map[types.NamespacedName]Change, len(changes))
+	for _, change := range changes {
+		r.changes[types.NamespacedName{Namespace: change.Namespace, Name: change.Name}] = change
+	}
+}
+
+// Forget drops an Ingress that no longer has pending changes.
+func (r *Report) Forget(nn types.NamespacedName) {
+	if r == nil {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.changes, nn)
+}
+
+// Changes returns the pending changes, ordered by namespace and name.
+func (r *Report) Changes() []Change {
+	changes := []Change{}
+	if r == nil {
+		return changes
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, change := range r.changes {
+		changes = append(changes, change)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		a, b := changes[i], changes[j]
+		return a.Namespace < b.Namespace || (a.Namespace == b.Namespace && a.Name < b.Name)
+	})
+	return changes
+}
+
+// ServeHTTP writes the pending changes as JSON.
+func (r *Report) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(r.Changes()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
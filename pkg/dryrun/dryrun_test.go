@@ -0,0 +1,54 @@
+package dryrun
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestReport(t *testing.T) {
+	report := NewReport()
+	assert.Empty(t, report.Changes())
+
+	report.Record(Change{Namespace: "ns2", Name: "ing1", Generation: "gen1", Removed: []string{"key1"}})
+	report.Record(Change{Namespace: "ns1", Name: "ing2", Generation: "gen1", Added: map[string]string{"key1": "value1"}})
+	report.Record(Change{Namespace: "ns1", Name: "ing1", Generation: "gen0"})
+	report.Record(Change{Namespace: "ns1", Name: "ing1", Generation: "gen1", Changed: map[string]string{"key1": "value1"}})
+	assert.Equal(t, []Change{
+		{Namespace: "ns1", Name: "ing1", Generation: "gen1", Changed: map[string]string{"key1": "value1"}},
+		{Namespace: "ns1", Name: "ing2", Generation: "gen1", Added: map[string]string{"key1": "value1"}},
+		{Namespace: "ns2", Name: "ing1", Generation: "gen1", Removed: []string{"key1"}},
+	}, report.Changes())
+
+	report.Forget(types.NamespacedName{Namespace: "ns1", Name: "ing2"})
+	assert.Len(t, report.Changes(), 2)
+
+	report.Replace([]Change{{Namespace: "ns3", Name: "ing1", Generation: "gen2"}})
+	assert.Equal(t, []Change{{Namespace: "ns3", Name: "ing1", Generation: "gen2"}}, report.Changes())
+	report.Replace(nil)
+	assert.Empty(t, report.Changes())
+}
+
+func TestReport_Nil(t *testing.T) {
+	var report *Report
+	report.Record(Change{Namespace: "ns1", Name: "ing1"})
+	report.Forget(types.NamespacedName{Namespace: "ns1", Name: "ing1"})
+	report.Replace([]Change{{Namespace: "ns1", Name: "ing1"}})
+	assert.Empty(t, report.Changes())
+}
+
+func TestReport_ServeHTTP(t *testing.T) {
+	report := NewReport()
+	report.Record(Change{Namespace: "ns1", Name: "ing1", Generation: "gen1", Rules: []string{"rule1"},
+		Added: map[string]string{"key1": "value1"}})
+
+	recorder := httptest.NewRecorder()
+	report.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, Path, nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	assert.JSONEq(t, `[{"namespace":"ns1","name":"ing1","generation":"gen1","rules":["rule1"],"added":{"key1":"value1"}}]`,
+		recorder.Body.String())
+}
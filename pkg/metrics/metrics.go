@@ -0,0 +1,206 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/kuoss/ingress-annotator/pkg/model"
+)
+
+const namespace = "ingress_annotator"
+
+var (
+	// RulesLoaded is the number of rules currently held by the RulesStore.
+	RulesLoaded = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rules_loaded",
+		Help:      "Number of rules currently loaded from the rules ConfigMap.",
+	})
+
+	// RulesLastLoadTimestamp is the time the rules were last loaded successfully.
+	RulesLastLoadTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "rules_last_load_timestamp_seconds",
+		Help:      "Unix time of the last successful load of the rules ConfigMap.",
+	})
+
+	// RuleParseFailures counts rules ConfigMaps that could not be parsed.
+	RuleParseFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rule_parse_failures_total",
+		Help:      "Number of times the rules ConfigMap could not be parsed.",
+	})
+
+	// ManagedIngresses is the number of Ingresses each rule is applied to.
+	ManagedIngresses = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "managed_ingresses",
+		Help:      "Number of Ingresses each rule is applied to.",
+	}, []string{"rule"})
+
+	// IngressRulesInfo reports each rule applied to an Ingress and whether it is
+	// referenced by the Ingress itself or by its Namespace.
+	IngressRulesInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ingress_rules_info",
+		Help:      "Rules applied to an Ingress, by the source of the rule reference (namespace or ingress).",
+	}, []string{"namespace", "ingress", "rule", "source"})
+
+	// UnknownRuleReferences counts references to rules that are not defined.
+	// The rule names come from user annotations, so they are logged instead
+	// of being used as a label.
+	UnknownRuleReferences = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unknown_rule_references_total",
+		Help:      "Number of references to rules that are not defined in the rules ConfigMap.",
+	})
+
+	// AnnotationWrites counts annotations written to Ingresses by operation.
+	AnnotationWrites = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "annotation_writes_total",
+		Help:      "Number of annotations written to Ingresses, by operation (added, changed, removed).",
+	}, []string{"operation"})
+
+	// AnnotationConflicts counts rule annotations that collided with a value already set on an Ingress.
+	AnnotationConflicts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "annotation_conflicts_total",
+		Help:      "Number of rule annotations that collided with a value already set on an Ingress, by conflict policy.",
+	}, []string{"policy"})
+
+	// DriftDetections counts managed annotations found modified or removed outside the annotator.
+	DriftDetections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "drift_detections_total",
+		Help:      "Number of managed annotations found modified or removed outside the annotator.",
+	})
+
+	// DryRunChanges counts annotation changes held back by a dry run.
+	DryRunChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dry_run_changes_total",
+		Help:      "Number of annotation changes a dry run held back, by operation (added, changed, removed).",
+	}, []string{"operation"})
+
+	// RulesRollbacks counts rollouts aborted and rolled back to the previous rules.
+	RulesRollbacks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rules_rollbacks_total",
+		Help:      "Number of rollouts rolled back to the previous rules, by reason (unhealthy, failure_rate).",
+	}, []string{"reason"})
+
+	// FailedIngresses is the number of Ingresses given up on after too many
+	// failed reconciles.
+	FailedIngresses = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "failed_ingresses",
+		Help:      "Number of Ingresses no longer retried after reaching the maximum number of retries.",
+	})
+
+	// ShardMembers is the number of replicas sharing the Namespaces.
+	ShardMembers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "shard_members",
+		Help:      "Number of replicas sharing the Namespaces when sharding is enabled.",
+	})
+
+	// ShardRebalances counts the changes of the replicas sharing the Namespaces.
+	ShardRebalances = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "shard_rebalances_total",
+		Help:      "Number of times the Namespaces were rebalanced because replicas joined or left.",
+	})
+
+	// ReconcileDuration is the reconcile latency per controller.
+	ReconcileDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "reconcile_duration_seconds",
+		Help:      "Time spent reconciling an object, by controller.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"controller"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(
+		RulesLoaded,
+		RulesLastLoadTimestamp,
+		RuleParseFailures,
+		ManagedIngresses,
+		IngressRulesInfo,
+		UnknownRuleReferences,
+		AnnotationWrites,
+		AnnotationConflicts,
+		DriftDetections,
+		DryRunChanges,
+		RulesRollbacks,
+		FailedIngresses,
+		ShardMembers,
+		ShardRebalances,
+		ReconcileDuration,
+	)
+}
+
+// ObserveReconcile records the time elapsed since start for the given controller.
+// It is meant to be deferred at the top of Reconcile.
+func ObserveReconcile(controller string, start time.Time) {
+	ReconcileDuration.WithLabelValues(controller).Observe(time.Since(start).Seconds())
+}
+
+// IngressRules tracks which rules are applied to which Ingress, so that the
+// per-rule gauges can be kept up to date from individual reconciles.
+type IngressRules struct {
+	mutex   sync.Mutex
+	ingress map[types.NamespacedName]map[string]model.Source
+	counts  map[string]int
+}
+
+// Tracker is the IngressRules instance backing ManagedIngresses and IngressRulesInfo.
+var Tracker = NewIngressRules()
+
+func NewIngressRules() *IngressRules {
+	return &IngressRules{
+		ingress: make(map[types.NamespacedName]map[string]model.Source),
+		counts:  make(map[string]int),
+	}
+}
+
+// Set records the rules applied to an Ingress, keyed by rule name with the
+// source of the reference, and updates ManagedIngresses and IngressRulesInfo.
+func (t *IngressRules) Set(nn types.NamespacedName, rules map[string]model.Source) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for rule, source := range t.ingress[nn] {
+		t.add(rule, -1)
+		IngressRulesInfo.DeleteLabelValues(nn.Namespace, nn.Name, rule, string(source))
+	}
+	if len(rules) == 0 {
+		delete(t.ingress, nn)
+		return
+	}
+	t.ingress[nn] = rules
+	for rule, source := range rules {
+		t.add(rule, 1)
+		IngressRulesInfo.WithLabelValues(nn.Namespace, nn.Name, rule, string(source)).Set(1)
+	}
+}
+
+// Delete forgets an Ingress, e.g. after it has been deleted.
+func (t *IngressRules) Delete(nn types.NamespacedName) {
+	t.Set(nn, nil)
+}
+
+func (t *IngressRules) add(rule string, delta int) {
+	t.counts[rule] += delta
+	if t.counts[rule] <= 0 {
+		delete(t.counts, rule)
+		ManagedIngresses.DeleteLabelValues(rule)
+		return
+	}
+	ManagedIngresses.WithLabelValues(rule).Set(float64(t.counts[rule]))
+}
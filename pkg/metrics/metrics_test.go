@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jmnote/tester/testcase"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	"github.com/kuoss/ingress-annotator/pkg/model"
+)
+
+func TestRegistered(t *testing.T) {
+	RulesLoaded.Set(1)
+	ManagedIngresses.WithLabelValues("registered").Set(1)
+	defer ManagedIngresses.DeleteLabelValues("registered")
+
+	families, err := metrics.Registry.Gather()
+	assert.NoError(t, err)
+	var names []string
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	assert.Contains(t, names, "ingress_annotator_rules_loaded")
+	assert.Contains(t, names, "ingress_annotator_managed_ingresses")
+}
+
+func TestObserveReconcile(t *testing.T) {
+	before := testutil.CollectAndCount(ReconcileDuration)
+	ObserveReconcile("test", time.Now())
+	assert.Equal(t, before+1, testutil.CollectAndCount(ReconcileDuration))
+}
+
+func TestIngressRules(t *testing.T) {
+	ing1 := types.NamespacedName{Namespace: "default", Name: "ing1"}
+	ing2 := types.NamespacedName{Namespace: "default", Name: "ing2"}
+
+	tests := []struct {
+		name     string
+		apply    func(tracker *IngressRules)
+		want     map[string]float64
+		wantInfo []string
+	}{
+		{
+			name: "Single Ingress",
+			apply: func(tracker *IngressRules) {
+				tracker.Set(ing1, map[string]model.Source{"rule1": model.SourceIngress, "rule2": model.SourceNamespace})
+			},
+			want:     map[string]float64{"rule1": 1, "rule2": 1},
+			wantInfo: []string{"default/ing1 rule1 ingress", "default/ing1 rule2 namespace"},
+		},
+		{
+			name: "Two Ingresses share a rule",
+			apply: func(tracker *IngressRules) {
+				tracker.Set(ing1, map[string]model.Source{"rule1": model.SourceIngress})
+				tracker.Set(ing2, map[string]model.Source{"rule1": model.SourceIngress, "rule2": model.SourceNamespace})
+			},
+			want:     map[string]float64{"rule1": 2, "rule2": 1},
+			wantInfo: []string{"default/ing1 rule1 ingress", "default/ing2 rule1 ingress", "default/ing2 rule2 namespace"},
+		},
+		{
+			name: "Rules of an Ingress are replaced",
+			apply: func(tracker *IngressRules) {
+				tracker.Set(ing1, map[string]model.Source{"rule1": model.SourceIngress})
+				tracker.Set(ing1, map[string]model.Source{"rule2": model.SourceIngress})
+			},
+			want:     map[string]float64{"rule2": 1},
+			wantInfo: []string{"default/ing1 rule2 ingress"},
+		},
+		{
+			name: "Deleted Ingress is forgotten",
+			apply: func(tracker *IngressRules) {
+				tracker.Set(ing1, map[string]model.Source{"rule1": model.SourceIngress})
+				tracker.Set(ing2, map[string]model.Source{"rule2": model.SourceIngress})
+				tracker.Delete(ing1)
+			},
+			want:     map[string]float64{"rule2": 1},
+			wantInfo: []string{"default/ing2 rule2 ingress"},
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(testcase.Name(i, tt.name), func(t *testing.T) {
+			ManagedIngresses.Reset()
+			IngressRulesInfo.Reset()
+			tracker := NewIngressRules()
+			tt.apply(tracker)
+
+			assert.Equal(t, len(tt.want), testutil.CollectAndCount(ManagedIngresses))
+			for rule, want := range tt.want {
+				assert.Equal(t, want, testutil.ToFloat64(ManagedIngresses.WithLabelValues(rule)), rule)
+			}
+			assert.Equal(t, tt.wantInfo, infoSeries(t))
+		})
+	}
+}
+
+// infoSeries returns the IngressRulesInfo series as sorted "namespace/ingress rule source" strings.
+func infoSeries(t *testing.T) []string {
+	families, err := metrics.Registry.Gather()
+	assert.NoError(t, err)
+	var series []string
+	for _, family := range families {
+		if family.GetName() != "ingress_annotator_ingress_rules_info" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			assert.Equal(t, float64(1), metric.GetGauge().GetValue())
+			series = append(series, fmt.Sprintf("%s/%s %s %s", labels["namespace"], labels["ingress"], labels["rule"], labels["source"]))
+		}
+	}
+	sort.Strings(series)
+	return series
+}
@@ -2,6 +2,9 @@ package model
 
 const (
 	ManagedAnnotationsKey = "annotator.ingress.kubernetes.io/managed-annotations"
+	PausedKey             = "annotator.ingress.kubernetes.io/paused"
+	PromoteKey            = "annotator.ingress.kubernetes.io/promote"
 	ReconcileKey          = "annotator.ingress.kubernetes.io/reconcile"
 	RulesKey              = "annotator.ingress.kubernetes.io/rules"
+	StatusKey             = "annotator.ingress.kubernetes.io/status"
 )
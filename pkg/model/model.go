@@ -1,5 +1,72 @@
 package model
 
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
 type Rules map[string]Annotations
 
+// Names returns the rule names in sorted order.
+func (r Rules) Names() []string {
+	names := make([]string, 0, len(r))
+	for name := range r {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type Annotations map[string]string
+
+// IsPaused reports whether the annotations of a Namespace or Ingress ask the
+// annotator to stop writing to it.
+func IsPaused(annotations map[string]string) bool {
+	paused, _ := strconv.ParseBool(annotations[PausedKey])
+	return paused
+}
+
+// ConflictPolicy decides what happens when a rule sets an annotation that is
+// already present on the Ingress and not managed by the annotator.
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyOverwrite replaces the existing value and keeps the original
+	// so it can be restored once the rule no longer applies.
+	ConflictPolicyOverwrite ConflictPolicy = "overwrite"
+	// ConflictPolicySkipIfPresent leaves the existing value untouched.
+	ConflictPolicySkipIfPresent ConflictPolicy = "skip-if-present"
+	// ConflictPolicyFail refuses to update the Ingress while the conflict lasts.
+	ConflictPolicyFail ConflictPolicy = "fail"
+)
+
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch p := ConflictPolicy(s); p {
+	case ConflictPolicyOverwrite, ConflictPolicySkipIfPresent, ConflictPolicyFail:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid conflict policy %q: must be one of %s, %s, %s",
+		s, ConflictPolicyOverwrite, ConflictPolicySkipIfPresent, ConflictPolicyFail)
+}
+
+// MissingPolicy decides what the annotator does while the rules ConfigMap does not exist.
+type MissingPolicy string
+
+const (
+	// MissingPolicyKeep keeps applying the last rules that were loaded.
+	MissingPolicyKeep MissingPolicy = "keep"
+	// MissingPolicyEmpty treats the rules as empty and removes all managed annotations.
+	MissingPolicyEmpty MissingPolicy = "empty"
+	// MissingPolicyPause stops all writes to Ingresses until the ConfigMap is back.
+	MissingPolicyPause MissingPolicy = "pause"
+)
+
+func ParseMissingPolicy(s string) (MissingPolicy, error) {
+	switch p := MissingPolicy(s); p {
+	case MissingPolicyKeep, MissingPolicyEmpty, MissingPolicyPause:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid rules missing policy %q: must be one of %s, %s, %s",
+		s, MissingPolicyKeep, MissingPolicyEmpty, MissingPolicyPause)
+}
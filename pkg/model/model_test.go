@@ -3,6 +3,7 @@ package model
 import (
 	"testing"
 
+	"github.com/jmnote/tester/testcase"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/yaml.v3"
 )
@@ -30,3 +31,76 @@ private:
 	assert.NoError(t, err)
 	assert.Equal(t, wantRules, rules)
 }
+
+func TestRulesNames(t *testing.T) {
+	assert.Equal(t, []string{}, Rules{}.Names())
+	assert.Equal(t, []string{"a", "b", "c"}, Rules{"c": {}, "a": {}, "b": {}}.Names())
+}
+
+func TestIsPaused(t *testing.T) {
+	testCases := []struct {
+		annotations map[string]string
+		want        bool
+	}{
+		{annotations: nil, want: false},
+		{annotations: map[string]string{}, want: false},
+		{annotations: map[string]string{PausedKey: "true"}, want: true},
+		{annotations: map[string]string{PausedKey: "1"}, want: true},
+		{annotations: map[string]string{PausedKey: "false"}, want: false},
+		{annotations: map[string]string{PausedKey: "yes"}, want: false},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.annotations), func(t *testing.T) {
+			assert.Equal(t, tc.want, IsPaused(tc.annotations))
+		})
+	}
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	testCases := []struct {
+		input     string
+		want      ConflictPolicy
+		wantError string
+	}{
+		{"overwrite", ConflictPolicyOverwrite, ""},
+		{"skip-if-present", ConflictPolicySkipIfPresent, ""},
+		{"fail", ConflictPolicyFail, ""},
+		{"", "", `invalid conflict policy "": must be one of overwrite, skip-if-present, fail`},
+		{"replace", "", `invalid conflict policy "replace": must be one of overwrite, skip-if-present, fail`},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.input), func(t *testing.T) {
+			got, err := ParseConflictPolicy(tc.input)
+			if tc.wantError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.wantError)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestParseMissingPolicy(t *testing.T) {
+	testCases := []struct {
+		input     string
+		want      MissingPolicy
+		wantError string
+	}{
+		{"keep", MissingPolicyKeep, ""},
+		{"empty", MissingPolicyEmpty, ""},
+		{"pause", MissingPolicyPause, ""},
+		{"xxx", "", `invalid rules missing policy "xxx": must be one of keep, empty, pause`},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.input), func(t *testing.T) {
+			got, err := ParseMissingPolicy(tc.input)
+			if tc.wantError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.wantError)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ManagedStateVersion is the version of the ManagedState format written by the annotator.
+const ManagedStateVersion = 2
+
+// Source tells where the reference to a rule was found.
+type Source string
+
+const (
+	SourceNamespace Source = "namespace"
+	SourceIngress   Source = "ingress"
+)
+
+// ManagedAnnotation records an annotation applied by the annotator and where it came from.
+type ManagedAnnotation struct {
+	Value      string `json:"value"`
+	Rule       string `json:"rule,omitempty"`
+	Source     Source `json:"source,omitempty"`
+	Generation string `json:"generation,omitempty"`
+}
+
+// ManagedState is the annotator's record of what it owns on an Ingress.
+// Originals holds the values that were present before the annotator took over
+// a key, so they can be restored when the key is released.
+type ManagedState struct {
+	Version     int                          `json:"version"`
+	Annotations map[string]ManagedAnnotation `json:"annotations"`
+	Originals   Annotations                  `json:"originals,omitempty"`
+}
+
+func NewManagedState() *ManagedState {
+	return &ManagedState{
+		Version:     ManagedStateVersion,
+		Annotations: map[string]ManagedAnnotation{},
+		Originals:   Annotations{},
+	}
+}
+
+// UnmarshalManagedState parses a ManagedState. Version 1, a plain JSON map of
+// key to value, is migrated to the current version without provenance.
+func UnmarshalManagedState(data string) (*ManagedState, error) {
+	var header struct {
+		Version *int `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(data), &header); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal managed state: %w", err)
+	}
+	if header.Version == nil {
+		return unmarshalManagedStateV1(data)
+	}
+	if *header.Version != ManagedStateVersion {
+		return nil, fmt.Errorf("unsupported managed state version %d", *header.Version)
+	}
+
+	state := NewManagedState()
+	if err := json.Unmarshal([]byte(data), state); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal managed state: %w", err)
+	}
+	if state.Annotations == nil {
+		state.Annotations = map[string]ManagedAnnotation{}
+	}
+	if state.Originals == nil {
+		state.Originals = Annotations{}
+	}
+	return state, nil
+}
+
+func unmarshalManagedStateV1(data string) (*ManagedState, error) {
+	var annotations Annotations
+	if err := json.Unmarshal([]byte(data), &annotations); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal managed state v1: %w", err)
+	}
+	state := NewManagedState()
+	for key, value := range annotations {
+		state.Annotations[key] = ManagedAnnotation{Value: value}
+	}
+	return state, nil
+}
+
+// IsEmpty reports whether the state owns nothing.
+func (s *ManagedState) IsEmpty() bool {
+	return s == nil || len(s.Annotations) == 0
+}
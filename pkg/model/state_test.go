@@ -0,0 +1,64 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/jmnote/tester/testcase"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnmarshalManagedState(t *testing.T) {
+	testCases := []struct {
+		name      string
+		data      string
+		want      *ManagedState
+		wantError string
+	}{
+		{
+			name: "version 1 map is migrated",
+			data: `{"key1":"value1"}`,
+			want: &ManagedState{
+				Version:     ManagedStateVersion,
+				Annotations: map[string]ManagedAnnotation{"key1": {Value: "value1"}},
+				Originals:   Annotations{},
+			},
+		},
+		{
+			name: "version 2",
+			data: `{"version":2,"annotations":{"key1":{"value":"value1","rule":"rule1","source":"namespace","generation":"abc"}},"originals":{"key1":"old"}}`,
+			want: &ManagedState{
+				Version: ManagedStateVersion,
+				Annotations: map[string]ManagedAnnotation{
+					"key1": {Value: "value1", Rule: "rule1", Source: SourceNamespace, Generation: "abc"},
+				},
+				Originals: Annotations{"key1": "old"},
+			},
+		},
+		{
+			name: "version 2 without annotations",
+			data: `{"version":2}`,
+			want: NewManagedState(),
+		},
+		{
+			name:      "unsupported version",
+			data:      `{"version":3}`,
+			wantError: "unsupported managed state version 3",
+		},
+		{
+			name:      "invalid json",
+			data:      `invalid-json`,
+			wantError: "failed to unmarshal managed state: invalid character 'i' looking for beginning of value",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			got, err := UnmarshalManagedState(tc.data)
+			if tc.wantError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.wantError)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
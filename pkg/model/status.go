@@ -0,0 +1,17 @@
+package model
+
+// IngressStatus is the compact summary the annotator writes to StatusKey so
+// that the owners of an Ingress can see why a rule did or did not take effect.
+type IngressStatus struct {
+	// Generation is the rules generation the Ingress was reconciled with.
+	Generation string `json:"generation"`
+	// Rules are the referenced rules that were found.
+	Rules []string `json:"rules,omitempty"`
+	// Unresolved are the referenced rules that are not defined.
+	Unresolved []string `json:"unresolved,omitempty"`
+	// Conflicts are the rule annotations that were not applied because the
+	// Ingress already sets them.
+	Conflicts []string `json:"conflicts,omitempty"`
+	// Error is the reason the rules could not be applied, if any.
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,101 @@
+package progress
+
+import (
+	"errors"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Result is the outcome of the last reconcile of an Ingress.
+type Result struct {
+	// Generation is the rules generation the Ingress was reconciled with.
+	Generation string
+	// Rules are the rule names referenced by the Ingress and its Namespace.
+	Rules []string
+	// UnknownRules are the referenced rule names that are not defined.
+	UnknownRules []string
+	// Error is set when the reconcile failed.
+	Error string
+}
+
+// Tracker keeps the last reconcile Result of every Ingress, for summarizing
+// the rollout of the rules. A nil Tracker records nothing.
+type Tracker struct {
+	mutex   sync.Mutex
+	results map[types.NamespacedName]Result
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{results: make(map[types.NamespacedName]Result)}
+}
+
+// Record stores the Result of reconciling an Ingress.
+func (t *Tracker) Record(nn types.NamespacedName, result Result) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.results[nn] = result
+}
+
+// Fail marks an Ingress as failed with message at generation, keeping the
+// rules of its last Result.
+func (t *Tracker) Fail(nn types.NamespacedName, generation, message string) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	result := t.results[nn]
+	result.Generation = generation
+	result.Error = message
+	t.results[nn] = result
+}
+
+// Failures returns the errors of the Ingresses among keys whose last
+// reconcile at generation failed, by namespace/name.
+func (t *Tracker) Failures(generation string, keys []types.NamespacedName) map[string]error {
+	failures := make(map[string]error)
+	if t == nil {
+		return failures
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, nn := range keys {
+		if result, ok := t.results[nn]; ok && result.Generation == generation && result.Error != "" {
+			failures[nn.String()] = errors.New(result.Error)
+		}
+	}
+	return failures
+}
+
+// Forget drops an Ingress, e.g. after it has been deleted.
+func (t *Tracker) Forget(nn types.NamespacedName) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.results, nn)
+}
+
+// Snapshot returns a copy of the recorded results.
+func (t *Tracker) Snapshot() map[types.NamespacedName]Result {
+	snapshot := make(map[types.NamespacedName]Result)
+	if t == nil {
+		return snapshot
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for nn, result := range t.results {
+		snapshot[nn] = result
+	}
+	return snapshot
+}
@@ -0,0 +1,63 @@
+package progress
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestTracker(t *testing.T) {
+	nn := types.NamespacedName{Namespace: "default", Name: "my-ingress"}
+	tracker := NewTracker()
+	assert.Empty(t, tracker.Snapshot())
+
+	tracker.Record(nn, Result{Generation: "gen1", Rules: []string{"rule1"}})
+	snapshot := tracker.Snapshot()
+	assert.Equal(t, map[types.NamespacedName]Result{nn: {Generation: "gen1", Rules: []string{"rule1"}}}, snapshot)
+
+	// The snapshot is a copy.
+	tracker.Record(nn, Result{Generation: "gen2"})
+	assert.Equal(t, "gen1", snapshot[nn].Generation)
+	assert.Equal(t, "gen2", tracker.Snapshot()[nn].Generation)
+
+	// Failing an Ingress keeps its rules.
+	tracker.Record(nn, Result{Generation: "gen2", Rules: []string{"rule1"}})
+	tracker.Fail(nn, "gen3", "mocked error")
+	assert.Equal(t, Result{Generation: "gen3", Rules: []string{"rule1"}, Error: "mocked error"}, tracker.Snapshot()[nn])
+
+	tracker.Forget(nn)
+	assert.Empty(t, tracker.Snapshot())
+
+	// Failing an Ingress without a Result records one.
+	tracker.Fail(nn, "gen1", "mocked error")
+	assert.Equal(t, Result{Generation: "gen1", Error: "mocked error"}, tracker.Snapshot()[nn])
+}
+
+func TestTracker_Failures(t *testing.T) {
+	failed := types.NamespacedName{Namespace: "default", Name: "failed"}
+	stale := types.NamespacedName{Namespace: "default", Name: "stale"}
+	updated := types.NamespacedName{Namespace: "default", Name: "updated"}
+	other := types.NamespacedName{Namespace: "default", Name: "other"}
+	tracker := NewTracker()
+	tracker.Record(failed, Result{Generation: "gen2", Error: "mocked error"})
+	tracker.Record(stale, Result{Generation: "gen1", Error: "mocked error"})
+	tracker.Record(updated, Result{Generation: "gen2"})
+	tracker.Record(other, Result{Generation: "gen2", Error: "mocked error"})
+
+	// Only the failures at the generation of the Ingresses asked for count.
+	failures := tracker.Failures("gen2", []types.NamespacedName{failed, stale, updated})
+	assert.Len(t, failures, 1)
+	assert.EqualError(t, failures["default/failed"], "mocked error")
+}
+
+func TestTracker_Nil(t *testing.T) {
+	var tracker *Tracker
+	nn := types.NamespacedName{Namespace: "default", Name: "my-ingress"}
+
+	tracker.Record(nn, Result{Generation: "gen1"})
+	tracker.Fail(nn, "gen1", "mocked error")
+	tracker.Forget(nn)
+	assert.Empty(t, tracker.Snapshot())
+	assert.Empty(t, tracker.Failures("gen1", []types.NamespacedName{nn}))
+}
@@ -0,0 +1,121 @@
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Checkpoint is the progress of a rollout.
+type Checkpoint struct {
+	// ID identifies the change being rolled out.
+	ID string
+	// Wave is the index of the current wave.
+	Wave int
+	// Last is the last Ingress of the wave done, as namespace/name; the
+	// Ingresses of a wave are rolled out in that order.
+	Last string
+	// Failed are the Ingresses of the wave up to Last that failed, as namespace/name.
+	Failed []string
+	// Aborted is set once the wave was found unhealthy.
+	Aborted bool
+}
+
+// pending returns the keys still to be done: the failed ones and those after Last.
+func (c Checkpoint) pending(keys []types.NamespacedName) []types.NamespacedName {
+	var pending []types.NamespacedName
+	for _, nn := range keys {
+		name := nn.String()
+		if c.Last == "" || name > c.Last || containsString(c.Failed, name) {
+			pending = append(pending, nn)
+		}
+	}
+	return pending
+}
+
+// advance records that the Ingresses up to last are done, failed being the
+// failures of the current run.
+func (c *Checkpoint) advance(last types.NamespacedName, failed map[string]error) {
+	if name := last.String(); name > c.Last {
+		c.Last = name
+	}
+	c.Failed = make([]string, 0, len(failed))
+	for name := range failed {
+		c.Failed = append(c.Failed, name)
+	}
+	sort.Strings(c.Failed)
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckpointStore persists the Checkpoint of the current rollout.
+type CheckpointStore interface {
+	Load(ctx context.Context) (Checkpoint, error)
+	Save(ctx context.Context, checkpoint Checkpoint) error
+}
+
+// ConfigMapCheckpointStore keeps the Checkpoint in the ConfigMap named NN.
+type ConfigMapCheckpointStore struct {
+	Client client.Client
+	NN     types.NamespacedName
+}
+
+func (s *ConfigMapCheckpointStore) Load(ctx context.Context) (Checkpoint, error) {
+	var cm corev1.ConfigMap
+	if err := s.Client.Get(ctx, s.NN, &cm); err != nil {
+		return Checkpoint{}, client.IgnoreNotFound(err)
+	}
+	checkpoint := Checkpoint{ID: cm.Data["id"], Last: cm.Data["last"], Aborted: cm.Data["aborted"] == "true"}
+	if wave := cm.Data["wave"]; wave != "" {
+		var err error
+		if checkpoint.Wave, err = strconv.Atoi(wave); err != nil {
+			return Checkpoint{}, fmt.Errorf("invalid rollout checkpoint wave %q: %w", wave, err)
+		}
+	}
+	if failed := cm.Data["failed"]; failed != "" {
+		checkpoint.Failed = strings.Split(failed, "\n")
+	}
+	return checkpoint, nil
+}
+
+func (s *ConfigMapCheckpointStore) Save(ctx context.Context, checkpoint Checkpoint) error {
+	data := map[string]string{
+		"id":      checkpoint.ID,
+		"wave":    strconv.Itoa(checkpoint.Wave),
+		"last":    checkpoint.Last,
+		"failed":  strings.Join(checkpoint.Failed, "\n"),
+		"aborted": strconv.FormatBool(checkpoint.Aborted),
+	}
+	var cm corev1.ConfigMap
+	err := s.Client.Get(ctx, s.NN, &cm)
+	if apierrors.IsNotFound(err) {
+		cm = corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: s.NN.Namespace, Name: s.NN.Name}, Data: data}
+		if err := s.Client.Create(ctx, &cm); err != nil {
+			return fmt.Errorf("failed to create rollout checkpoint: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get rollout checkpoint: %w", err)
+	}
+	cm.Data = data
+	if err := s.Client.Update(ctx, &cm); err != nil {
+		return fmt.Errorf("failed to update rollout checkpoint: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// HealthCheck tells whether the Ingresses updated so far by a rollout are healthy.
+type HealthCheck interface {
+	Check(ctx context.Context, done []types.NamespacedName) error
+}
+
+// HealthChecks is a HealthCheck that passes when all of its checks pass.
+type HealthChecks []HealthCheck
+
+func (c HealthChecks) Check(ctx context.Context, done []types.NamespacedName) error {
+	var errs []error
+	for _, check := range c {
+		if err := check.Check(ctx, done); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LoadBalancerCheck fails when an Ingress that had a load balancer address
+// before the rollout has lost it.
+type LoadBalancerCheck struct {
+	Client client.Reader
+	// Baseline are the Ingresses that had a load balancer address.
+	Baseline map[types.NamespacedName]bool
+}
+
+// NewLoadBalancerCheck returns a LoadBalancerCheck for the Ingresses as they
+// were before the rollout.
+func NewLoadBalancerCheck(c client.Reader, ingresses []networkingv1.Ingress) *LoadBalancerCheck {
+	check := &LoadBalancerCheck{Client: c, Baseline: make(map[types.NamespacedName]bool)}
+	for _, ing := range ingresses {
+		if len(ing.Status.LoadBalancer.Ingress) > 0 {
+			check.Baseline[client.ObjectKeyFromObject(&ing)] = true
+		}
+	}
+	return check
+}
+
+func (c *LoadBalancerCheck) Check(ctx context.Context, done []types.NamespacedName) error {
+	for _, nn := range done {
+		if !c.Baseline[nn] {
+			continue
+		}
+		var ing networkingv1.Ingress
+		if err := c.Client.Get(ctx, nn, &ing); err != nil {
+			if client.IgnoreNotFound(err) == nil {
+				continue
+			}
+			return fmt.Errorf("failed to get ingress %s: %w", nn, err)
+		}
+		if len(ing.Status.LoadBalancer.Ingress) == 0 {
+			return fmt.Errorf("ingress %s lost its load balancer address", nn)
+		}
+	}
+	return nil
+}
+
+// ProbeCheck fails unless a GET of URL succeeds.
+type ProbeCheck struct {
+	URL    string
+	Client *http.Client
+}
+
+func (c *ProbeCheck) Check(ctx context.Context, _ []types.NamespacedName) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("health probe failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("health probe returned %s", resp.Status)
+	}
+	return nil
+}
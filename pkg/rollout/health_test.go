@@ -0,0 +1,102 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jmnote/tester/testcase"
+	"github.com/stretchr/testify/assert"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/kuoss/ingress-annotator/pkg/testutil/fakeclient"
+)
+
+func newIngress(name string, addresses ...string) *networkingv1.Ingress {
+	ing := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+	for _, address := range addresses {
+		ing.Status.LoadBalancer.Ingress = append(ing.Status.LoadBalancer.Ingress,
+			networkingv1.IngressLoadBalancerIngress{IP: address})
+	}
+	return ing
+}
+
+func TestLoadBalancerCheck(t *testing.T) {
+	before := []networkingv1.Ingress{*newIngress("a", "10.0.0.1"), *newIngress("b"), *newIngress("c", "10.0.0.3")}
+
+	testCases := []struct {
+		name      string
+		after     []*networkingv1.Ingress
+		wantError string
+	}{
+		{
+			name:  "Addresses kept",
+			after: []*networkingv1.Ingress{newIngress("a", "10.0.0.9"), newIngress("b"), newIngress("c", "10.0.0.3")},
+		},
+		{
+			name:  "Deleted Ingresses are ignored",
+			after: []*networkingv1.Ingress{newIngress("a", "10.0.0.1")},
+		},
+		{
+			name:      "Address lost",
+			after:     []*networkingv1.Ingress{newIngress("a"), newIngress("b"), newIngress("c", "10.0.0.3")},
+			wantError: "ingress default/a lost its load balancer address",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			var objs []*networkingv1.Ingress
+			objs = append(objs, tc.after...)
+			c := fakeclient.NewClient(nil)
+			for _, obj := range objs {
+				assert.NoError(t, c.Create(context.Background(), obj))
+			}
+			check := NewLoadBalancerCheck(c, before)
+			err := check.Check(context.Background(), keysOf("a", "b", "c"))
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestProbeCheck(t *testing.T) {
+	testCases := []struct {
+		status    int
+		wantError string
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusBadGateway, wantError: "health probe returned 502 Bad Gateway"},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.status), func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(tc.status)
+			}))
+			defer server.Close()
+
+			check := &ProbeCheck{URL: server.URL, Client: server.Client()}
+			err := check.Check(context.Background(), nil)
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	pass := checkFunc(func(context.Context, []types.NamespacedName) error { return nil })
+	fail := checkFunc(func(context.Context, []types.NamespacedName) error { return errors.New("mocked unhealthy") })
+
+	assert.NoError(t, HealthChecks{}.Check(context.Background(), nil))
+	assert.NoError(t, HealthChecks{pass, pass}.Check(context.Background(), nil))
+	assert.EqualError(t, HealthChecks{pass, fail, fail}.Check(context.Background(), nil), "mocked unhealthy\nmocked unhealthy")
+}
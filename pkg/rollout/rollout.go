@@ -0,0 +1,262 @@
+package rollout
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// maxReportedFailures caps the Ingresses listed in an Error message.
+const maxReportedFailures = 5
+
+// Options configures the pace of a rollout.
+type Options struct {
+	// QPS is the maximum number of Ingresses updated per second; 0 is unlimited.
+	QPS float64
+	// BatchSize is the number of Ingresses updated between checkpoints.
+	BatchSize int
+	// BatchInterval is the pause between batches, giving ingress controllers
+	// time to reload.
+	BatchInterval time.Duration
+	// Waves are the cumulative percentages of Ingresses updated by each wave,
+	// e.g. 10, 50, 100; a rollout is done in a single wave if unset.
+	Waves []int
+	// WaveInterval is the pause after each wave, before its health is checked.
+	WaveInterval time.Duration
+	// MaxFailureRatio is the share of the Ingresses tried so far that may
+	// fail before the rollout is aborted; 0 never aborts.
+	MaxFailureRatio float64
+	// MinFailures is the number of failures tolerated whatever their share,
+	// so that a few failures early on do not abort the rollout.
+	MinFailures int
+	// Failures reports the Ingresses that failed to take the change after
+	// apply returned, as apply may merely trigger their update. They count
+	// towards the MaxFailureRatio once a batch or a wave is done.
+	Failures Failures
+}
+
+// Failures returns the errors of the Ingresses among keys that failed to
+// take the change being rolled out, by namespace/name.
+type Failures func(keys []types.NamespacedName) map[string]error
+
+// Engine applies a change to many Ingresses at a limited pace. Failures are
+// collected instead of stopping the rollout, and progress is checkpointed
+// after every batch so a restarted rollout resumes where it stopped. A nil
+// Engine applies the change to all Ingresses at once, without checkpoints.
+type Engine struct {
+	opts        Options
+	limiter     *rate.Limiter
+	checkpoints CheckpointStore
+	gate        *Gate
+}
+
+// New returns an Engine; checkpoints may be nil.
+func New(opts Options, checkpoints CheckpointStore) *Engine {
+	limit := rate.Inf
+	if opts.QPS > 0 {
+		limit = rate.Limit(opts.QPS)
+	}
+	engine := &Engine{
+		opts:        opts,
+		limiter:     rate.NewLimiter(limit, 1),
+		checkpoints: checkpoints,
+	}
+	if len(opts.Waves) > 0 {
+		engine.gate = NewGate()
+	}
+	return engine
+}
+
+// Gate returns the Gate holding back the Ingresses of later waves, or nil
+// if rollouts are not done in waves.
+func (e *Engine) Gate() *Gate {
+	if e == nil {
+		return nil
+	}
+	return e.gate
+}
+
+// Run calls apply for each of keys. id identifies the change being rolled
+// out: a rollout with the id of the last checkpoint only retries the
+// Ingresses that failed and continues after the last one that was done.
+func (e *Engine) Run(ctx context.Context, id string, keys []types.NamespacedName,
+	apply func(context.Context, types.NamespacedName) error) error {
+	return e.RunWaves(ctx, id, [][]types.NamespacedName{keys}, apply, nil)
+}
+
+// tally counts the Ingresses a rollout tried and those that failed.
+type tally struct {
+	tried  int
+	done   []types.NamespacedName
+	failed map[string]error
+}
+
+// runWave calls apply for the keys of a wave still pending according to
+// checkpoint, counting them in t. It aborts the wave with a FailureRateError
+// when too many of the Ingresses tried fail.
+func (e *Engine) runWave(ctx context.Context, checkpoint *Checkpoint, keys []types.NamespacedName,
+	apply func(context.Context, types.NamespacedName) error, t *tally) error {
+	logger := log.FromContext(ctx).WithValues("rollout", checkpoint.ID, "wave", checkpoint.Wave)
+
+	pending := checkpoint.pending(sortedKeys(keys))
+	total := len(pending)
+	batchSize := total
+	if e != nil && e.opts.BatchSize > 0 {
+		batchSize = e.opts.BatchSize
+	}
+	waveFailed := make(map[string]error)
+	for start := 0; start < total; start += batchSize {
+		if start > 0 && e != nil && e.opts.BatchInterval > 0 {
+			if err := sleep(ctx, e.opts.BatchInterval); err != nil {
+				return err
+			}
+		}
+		if start > 0 {
+			if err := e.collect(t); err != nil {
+				checkpoint.Aborted = true
+				e.save(ctx, *checkpoint)
+				return err
+			}
+		}
+		end := min(start+batchSize, total)
+		for _, nn := range pending[start:end] {
+			// A cancelled rollout stops before its next Ingress, paced or not.
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if e != nil {
+				if err := e.limiter.Wait(ctx); err != nil {
+					return err
+				}
+			}
+			t.tried++
+			t.done = append(t.done, nn)
+			err := apply(ctx, nn)
+			if err == nil {
+				continue
+			}
+			waveFailed[nn.String()] = err
+			t.failed[nn.String()] = err
+			if e.failing(t) {
+				checkpoint.advance(nn, waveFailed)
+				checkpoint.Aborted = true
+				e.save(ctx, *checkpoint)
+				return &FailureRateError{Failed: len(t.failed), Total: t.tried, Last: err}
+			}
+		}
+
+		checkpoint.advance(pending[end-1], waveFailed)
+		e.save(ctx, *checkpoint)
+		logger.V(1).Info("Rollout batch done", "done", end, "total", total, "failed", len(waveFailed))
+	}
+	if err := e.collect(t); err != nil {
+		checkpoint.Aborted = true
+		e.save(ctx, *checkpoint)
+		return err
+	}
+	return nil
+}
+
+// collect counts in t the Failures of the Ingresses tried so far, returning
+// a FailureRateError when the failures exceed the MaxFailureRatio.
+func (e *Engine) collect(t *tally) error {
+	if e == nil || e.opts.Failures == nil {
+		return nil
+	}
+	failures := e.opts.Failures(t.done)
+	names := make([]string, 0, len(failures))
+	for name := range failures {
+		if _, ok := t.failed[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t.failed[name] = failures[name]
+	}
+	if e.failing(t) {
+		return &FailureRateError{Failed: len(t.failed), Total: t.tried, Last: failures[names[len(names)-1]]}
+	}
+	return nil
+}
+
+// failing reports whether the failures counted in t exceed the MaxFailureRatio.
+func (e *Engine) failing(t *tally) bool {
+	if e == nil || e.opts.MaxFailureRatio <= 0 || len(t.failed) <= e.opts.MinFailures {
+		return false
+	}
+	return float64(len(t.failed)) > e.opts.MaxFailureRatio*float64(t.tried)
+}
+
+func (e *Engine) save(ctx context.Context, checkpoint Checkpoint) {
+	if e == nil || e.checkpoints == nil {
+		return
+	}
+	if err := e.checkpoints.Save(ctx, checkpoint); err != nil {
+		// The rollout goes on; a restart merely repeats more of it.
+		log.FromContext(ctx).Error(err, "Failed to save rollout checkpoint")
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func sortedKeys(keys []types.NamespacedName) []types.NamespacedName {
+	sorted := make([]types.NamespacedName, len(keys))
+	copy(sorted, keys)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].String() < sorted[j].String() })
+	return sorted
+}
+
+// FailureRateError reports a rollout aborted because too many Ingresses
+// failed to update.
+type FailureRateError struct {
+	Failed int
+	Total  int
+	// Last is the error of the Ingress that exceeded the MaxFailureRatio.
+	Last error
+}
+
+func (e *FailureRateError) Error() string {
+	return fmt.Sprintf("%d of %d Ingresses failed to update, last: %v", e.Failed, e.Total, e.Last)
+}
+
+// Error reports the Ingresses a rollout failed to update.
+type Error struct {
+	Total  int
+	Failed map[string]error
+}
+
+func (e *Error) Error() string {
+	names := make([]string, 0, len(e.Failed))
+	for name := range e.Failed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var details []string
+	for _, name := range names[:min(len(names), maxReportedFailures)] {
+		details = append(details, fmt.Sprintf("%s: %v", name, e.Failed[name]))
+	}
+	if len(names) > maxReportedFailures {
+		details = append(details, fmt.Sprintf("and %d more", len(names)-maxReportedFailures))
+	}
+	return fmt.Sprintf("failed to update %d of %d Ingresses: %s", len(e.Failed), e.Total, strings.Join(details, "; "))
+}
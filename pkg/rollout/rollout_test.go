@@ -0,0 +1,289 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jmnote/tester/testcase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/kuoss/ingress-annotator/pkg/testutil/fakeclient"
+)
+
+type memoryStore struct {
+	checkpoint Checkpoint
+	saves      []Checkpoint
+}
+
+func (s *memoryStore) Load(_ context.Context) (Checkpoint, error) {
+	return s.checkpoint, nil
+}
+
+func (s *memoryStore) Save(_ context.Context, checkpoint Checkpoint) error {
+	s.checkpoint = checkpoint
+	s.saves = append(s.saves, checkpoint)
+	return nil
+}
+
+func keysOf(names ...string) []types.NamespacedName {
+	var keys []types.NamespacedName
+	for _, name := range names {
+		keys = append(keys, types.NamespacedName{Namespace: "default", Name: name})
+	}
+	return keys
+}
+
+// record returns an apply func that records the Ingresses it is called for
+// and fails for those in fail.
+func record(applied *[]string, fail ...string) func(context.Context, types.NamespacedName) error {
+	return func(_ context.Context, nn types.NamespacedName) error {
+		*applied = append(*applied, nn.Name)
+		for _, name := range fail {
+			if nn.Name == name {
+				return errors.New("mocked error")
+			}
+		}
+		return nil
+	}
+}
+
+func TestRun(t *testing.T) {
+	testCases := []struct {
+		name        string
+		engine      *Engine
+		fail        []string
+		wantApplied []string
+		wantError   string
+	}{
+		{
+			name:        "Nil engine applies all",
+			wantApplied: []string{"a", "b", "c"},
+		},
+		{
+			name:        "Batches apply all in order",
+			engine:      New(Options{BatchSize: 2}, nil),
+			wantApplied: []string{"a", "b", "c"},
+		},
+		{
+			name:        "Failures do not stop the rollout",
+			engine:      New(Options{BatchSize: 1}, nil),
+			fail:        []string{"a", "c"},
+			wantApplied: []string{"a", "b", "c"},
+			wantError:   "failed to update 2 of 3 Ingresses: default/a: mocked error; default/c: mocked error",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			var applied []string
+			err := tc.engine.Run(context.Background(), "gen1", keysOf("c", "a", "b"), record(&applied, tc.fail...))
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.wantApplied, applied)
+		})
+	}
+}
+
+func TestRun_Checkpoint(t *testing.T) {
+	store := &memoryStore{}
+	engine := New(Options{BatchSize: 2}, store)
+
+	var applied []string
+	err := engine.Run(context.Background(), "gen1", keysOf("a", "b", "c"), record(&applied, "b"))
+	assert.EqualError(t, err, "failed to update 1 of 3 Ingresses: default/b: mocked error")
+	assert.Equal(t, []Checkpoint{
+		{ID: "gen1", Last: "default/b", Failed: []string{"default/b"}},
+		{ID: "gen1", Last: "default/c", Failed: []string{"default/b"}},
+	}, store.saves)
+
+	// The same rollout retries the failed Ingresses and those added after
+	// the last one done.
+	applied = nil
+	assert.NoError(t, engine.Run(context.Background(), "gen1", keysOf("a", "b", "c", "d"), record(&applied)))
+	assert.Equal(t, []string{"b", "d"}, applied)
+	assert.Equal(t, Checkpoint{ID: "gen1", Last: "default/d", Failed: []string{}}, store.checkpoint)
+
+	// Another rollout starts over.
+	applied = nil
+	assert.NoError(t, engine.Run(context.Background(), "gen2", keysOf("a", "b"), record(&applied)))
+	assert.Equal(t, []string{"a", "b"}, applied)
+}
+
+func TestRun_Pace(t *testing.T) {
+	engine := New(Options{QPS: 100, BatchSize: 1, BatchInterval: 10 * time.Millisecond}, nil)
+	var applied []string
+	start := time.Now()
+	assert.NoError(t, engine.Run(context.Background(), "gen1", keysOf("a", "b", "c"), record(&applied)))
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	applied = nil
+	assert.ErrorIs(t, engine.Run(ctx, "gen1", keysOf("a", "b"), record(&applied)), context.Canceled)
+	assert.Empty(t, applied)
+
+	// A nil engine stops as well.
+	var nilEngine *Engine
+	assert.ErrorIs(t, nilEngine.Run(ctx, "gen1", keysOf("a", "b"), record(&applied)), context.Canceled)
+	assert.Empty(t, applied)
+}
+
+func TestRun_FailureRate(t *testing.T) {
+	testCases := []struct {
+		name        string
+		opts        Options
+		fail        []string
+		wantApplied []string
+		wantError   string
+	}{
+		{
+			name:        "Disabled",
+			opts:        Options{},
+			fail:        []string{"a", "b", "c"},
+			wantApplied: []string{"a", "b", "c", "d"},
+			wantError:   "failed to update 3 of 4 Ingresses: default/a: mocked error; default/b: mocked error; default/c: mocked error",
+		},
+		{
+			name:        "Below the ratio",
+			opts:        Options{MaxFailureRatio: 0.5},
+			fail:        []string{"b", "d"},
+			wantApplied: []string{"a", "b", "c", "d"},
+			wantError:   "failed to update 2 of 4 Ingresses: default/b: mocked error; default/d: mocked error",
+		},
+		{
+			name:        "Above the ratio",
+			opts:        Options{MaxFailureRatio: 0.5},
+			fail:        []string{"a", "b", "c"},
+			wantApplied: []string{"a"},
+			wantError:   "rollout aborted after wave 1: 1 of 1 Ingresses failed to update, last: mocked error",
+		},
+		{
+			name:        "Failures tolerated",
+			opts:        Options{MaxFailureRatio: 0.5, MinFailures: 1},
+			fail:        []string{"a", "b", "c"},
+			wantApplied: []string{"a", "b"},
+			wantError:   "rollout aborted after wave 1: 2 of 2 Ingresses failed to update, last: mocked error",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			store := &memoryStore{}
+			engine := New(tc.opts, store)
+			var applied []string
+			err := engine.Run(context.Background(), "gen1", keysOf("a", "b", "c", "d"), record(&applied, tc.fail...))
+			assert.EqualError(t, err, tc.wantError)
+			assert.Equal(t, tc.wantApplied, applied)
+
+			var rateErr *FailureRateError
+			if !errors.As(err, &rateErr) {
+				assert.False(t, store.checkpoint.Aborted)
+				return
+			}
+			// The aborted rollout is not resumed.
+			assert.True(t, store.checkpoint.Aborted)
+			applied = nil
+			assert.ErrorIs(t, engine.Run(context.Background(), "gen1", keysOf("a", "b", "c", "d"), record(&applied)), ErrAborted)
+			assert.Empty(t, applied)
+		})
+	}
+}
+
+func TestRun_Failures(t *testing.T) {
+	testCases := []struct {
+		name        string
+		opts        Options
+		failures    []string
+		wantApplied []string
+		wantError   string
+	}{
+		{
+			name:        "Failures reported",
+			opts:        Options{BatchSize: 2},
+			failures:    []string{"b"},
+			wantApplied: []string{"a", "b", "c", "d"},
+			wantError:   "failed to update 1 of 4 Ingresses: default/b: mocked update rejected",
+		},
+		{
+			name:        "Above the ratio after a batch",
+			opts:        Options{BatchSize: 2, MaxFailureRatio: 0.25},
+			failures:    []string{"a", "b"},
+			wantApplied: []string{"a", "b"},
+			wantError:   "rollout aborted after wave 1: 2 of 2 Ingresses failed to update, last: mocked update rejected",
+		},
+		{
+			name:        "Below the ratio at the end of the wave",
+			opts:        Options{BatchSize: 2, MaxFailureRatio: 0.25},
+			failures:    []string{"d"},
+			wantApplied: []string{"a", "b", "c", "d"},
+			wantError:   "failed to update 1 of 4 Ingresses: default/d: mocked update rejected",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			// The updates of the Ingresses in failures are rejected after apply.
+			tc.opts.Failures = func(keys []types.NamespacedName) map[string]error {
+				failures := map[string]error{}
+				for _, nn := range keys {
+					for _, name := range tc.failures {
+						if nn.Name == name {
+							failures[nn.String()] = errors.New("mocked update rejected")
+						}
+					}
+				}
+				return failures
+			}
+			store := &memoryStore{}
+			engine := New(tc.opts, store)
+			var applied []string
+			err := engine.Run(context.Background(), "gen1", keysOf("a", "b", "c", "d"), record(&applied))
+			assert.EqualError(t, err, tc.wantError)
+			assert.Equal(t, tc.wantApplied, applied)
+
+			var rateErr *FailureRateError
+			assert.Equal(t, errors.As(err, &rateErr), store.checkpoint.Aborted)
+		})
+	}
+}
+
+func TestError(t *testing.T) {
+	failed := map[string]error{}
+	for i := 0; i < 7; i++ {
+		failed[fmt.Sprintf("default/ingress%d", i)] = errors.New("mocked error")
+	}
+	err := &Error{Total: 10, Failed: failed}
+	assert.Equal(t, "failed to update 7 of 10 Ingresses: default/ingress0: mocked error; default/ingress1: mocked error; "+
+		"default/ingress2: mocked error; default/ingress3: mocked error; default/ingress4: mocked error; and 2 more", err.Error())
+}
+
+func TestConfigMapCheckpointStore(t *testing.T) {
+	nn := types.NamespacedName{Namespace: "default", Name: "ingress-annotator-rollout"}
+	store := &ConfigMapCheckpointStore{Client: fakeclient.NewClient(nil), NN: nn}
+	ctx := context.Background()
+
+	got, err := store.Load(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, Checkpoint{}, got)
+
+	checkpoints := []Checkpoint{
+		{ID: "gen1", Last: "default/a", Failed: []string{"default/a"}},
+		{ID: "gen1", Last: "default/b"},
+	}
+	for _, checkpoint := range checkpoints {
+		require.NoError(t, store.Save(ctx, checkpoint))
+		got, err := store.Load(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, checkpoint, got)
+	}
+
+	store.Client = fakeclient.NewClient(&fakeclient.ClientOpts{GetError: "*"})
+	_, err = store.Load(ctx)
+	assert.EqualError(t, err, "mocked GetError")
+	assert.EqualError(t, store.Save(ctx, checkpoints[0]), "failed to get rollout checkpoint: mocked GetError")
+}
@@ -0,0 +1,228 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// ErrAborted reports a rollout found aborted in its checkpoint.
+var ErrAborted = errors.New("rollout was aborted earlier")
+
+// HealthError reports a rollout aborted because a wave was unhealthy or too
+// many of its Ingresses failed to update.
+type HealthError struct {
+	// Wave is the index of the unhealthy wave.
+	Wave int
+	// Done are the Ingresses released up to and including that wave.
+	Done []types.NamespacedName
+	Err  error
+}
+
+func (e *HealthError) Error() string {
+	return fmt.Sprintf("rollout aborted after wave %d: %v", e.Wave+1, e.Err)
+}
+
+func (e *HealthError) Unwrap() error {
+	return e.Err
+}
+
+// Gate holds back the Ingresses a rollout in waves has not reached yet, so
+// that reconciles triggered by anything else keep their annotations. A nil
+// Gate holds nothing.
+type Gate struct {
+	mutex    sync.Mutex
+	holding  bool
+	released map[types.NamespacedName]bool
+}
+
+// NewGate returns a Gate holding all Ingresses until the first rollout
+// releases them, so that a restart does not skip the remaining waves.
+func NewGate() *Gate {
+	return &Gate{holding: true}
+}
+
+// Holds reports whether the Ingress nn must keep its annotations.
+func (g *Gate) Holds(nn types.NamespacedName) bool {
+	if g == nil {
+		return false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.holding && !g.released[nn]
+}
+
+// Open releases all Ingresses.
+func (g *Gate) Open() {
+	if g == nil {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.holding = false
+	g.released = nil
+}
+
+// close holds all Ingresses again.
+func (g *Gate) close() {
+	if g == nil {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.holding = true
+	g.released = make(map[types.NamespacedName]bool)
+}
+
+func (g *Gate) release(keys []types.NamespacedName) {
+	if g == nil {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, nn := range keys {
+		g.released[nn] = true
+	}
+}
+
+// PlanWaves splits keys into the waves of a rollout. The canary Ingresses,
+// if any, make up the first wave; the others are spread over the cumulative
+// percentages of the Engine options, in an order that mixes namespaces and
+// stays the same across restarts. Without percentages, the others make up a
+// single wave.
+func (e *Engine) PlanWaves(keys []types.NamespacedName, canary func(types.NamespacedName) bool) [][]types.NamespacedName {
+	var waves [][]types.NamespacedName
+	var canaries, others []types.NamespacedName
+	for _, nn := range keys {
+		if canary != nil && canary(nn) {
+			canaries = append(canaries, nn)
+		} else {
+			others = append(others, nn)
+		}
+	}
+	if len(canaries) > 0 {
+		waves = append(waves, canaries)
+	}
+
+	var percents []int
+	if e != nil {
+		percents = e.opts.Waves
+	}
+	if len(percents) == 0 {
+		return append(waves, others)
+	}
+	sort.Slice(others, func(i, j int) bool { return hashOf(others[i]) < hashOf(others[j]) })
+	start := 0
+	for i, percent := range percents {
+		end := (len(others)*percent + 99) / 100
+		if i == len(percents)-1 || end > len(others) {
+			end = len(others)
+		}
+		if end > start {
+			waves = append(waves, others[start:end])
+			start = end
+		}
+	}
+	return waves
+}
+
+func hashOf(nn types.NamespacedName) uint32 {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(nn.String()))
+	return h.Sum32()
+}
+
+// RunWaves calls apply for the keys of each wave in turn. After each wave
+// but the last, it waits for the WaveInterval and runs check, if set; an
+// unhealthy wave aborts the rollout with a HealthError, leaving the
+// Ingresses of later waves held by the Gate. Failures of apply, and those
+// reported by the Failures option, do not stop the rollout and are reported
+// together once it is done, unless they exceed the MaxFailureRatio: the
+// rollout is then aborted with a HealthError wrapping a FailureRateError.
+func (e *Engine) RunWaves(ctx context.Context, id string, waves [][]types.NamespacedName,
+	apply func(context.Context, types.NamespacedName) error, check HealthCheck) error {
+	logger := log.FromContext(ctx).WithValues("rollout", id)
+
+	checkpoint := Checkpoint{ID: id}
+	if e != nil && e.checkpoints != nil {
+		last, err := e.checkpoints.Load(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to load rollout checkpoint: %w", err)
+		}
+		if last.ID == id {
+			checkpoint = last
+			logger.Info("Resuming rollout", "wave", checkpoint.Wave, "last", checkpoint.Last, "failed", len(checkpoint.Failed))
+		}
+	}
+
+	gate := e.Gate()
+	gate.close()
+	var done []types.NamespacedName
+	for i := 0; i <= min(checkpoint.Wave, len(waves)-1); i++ {
+		done = append(done, waves[i]...)
+	}
+	if checkpoint.Aborted {
+		// The rolled back Ingresses are held along with the others.
+		return &HealthError{Wave: checkpoint.Wave, Done: done, Err: ErrAborted}
+	}
+	done = nil
+	for i := 0; i < min(checkpoint.Wave, len(waves)); i++ {
+		gate.release(waves[i])
+		done = append(done, waves[i]...)
+	}
+
+	t := &tally{failed: make(map[string]error)}
+	for i := checkpoint.Wave; i < len(waves); i++ {
+		if i > checkpoint.Wave {
+			checkpoint = Checkpoint{ID: id, Wave: i}
+		}
+		gate.release(waves[i])
+		done = append(done, waves[i]...)
+		if err := e.runWave(ctx, &checkpoint, waves[i], apply, t); err != nil {
+			var rateErr *FailureRateError
+			if errors.As(err, &rateErr) {
+				return &HealthError{Wave: i, Done: done, Err: err}
+			}
+			return err
+		}
+		if i == len(waves)-1 || e == nil {
+			continue
+		}
+
+		logger.Info("Rollout wave done", "wave", i+1, "waves", len(waves), "failed", len(t.failed))
+		if e.opts.WaveInterval > 0 {
+			if err := sleep(ctx, e.opts.WaveInterval); err != nil {
+				return err
+			}
+		}
+		if err := e.collect(t); err != nil {
+			checkpoint.Aborted = true
+			e.save(ctx, checkpoint)
+			return &HealthError{Wave: i, Done: done, Err: err}
+		}
+		if check != nil {
+			if err := check.Check(ctx, done); err != nil {
+				checkpoint.Aborted = true
+				e.save(ctx, checkpoint)
+				return &HealthError{Wave: i, Done: done, Err: err}
+			}
+		}
+		e.save(ctx, Checkpoint{ID: id, Wave: i + 1})
+	}
+	gate.Open()
+
+	if len(t.failed) > 0 {
+		return &Error{Total: t.tried, Failed: t.failed}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package rollout
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmnote/tester/testcase"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+type checkFunc func(ctx context.Context, done []types.NamespacedName) error
+
+func (f checkFunc) Check(ctx context.Context, done []types.NamespacedName) error {
+	return f(ctx, done)
+}
+
+func namesOf(keys []types.NamespacedName) []string {
+	names := []string{}
+	for _, nn := range keys {
+		names = append(names, nn.String())
+	}
+	return names
+}
+
+func TestGate(t *testing.T) {
+	nn := types.NamespacedName{Namespace: "default", Name: "a"}
+	var nilGate *Gate
+	assert.False(t, nilGate.Holds(nn))
+
+	gate := NewGate()
+	assert.True(t, gate.Holds(nn))
+	gate.close()
+	gate.release([]types.NamespacedName{nn})
+	assert.False(t, gate.Holds(nn))
+	assert.True(t, gate.Holds(types.NamespacedName{Namespace: "default", Name: "b"}))
+	gate.Open()
+	assert.False(t, gate.Holds(types.NamespacedName{Namespace: "default", Name: "b"}))
+}
+
+func TestPlanWaves(t *testing.T) {
+	keys := append(keysOf("a", "b", "c", "d", "e", "f", "g", "h", "i", "j"),
+		types.NamespacedName{Namespace: "canary", Name: "a"})
+	isCanary := func(nn types.NamespacedName) bool { return nn.Namespace == "canary" }
+
+	testCases := []struct {
+		name       string
+		engine     *Engine
+		canary     func(types.NamespacedName) bool
+		wantCounts []int
+	}{
+		{
+			name:       "Nil engine",
+			wantCounts: []int{11},
+		},
+		{
+			name:       "Canary Namespaces",
+			engine:     New(Options{}, nil),
+			canary:     isCanary,
+			wantCounts: []int{1, 10},
+		},
+		{
+			name:       "Percentages",
+			engine:     New(Options{Waves: []int{10, 50, 100}}, nil),
+			canary:     isCanary,
+			wantCounts: []int{1, 1, 4, 5},
+		},
+		{
+			name:       "Last wave takes the rest",
+			engine:     New(Options{Waves: []int{25, 50}}, nil),
+			wantCounts: []int{3, 8},
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			waves := tc.engine.PlanWaves(keys, tc.canary)
+			var counts []int
+			var all []string
+			for _, wave := range waves {
+				counts = append(counts, len(wave))
+				all = append(all, namesOf(wave)...)
+			}
+			assert.Equal(t, tc.wantCounts, counts)
+			assert.ElementsMatch(t, namesOf(keys), all)
+
+			// Plans are the same for the same Ingresses.
+			assert.Equal(t, waves, tc.engine.PlanWaves(keys, tc.canary))
+		})
+	}
+}
+
+func TestRunWaves(t *testing.T) {
+	waves := [][]types.NamespacedName{keysOf("c"), keysOf("a", "b"), keysOf("d")}
+
+	t.Run("Healthy", func(t *testing.T) {
+		store := &memoryStore{}
+		engine := New(Options{Waves: []int{100}, WaveInterval: time.Millisecond}, store)
+		var checked [][]string
+		check := checkFunc(func(_ context.Context, done []types.NamespacedName) error {
+			checked = append(checked, namesOf(done))
+			return nil
+		})
+		var applied []string
+		assert.NoError(t, engine.RunWaves(context.Background(), "gen1", waves, record(&applied), check))
+		assert.Equal(t, []string{"c", "a", "b", "d"}, applied)
+		assert.Equal(t, [][]string{{"default/c"}, {"default/c", "default/a", "default/b"}}, checked)
+		assert.Equal(t, Checkpoint{ID: "gen1", Wave: 2, Last: "default/d", Failed: []string{}}, store.checkpoint)
+		assert.False(t, engine.Gate().Holds(types.NamespacedName{Namespace: "default", Name: "x"}))
+	})
+
+	t.Run("Unhealthy", func(t *testing.T) {
+		store := &memoryStore{}
+		engine := New(Options{Waves: []int{100}}, store)
+		check := checkFunc(func(_ context.Context, done []types.NamespacedName) error {
+			if len(done) > 1 {
+				return errors.New("mocked unhealthy")
+			}
+			return nil
+		})
+		var applied []string
+		err := engine.RunWaves(context.Background(), "gen1", waves, record(&applied), check)
+		assert.EqualError(t, err, "rollout aborted after wave 2: mocked unhealthy")
+		var healthErr *HealthError
+		assert.ErrorAs(t, err, &healthErr)
+		assert.Equal(t, []string{"default/c", "default/a", "default/b"}, namesOf(healthErr.Done))
+		assert.Equal(t, []string{"c", "a", "b"}, applied)
+		assert.True(t, engine.Gate().Holds(types.NamespacedName{Namespace: "default", Name: "d"}))
+		assert.False(t, engine.Gate().Holds(types.NamespacedName{Namespace: "default", Name: "a"}))
+
+		// The aborted rollout is not resumed, and holds all Ingresses.
+		applied = nil
+		err = engine.RunWaves(context.Background(), "gen1", waves, record(&applied), check)
+		assert.ErrorIs(t, err, ErrAborted)
+		assert.Empty(t, applied)
+		assert.True(t, engine.Gate().Holds(types.NamespacedName{Namespace: "default", Name: "a"}))
+
+		// Other rules start over.
+		assert.NoError(t, engine.RunWaves(context.Background(), "gen2", waves, record(&applied), nil))
+		assert.Equal(t, []string{"c", "a", "b", "d"}, applied)
+	})
+
+	t.Run("Resume", func(t *testing.T) {
+		store := &memoryStore{checkpoint: Checkpoint{ID: "gen1", Wave: 1, Last: "default/a", Failed: []string{"default/a"}}}
+		engine := New(Options{Waves: []int{100}}, store)
+		var applied []string
+		assert.NoError(t, engine.RunWaves(context.Background(), "gen1", waves, record(&applied), nil))
+		assert.Equal(t, []string{"a", "b", "d"}, applied)
+	})
+}
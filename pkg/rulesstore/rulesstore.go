@@ -1,24 +1,70 @@
 package rulesstore
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"net/http"
+	"strconv"
 	"sync"
+	"time"
 
 	"gopkg.in/yaml.v3"
 	corev1 "k8s.io/api/core/v1"
 
 	"github.com/kuoss/ingress-annotator/pkg/model"
+	"github.com/kuoss/ingress-annotator/pkg/util"
 )
 
+// StagedRulesKey is the ConfigMap key of the rules awaiting promotion.
+const StagedRulesKey = "rules-staged"
+
 type IRulesStore interface {
 	GetRules() *model.Rules
+	GetGeneration() string
+	IsCleanupEnabled() bool
+	IsPaused() bool
+	IsPauseRequested() bool
+	GetStagedRules() *model.Rules
+	GetStagedGeneration() string
 	UpdateRules(cm *corev1.ConfigMap) error
+	Rollback() bool
+	GetRolledBackGeneration() string
+	MarkMissing(policy model.MissingPolicy)
+	MarkReadError(err error)
+	LastReadError() error
+}
+
+// snapshot is a rule set that was applied before the current one.
+type snapshot struct {
+	rules      *model.Rules
+	generation string
+	cleanup    bool
 }
 
 type RulesStore struct {
 	Rules      *model.Rules
-	rulesMutex *sync.Mutex
+	generation string
+	cleanup    bool
+	// previous is the rule set replaced by the current one, if any.
+	previous *snapshot
+	// rolledBack is the generation of the rules replaced by a rollback,
+	// which are not applied again until the ConfigMap holds other rules.
+	rolledBack string
+	// staged are the proposed rules awaiting promotion, if any.
+	staged           *model.Rules
+	stagedGeneration string
+	// pause is set by the ConfigMap; paused while no rules are available.
+	pause  bool
+	loaded bool
+	paused bool
+	// lastRead is the time the ConfigMap was last read successfully, and
+	// failingSince the start of the current run of failed reads, if any.
+	lastRead     time.Time
+	failingSince time.Time
+	lastError    error
+	rulesMutex   *sync.Mutex
 }
 
 func New(cm *corev1.ConfigMap) (*RulesStore, error) {
@@ -31,6 +77,18 @@ func New(cm *corev1.ConfigMap) (*RulesStore, error) {
 	return store, nil
 }
 
+// NewMissing returns a RulesStore for a ConfigMap that does not exist yet.
+// Unless policy is MissingPolicyEmpty, writes stay paused until rules are loaded.
+func NewMissing(policy model.MissingPolicy) *RulesStore {
+	store := &RulesStore{
+		Rules:      &model.Rules{},
+		generation: generationOf(model.Rules{}),
+		rulesMutex: &sync.Mutex{},
+	}
+	store.MarkMissing(policy)
+	return store
+}
+
 func (s *RulesStore) GetRules() *model.Rules {
 	s.rulesMutex.Lock()
 	defer s.rulesMutex.Unlock()
@@ -38,21 +96,254 @@ func (s *RulesStore) GetRules() *model.Rules {
 	return s.Rules
 }
 
+// GetGeneration returns a short digest of the current rules. It changes only
+// when the rules themselves change, so it is stable across restarts.
+func (s *RulesStore) GetGeneration() string {
+	s.rulesMutex.Lock()
+	defer s.rulesMutex.Unlock()
+
+	return s.generation
+}
+
+// GetStagedRules returns the rules proposed under the 'rules-staged' key of
+// the ConfigMap, or nil if there are none.
+func (s *RulesStore) GetStagedRules() *model.Rules {
+	s.rulesMutex.Lock()
+	defer s.rulesMutex.Unlock()
+
+	return s.staged
+}
+
+// GetStagedGeneration returns the generation of the staged rules, or "" if
+// there are none.
+func (s *RulesStore) GetStagedGeneration() string {
+	s.rulesMutex.Lock()
+	defer s.rulesMutex.Unlock()
+
+	return s.stagedGeneration
+}
+
+// IsCleanupEnabled reports whether the ConfigMap asks for all managed
+// annotations to be removed, regardless of the rules.
+func (s *RulesStore) IsCleanupEnabled() bool {
+	s.rulesMutex.Lock()
+	defer s.rulesMutex.Unlock()
+
+	return s.cleanup
+}
+
+// IsPaused reports whether Ingresses must not be written to, because no rules
+// are known or the ConfigMap is missing under MissingPolicyPause.
+func (s *RulesStore) IsPaused() bool {
+	s.rulesMutex.Lock()
+	defer s.rulesMutex.Unlock()
+
+	return s.paused
+}
+
+// IsPauseRequested reports whether the ConfigMap asks for writes to Ingresses
+// to be paused. Unlike IsPaused, the rules are still evaluated.
+func (s *RulesStore) IsPauseRequested() bool {
+	s.rulesMutex.Lock()
+	defer s.rulesMutex.Unlock()
+
+	return s.pause
+}
+
+// MarkMissing records that the ConfigMap no longer exists and applies policy.
+func (s *RulesStore) MarkMissing(policy model.MissingPolicy) {
+	s.rulesMutex.Lock()
+	defer s.rulesMutex.Unlock()
+
+	s.markRead()
+	switch policy {
+	case model.MissingPolicyEmpty:
+		s.Rules = &model.Rules{}
+		s.generation = generationOf(model.Rules{})
+		s.cleanup = false
+		s.pause = false
+		s.paused = false
+	case model.MissingPolicyPause:
+		s.paused = true
+	default:
+		// Keep the last-known rules; there is nothing to keep if none were loaded.
+		s.paused = !s.loaded
+	}
+}
+
+// MarkReadError records that the ConfigMap could not be read or parsed. The
+// last-known rules stay in effect.
+func (s *RulesStore) MarkReadError(err error) {
+	s.rulesMutex.Lock()
+	defer s.rulesMutex.Unlock()
+
+	if s.failingSince.IsZero() {
+		s.failingSince = time.Now()
+	}
+	s.lastError = err
+}
+
+func (s *RulesStore) markRead() {
+	s.lastRead = time.Now()
+	s.failingSince = time.Time{}
+	s.lastError = nil
+}
+
+// LastReadError returns the error of the current run of failed reads, or nil
+// if the ConfigMap was last read successfully.
+func (s *RulesStore) LastReadError() error {
+	s.rulesMutex.Lock()
+	defer s.rulesMutex.Unlock()
+
+	return s.lastError
+}
+
+// LastRead returns the time the ConfigMap was last read successfully.
+func (s *RulesStore) LastRead() time.Time {
+	s.rulesMutex.Lock()
+	defer s.rulesMutex.Unlock()
+
+	return s.lastRead
+}
+
+// ReadyzCheck fails while no valid rule set is available to apply.
+func (s *RulesStore) ReadyzCheck(_ *http.Request) error {
+	if s.IsPaused() {
+		return errors.New("rules are not loaded")
+	}
+	return nil
+}
+
+// HealthzCheck returns a check that fails once the ConfigMap has been
+// unreadable for longer than threshold.
+func (s *RulesStore) HealthzCheck(threshold time.Duration) func(*http.Request) error {
+	return func(_ *http.Request) error {
+		s.rulesMutex.Lock()
+		defer s.rulesMutex.Unlock()
+
+		if s.failingSince.IsZero() {
+			return nil
+		}
+		if failing := time.Since(s.failingSince); failing > threshold {
+			return fmt.Errorf("rules ConfigMap unreadable for %s (last read %s): %w",
+				failing.Round(time.Second), s.lastRead.Format(time.RFC3339), s.lastError)
+		}
+		return nil
+	}
+}
+
 func (s *RulesStore) UpdateRules(cm *corev1.ConfigMap) error {
 	rules, err := getRulesFromConfigMap(cm)
 	if err != nil {
-		return fmt.Errorf("failed to extract rules from configMap: %w", err)
+		err = fmt.Errorf("failed to extract rules from configMap: %w", err)
+		s.MarkReadError(err)
+		return err
+	}
+	staged, err := getStagedRulesFromConfigMap(cm)
+	if err != nil {
+		err = fmt.Errorf("failed to extract staged rules from configMap: %w", err)
+		s.MarkReadError(err)
+		return err
+	}
+	cleanup, err := getBoolFromConfigMap(cm, "cleanup")
+	if err != nil {
+		err = fmt.Errorf("failed to extract settings from configMap: %w", err)
+		s.MarkReadError(err)
+		return err
 	}
 
-	s.updateRules(rules)
+	pause, err := getBoolFromConfigMap(cm, "paused")
+	if err != nil {
+		err = fmt.Errorf("failed to extract settings from configMap: %w", err)
+		s.MarkReadError(err)
+		return err
+	}
+
+	s.updateRules(rules, cleanup, pause)
+	s.updateStagedRules(staged)
 	return nil
 }
 
-func (s *RulesStore) updateRules(rules model.Rules) {
+func (s *RulesStore) updateStagedRules(staged *model.Rules) {
+	s.rulesMutex.Lock()
+	defer s.rulesMutex.Unlock()
+
+	s.staged = staged
+	s.stagedGeneration = ""
+	if staged != nil {
+		s.stagedGeneration = generationOf(*staged)
+	}
+}
+
+func (s *RulesStore) updateRules(rules model.Rules, cleanup, pause bool) {
 	s.rulesMutex.Lock()
 	defer s.rulesMutex.Unlock()
 
+	generation := generationOf(rules)
+	s.pause = pause
+	s.markRead()
+	if generation == s.rolledBack {
+		return
+	}
+	s.rolledBack = ""
+	if s.loaded && generation != s.generation {
+		s.previous = &snapshot{rules: s.Rules, generation: s.generation, cleanup: s.cleanup}
+	}
 	s.Rules = &rules
+	s.generation = generation
+	s.cleanup = cleanup
+	s.loaded = true
+	s.paused = false
+}
+
+// Rollback restores the rule set replaced by the current one. Loading the
+// ConfigMap again keeps the rollback until it holds other rules. It reports
+// false if there is no rule set to restore.
+func (s *RulesStore) Rollback() bool {
+	s.rulesMutex.Lock()
+	defer s.rulesMutex.Unlock()
+
+	if s.previous == nil {
+		return false
+	}
+	s.rolledBack = s.generation
+	s.Rules = s.previous.rules
+	s.generation = s.previous.generation
+	s.cleanup = s.previous.cleanup
+	s.previous = nil
+	return true
+}
+
+// GetRolledBackGeneration returns the generation of the rules replaced by
+// the last rollback while the ConfigMap still holds them, or "" otherwise.
+func (s *RulesStore) GetRolledBackGeneration() string {
+	s.rulesMutex.Lock()
+	defer s.rulesMutex.Unlock()
+
+	return s.rolledBack
+}
+
+// Generation returns the generation of the rules of cm, as GetGeneration
+// would once they are loaded.
+func Generation(cm *corev1.ConfigMap) (string, error) {
+	rules, err := getRulesFromConfigMap(cm)
+	if err != nil {
+		return "", err
+	}
+	return generationOf(rules), nil
+}
+
+// PauseRequested reports whether cm asks for writes to Ingresses to be
+// paused, as IsPauseRequested would once it is loaded. An invalid setting
+// does not, as the ConfigMap is then not loaded.
+func PauseRequested(cm *corev1.ConfigMap) bool {
+	pause, err := getBoolFromConfigMap(cm, "paused")
+	return err == nil && pause
+}
+
+func generationOf(rules model.Rules) string {
+	sum := sha256.Sum256(util.MustMarshalJSON(rules))
+	return hex.EncodeToString(sum[:])[:12]
 }
 
 func getRulesFromConfigMap(cm *corev1.ConfigMap) (model.Rules, error) {
@@ -72,3 +363,30 @@ func getRulesFromConfigMap(cm *corev1.ConfigMap) (model.Rules, error) {
 
 	return rules, nil
 }
+
+// getStagedRulesFromConfigMap returns the rules under the 'rules-staged' key,
+// or nil if the key is not set.
+func getStagedRulesFromConfigMap(cm *corev1.ConfigMap) (*model.Rules, error) {
+	rulesText, ok := cm.Data[StagedRulesKey]
+	if !ok {
+		return nil, nil
+	}
+
+	rules := model.Rules{}
+	if err := yaml.Unmarshal([]byte(rulesText), &rules); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal staged rules: %w", err)
+	}
+	return &rules, nil
+}
+
+func getBoolFromConfigMap(cm *corev1.ConfigMap, key string) (bool, error) {
+	value, ok := cm.Data[key]
+	if !ok || value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid '%s' value %q: %w", key, value, err)
+	}
+	return b, nil
+}
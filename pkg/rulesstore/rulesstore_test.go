@@ -1,8 +1,10 @@
 package rulesstore
 
 import (
+	"errors"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/jmnote/tester/testcase"
 	"github.com/stretchr/testify/assert"
@@ -133,3 +135,330 @@ rule1:
 		})
 	}
 }
+
+func TestGetGeneration(t *testing.T) {
+	newConfigMap := func(rulesText string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{Data: map[string]string{"rules": rulesText}}
+	}
+
+	store, err := New(newConfigMap("rule1:\n  key1: value1\nrule2:\n  key2: value2"))
+	assert.NoError(t, err)
+	generation := store.GetGeneration()
+	assert.Len(t, generation, 12)
+
+	// Formatting and ordering do not change the generation.
+	err = store.UpdateRules(newConfigMap("rule2: {key2: value2}\nrule1: {key1: value1}"))
+	assert.NoError(t, err)
+	assert.Equal(t, generation, store.GetGeneration())
+
+	err = store.UpdateRules(newConfigMap("rule1:\n  key1: value2"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, generation, store.GetGeneration())
+
+	// Generation tells the generation of a ConfigMap without loading it.
+	got, err := Generation(newConfigMap("rule1:\n  key1: value2"))
+	assert.NoError(t, err)
+	assert.Equal(t, store.GetGeneration(), got)
+
+	_, err = Generation(newConfigMap("invalid"))
+	assert.Error(t, err)
+}
+
+func TestRollback(t *testing.T) {
+	newConfigMap := func(rulesText string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{Data: map[string]string{"rules": rulesText}}
+	}
+
+	store, err := New(newConfigMap("rule1:\n  key1: value1"))
+	assert.NoError(t, err)
+	generation := store.GetGeneration()
+	assert.False(t, store.Rollback())
+
+	// Loading the same rules again keeps nothing to roll back to.
+	assert.NoError(t, store.UpdateRules(newConfigMap("rule1: {key1: value1}")))
+	assert.False(t, store.Rollback())
+
+	assert.NoError(t, store.UpdateRules(newConfigMap("rule1:\n  key1: value2")))
+	rolledBack := store.GetGeneration()
+	assert.NotEqual(t, generation, rolledBack)
+	assert.Equal(t, "", store.GetRolledBackGeneration())
+	assert.True(t, store.Rollback())
+	assert.Equal(t, generation, store.GetGeneration())
+	assert.Equal(t, rolledBack, store.GetRolledBackGeneration())
+	assert.Equal(t, &model.Rules{"rule1": {"key1": "value1"}}, store.GetRules())
+	assert.False(t, store.Rollback())
+
+	// Loading the rolled back rules again keeps the rollback.
+	assert.NoError(t, store.UpdateRules(newConfigMap("rule1:\n  key1: value2")))
+	assert.Equal(t, generation, store.GetGeneration())
+	assert.Equal(t, &model.Rules{"rule1": {"key1": "value1"}}, store.GetRules())
+
+	// Other rules replace it.
+	assert.NoError(t, store.UpdateRules(newConfigMap("rule1:\n  key1: value3")))
+	assert.Equal(t, &model.Rules{"rule1": {"key1": "value3"}}, store.GetRules())
+	assert.Equal(t, "", store.GetRolledBackGeneration())
+	assert.True(t, store.Rollback())
+	assert.Equal(t, generation, store.GetGeneration())
+}
+
+func TestGetStagedRules(t *testing.T) {
+	testCases := []struct {
+		name           string
+		data           map[string]string
+		wantRules      *model.Rules
+		wantGeneration string
+		wantError      string
+	}{
+		{
+			name: "No staged rules",
+			data: map[string]string{"rules": "rule1:\n  key1: value1"},
+		},
+		{
+			name:           "Staged rules",
+			data:           map[string]string{"rules": "", StagedRulesKey: "rule1:\n  key1: value1"},
+			wantRules:      &model.Rules{"rule1": {"key1": "value1"}},
+			wantGeneration: "b8a831bf6b3c",
+		},
+		{
+			name:           "Empty staged rules",
+			data:           map[string]string{"rules": "rule1:\n  key1: value1", StagedRulesKey: ""},
+			wantRules:      &model.Rules{},
+			wantGeneration: generationOf(model.Rules{}),
+		},
+		{
+			name:      "Invalid staged rules",
+			data:      map[string]string{"rules": "", StagedRulesKey: "invalid"},
+			wantError: "failed to extract staged rules from configMap: failed to unmarshal staged rules: yaml: unmarshal errors:\n  line 1: cannot unmarshal !!str `invalid` into model.Rules",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			store := NewMissing(model.MissingPolicyKeep)
+			err := store.UpdateRules(&corev1.ConfigMap{Data: tc.data})
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.wantRules, store.GetStagedRules())
+			assert.Equal(t, tc.wantGeneration, store.GetStagedGeneration())
+		})
+	}
+}
+
+func TestIsCleanupEnabled(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        map[string]string
+		wantCleanup bool
+		wantError   string
+	}{
+		{
+			name: "not set",
+			data: map[string]string{"rules": ""},
+		},
+		{
+			name:        "enabled",
+			data:        map[string]string{"rules": "", "cleanup": "true"},
+			wantCleanup: true,
+		},
+		{
+			name: "disabled",
+			data: map[string]string{"rules": "", "cleanup": "false"},
+		},
+		{
+			name:      "invalid value",
+			data:      map[string]string{"rules": "", "cleanup": "yes please"},
+			wantError: "failed to extract settings from configMap: invalid 'cleanup' value \"yes please\": strconv.ParseBool: parsing \"yes please\": invalid syntax",
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(testcase.Name(i, tt.name), func(t *testing.T) {
+			store := &RulesStore{
+				rulesMutex: &sync.Mutex{},
+			}
+			err := store.UpdateRules(&corev1.ConfigMap{Data: tt.data})
+			if tt.wantError != "" {
+				assert.EqualError(t, err, tt.wantError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantCleanup, store.IsCleanupEnabled())
+		})
+	}
+}
+
+func TestIsPauseRequested(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      map[string]string
+		wantPause bool
+		wantError string
+	}{
+		{
+			name: "not set",
+			data: map[string]string{"rules": ""},
+		},
+		{
+			name:      "paused",
+			data:      map[string]string{"rules": "", "paused": "true"},
+			wantPause: true,
+		},
+		{
+			name: "resumed",
+			data: map[string]string{"rules": "", "paused": "false"},
+		},
+		{
+			name:      "invalid value",
+			data:      map[string]string{"rules": "", "paused": "maybe"},
+			wantError: "failed to extract settings from configMap: invalid 'paused' value \"maybe\": strconv.ParseBool: parsing \"maybe\": invalid syntax",
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(testcase.Name(i, tt.name), func(t *testing.T) {
+			store := &RulesStore{
+				rulesMutex: &sync.Mutex{},
+			}
+			err := store.UpdateRules(&corev1.ConfigMap{Data: tt.data})
+			if tt.wantError != "" {
+				assert.EqualError(t, err, tt.wantError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantPause, store.IsPauseRequested())
+			// Rules stay available while writes are paused.
+			assert.False(t, store.IsPaused())
+		})
+	}
+}
+
+func TestMarkMissing(t *testing.T) {
+	loadedRules := &model.Rules{"rule1": model.Annotations{"key1": "value1"}}
+
+	tests := []struct {
+		name       string
+		loaded     bool
+		policy     model.MissingPolicy
+		wantRules  *model.Rules
+		wantPaused bool
+	}{
+		{
+			name:       "keep without loaded rules",
+			policy:     model.MissingPolicyKeep,
+			wantRules:  &model.Rules{},
+			wantPaused: true,
+		},
+		{
+			name:      "keep with loaded rules",
+			loaded:    true,
+			policy:    model.MissingPolicyKeep,
+			wantRules: loadedRules,
+		},
+		{
+			name:      "empty",
+			loaded:    true,
+			policy:    model.MissingPolicyEmpty,
+			wantRules: &model.Rules{},
+		},
+		{
+			name:       "pause",
+			loaded:     true,
+			policy:     model.MissingPolicyPause,
+			wantRules:  loadedRules,
+			wantPaused: true,
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(testcase.Name(i, tt.name), func(t *testing.T) {
+			store := NewMissing(model.MissingPolicyPause)
+			if tt.loaded {
+				err := store.UpdateRules(&corev1.ConfigMap{Data: map[string]string{"rules": "rule1:\n  key1: value1"}})
+				assert.NoError(t, err)
+				assert.False(t, store.IsPaused())
+			}
+
+			store.MarkMissing(tt.policy)
+			assert.Equal(t, tt.wantRules, store.GetRules())
+			assert.Equal(t, tt.wantPaused, store.IsPaused())
+		})
+	}
+}
+
+func TestReadyzCheck(t *testing.T) {
+	store := NewMissing(model.MissingPolicyPause)
+	assert.EqualError(t, store.ReadyzCheck(nil), "rules are not loaded")
+
+	err := store.UpdateRules(&corev1.ConfigMap{Data: map[string]string{"rules": "rule1:\n  key1: value1"}})
+	assert.NoError(t, err)
+	assert.NoError(t, store.ReadyzCheck(nil))
+
+	// The last-known rules remain valid while the ConfigMap is invalid.
+	err = store.UpdateRules(&corev1.ConfigMap{Data: map[string]string{"rules": "invalid rules"}})
+	assert.Error(t, err)
+	assert.NoError(t, store.ReadyzCheck(nil))
+}
+
+func TestHealthzCheck(t *testing.T) {
+	tests := []struct {
+		name         string
+		failingSince time.Duration
+		wantError    string
+	}{
+		{
+			name: "readable",
+		},
+		{
+			name:         "unreadable within threshold",
+			failingSince: time.Minute,
+		},
+		{
+			name:         "unreadable beyond threshold",
+			failingSince: 10 * time.Minute,
+			wantError:    "rules ConfigMap unreadable for 10m0s (last read 2024-01-01T00:00:00Z): mocked error",
+		},
+	}
+
+	for i, tt := range tests {
+		t.Run(testcase.Name(i, tt.name), func(t *testing.T) {
+			store, err := New(&corev1.ConfigMap{Data: map[string]string{"rules": ""}})
+			assert.NoError(t, err)
+			assert.False(t, store.LastRead().IsZero())
+
+			if tt.failingSince > 0 {
+				store.MarkReadError(errors.New("mocked error"))
+				store.failingSince = time.Now().Add(-tt.failingSince)
+				store.lastRead = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			}
+
+			err = store.HealthzCheck(5 * time.Minute)(nil)
+			if tt.wantError != "" {
+				assert.EqualError(t, err, tt.wantError)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestMarkReadError(t *testing.T) {
+	store, err := New(&corev1.ConfigMap{Data: map[string]string{"rules": ""}})
+	assert.NoError(t, err)
+
+	store.MarkReadError(errors.New("first error"))
+	failingSince := store.failingSince
+	assert.False(t, failingSince.IsZero())
+
+	// A run of failures keeps its start time.
+	err = store.UpdateRules(&corev1.ConfigMap{Data: map[string]string{"rules": "invalid rules"}})
+	assert.Error(t, err)
+	assert.Equal(t, failingSince, store.failingSince)
+	assert.Equal(t, err, store.lastError)
+
+	// A successful read ends it.
+	store.MarkMissing(model.MissingPolicyKeep)
+	assert.True(t, store.failingSince.IsZero())
+	assert.NoError(t, store.lastError)
+}
@@ -0,0 +1,58 @@
+// Package scope restricts the annotator to the Ingresses of some namespaces.
+package scope
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Scope selects the namespaces whose Ingresses the annotator manages. A nil
+// Scope selects all namespaces.
+type Scope struct {
+	// Namespaces are the names of the namespaces selected; all if empty.
+	Namespaces []string
+	// Selector selects namespaces by their labels; all if nil.
+	Selector labels.Selector
+}
+
+// Parse returns the Scope of a comma-separated list of namespaces and a
+// label selector of namespaces, or nil if both are empty.
+func Parse(namespaces, selector string) (*Scope, error) {
+	s := &Scope{Namespaces: SplitNamespaces(namespaces)}
+	if selector != "" {
+		var err error
+		if s.Selector, err = labels.Parse(selector); err != nil {
+			return nil, fmt.Errorf("invalid namespace selector: %w", err)
+		}
+	}
+	if len(s.Namespaces) == 0 && s.Selector == nil {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// SplitNamespaces returns the names of a comma-separated list of namespaces.
+func SplitNamespaces(namespaces string) []string {
+	var names []string
+	for _, name := range strings.Split(namespaces, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Includes reports whether the Ingresses of namespace are managed.
+func (s *Scope) Includes(namespace *corev1.Namespace) bool {
+	if s == nil {
+		return true
+	}
+	if len(s.Namespaces) > 0 && !slices.Contains(s.Namespaces, namespace.Name) {
+		return false
+	}
+	return s.Selector == nil || s.Selector.Matches(labels.Set(namespace.Labels))
+}
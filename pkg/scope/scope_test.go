@@ -0,0 +1,82 @@
+package scope
+
+import (
+	"testing"
+
+	"github.com/jmnote/tester/testcase"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParse(t *testing.T) {
+	testCases := []struct {
+		namespaces     string
+		selector       string
+		wantNil        bool
+		wantNamespaces []string
+		wantSelector   string
+		wantError      string
+	}{
+		{
+			wantNil: true,
+		},
+		{
+			namespaces: " , ",
+			wantNil:    true,
+		},
+		{
+			namespaces:     "team-a, team-b,",
+			wantNamespaces: []string{"team-a", "team-b"},
+		},
+		{
+			selector:     "tenant in (a,b)",
+			wantSelector: "tenant in (a,b)",
+		},
+		{
+			selector:  "tenant in",
+			wantError: "invalid namespace selector: unable to parse requirement: found '' expected: '('",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.namespaces, tc.selector), func(t *testing.T) {
+			got, err := Parse(tc.namespaces, tc.selector)
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+				return
+			}
+			assert.NoError(t, err)
+			if tc.wantNil {
+				assert.Nil(t, got)
+				return
+			}
+			assert.Equal(t, tc.wantNamespaces, got.Namespaces)
+			if tc.wantSelector != "" {
+				assert.Equal(t, tc.wantSelector, got.Selector.String())
+			}
+		})
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	teamA := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"tenant": "a"}}}
+	teamB := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}}
+
+	var nilScope *Scope
+	assert.True(t, nilScope.Includes(teamA))
+
+	byName, err := Parse("team-a", "")
+	assert.NoError(t, err)
+	assert.True(t, byName.Includes(teamA))
+	assert.False(t, byName.Includes(teamB))
+
+	byLabel, err := Parse("", "tenant")
+	assert.NoError(t, err)
+	assert.True(t, byLabel.Includes(teamA))
+	assert.False(t, byLabel.Includes(teamB))
+
+	both, err := Parse("team-b", "tenant")
+	assert.NoError(t, err)
+	assert.False(t, both.Includes(teamA))
+	assert.False(t, both.Includes(teamB))
+}
@@ -0,0 +1,80 @@
+package shard
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// virtualNodes is the number of points each member has on the Ring, which
+// evens out the share of keys each member owns.
+const virtualNodes = 128
+
+// Ring assigns keys to members by consistent hashing: when a member joins or
+// leaves, only the keys it gains or owned move.
+type Ring struct {
+	members []string
+	points  []point
+}
+
+type point struct {
+	hash   uint64
+	member string
+}
+
+// NewRing returns the Ring of members; duplicates are ignored.
+func NewRing(members []string) *Ring {
+	r := &Ring{}
+	seen := make(map[string]bool, len(members))
+	for _, member := range members {
+		if seen[member] {
+			continue
+		}
+		seen[member] = true
+		r.members = append(r.members, member)
+		for i := 0; i < virtualNodes; i++ {
+			r.points = append(r.points, point{hash: hash(member + "#" + strconv.Itoa(i)), member: member})
+		}
+	}
+	sort.Strings(r.members)
+	sort.Slice(r.points, func(i, j int) bool {
+		a, b := r.points[i], r.points[j]
+		return a.hash < b.hash || (a.hash == b.hash && a.member < b.member)
+	})
+	return r
+}
+
+// Members returns the sorted members of the Ring.
+func (r *Ring) Members() []string {
+	if r == nil {
+		return nil
+	}
+	return r.members
+}
+
+// Owner returns the member owning key, or "" if the Ring is empty.
+func (r *Ring) Owner(key string) string {
+	if r == nil || len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].member
+}
+
+// hash is FNV-1a followed by the finalizer of SplitMix64, as FNV alone
+// spreads similar short strings such as "pod-0#1" and "pod-0#2" poorly.
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,78 @@
+package shard
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/jmnote/tester/testcase"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing_Owner(t *testing.T) {
+	testCases := []struct {
+		members []string
+		want    []string
+	}{
+		{
+			members: nil,
+			want:    []string{""},
+		},
+		{
+			members: []string{"pod-0"},
+			want:    []string{"pod-0"},
+		},
+		{
+			members: []string{"pod-0", "pod-1", "pod-0"},
+			want:    []string{"pod-0", "pod-1"},
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i), func(t *testing.T) {
+			ring := NewRing(tc.members)
+			owners := map[string]bool{}
+			for j := 0; j < 100; j++ {
+				owners[ring.Owner(fmt.Sprintf("namespace-%d", j))] = true
+			}
+			assert.Len(t, owners, len(tc.want))
+			for _, want := range tc.want {
+				assert.True(t, owners[want], want)
+			}
+		})
+	}
+}
+
+func TestRing_Members(t *testing.T) {
+	assert.Nil(t, (*Ring)(nil).Members())
+	assert.Equal(t, []string{"pod-0", "pod-1"}, NewRing([]string{"pod-1", "pod-0", "pod-1"}).Members())
+}
+
+func TestRing_Balance(t *testing.T) {
+	members := []string{"pod-0", "pod-1", "pod-2", "pod-3"}
+	ring := NewRing(members)
+	counts := map[string]int{}
+	const keys = 10000
+	for i := 0; i < keys; i++ {
+		counts[ring.Owner(fmt.Sprintf("namespace-%d", i))]++
+	}
+	for _, member := range members {
+		// Within 30% of an even share.
+		assert.InDelta(t, keys/len(members), counts[member], 0.3*keys/float64(len(members)), member)
+	}
+}
+
+func TestRing_Join(t *testing.T) {
+	before := NewRing([]string{"pod-0", "pod-1", "pod-2"})
+	after := NewRing([]string{"pod-0", "pod-1", "pod-2", "pod-3"})
+	moved := 0
+	const keys = 10000
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("namespace-%d", i)
+		if before.Owner(key) != after.Owner(key) {
+			moved++
+			// Keys only move to the member that joined.
+			assert.Equal(t, "pod-3", after.Owner(key))
+		}
+	}
+	// About a quarter of the keys move to the new member.
+	assert.InDelta(t, keys/4, moved, 0.3*keys/4)
+}
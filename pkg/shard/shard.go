@@ -0,0 +1,334 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/kuoss/ingress-annotator/pkg/metrics"
+)
+
+const (
+	// LeasePrefix is the prefix of the name of the Lease of each replica.
+	LeasePrefix = "ingress-annotator-shard-"
+	// MemberLabel marks the Leases of the replicas sharing the Namespaces.
+	MemberLabel = "annotator.ingress.kubernetes.io/shard"
+)
+
+// Options configures a Shard.
+type Options struct {
+	// Namespace is where the Leases live, the namespace of the manager.
+	Namespace string
+	// Identity names this replica, e.g. its Pod name.
+	Identity string
+	// LeaseDuration is how long a replica that stopped renewing its Lease
+	// keeps its Namespaces. Leases are renewed three times as often.
+	LeaseDuration time.Duration
+}
+
+// Shard is the share of Namespaces of one replica, when replicas run
+// active-active. Each replica holds a Lease; the replicas with a live Lease
+// split the Namespaces by consistent hashing of their names.
+//
+// A nil Shard owns every Namespace, as does a single replica without sharding.
+type Shard struct {
+	client client.Client
+	// reader reads the Leases uncached, so that no informer watches them.
+	reader client.Reader
+	opts   Options
+	now    func() time.Time
+
+	mutex sync.RWMutex
+	ring  *Ring
+	// renewed is when the Lease of this replica was last renewed.
+	renewed time.Time
+
+	gained chan event.GenericEvent
+	lost   chan event.GenericEvent
+}
+
+// New returns a Shard that owns no Namespace until it is started.
+func New(c client.Client, reader client.Reader, opts Options) *Shard {
+	return &Shard{
+		client: c,
+		reader: reader,
+		opts:   opts,
+		now:    time.Now,
+		gained: make(chan event.GenericEvent, 1024),
+		lost:   make(chan event.GenericEvent, 1024),
+	}
+}
+
+// NewFixed returns a Shard of members that never changes; it need not be started.
+func NewFixed(identity string, members ...string) *Shard {
+	s := New(nil, nil, Options{Identity: identity})
+	s.ring = NewRing(members)
+	return s
+}
+
+// Owns reports whether the Ingresses of namespace are handled by this replica.
+// It owns none once its Lease went unrenewed for longer than LeaseDuration,
+// as the other replicas then take its Namespaces over.
+func (s *Shard) Owns(namespace string) bool {
+	if s == nil {
+		return true
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.lapsed() {
+		return false
+	}
+	return s.ring.Owner(namespace) == s.opts.Identity
+}
+
+// lapsed reports whether the Lease of this replica expired; a fixed Shard,
+// without a LeaseDuration, never lapses. The caller holds the mutex.
+func (s *Shard) lapsed() bool {
+	return s.opts.LeaseDuration > 0 && s.now().Sub(s.renewed) > s.opts.LeaseDuration
+}
+
+// Members returns the identities of the replicas sharing the Namespaces.
+func (s *Shard) Members() []string {
+	if s == nil {
+		return nil
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.ring.Members()
+}
+
+// Gained delivers the Namespaces this replica takes over when the replicas
+// are rebalanced, so that their Ingresses are reconciled by their new owner.
+func (s *Shard) Gained() <-chan event.GenericEvent {
+	return s.gained
+}
+
+// Lost delivers the Namespaces this replica hands over to another one, or
+// gives up once its Lease lapsed, so that their Ingresses stop being reported
+// by this replica.
+func (s *Shard) Lost() <-chan event.GenericEvent {
+	return s.lost
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable: every
+// replica holds its own Lease.
+func (s *Shard) NeedLeaderElection() bool {
+	return false
+}
+
+// Start renews the Lease of this replica and rebalances the Namespaces
+// whenever replicas join or leave, until ctx is done. The Lease is then
+// released, so that the other replicas take over right away.
+func (s *Shard) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithValues("shard", s.opts.Identity)
+	ticker := time.NewTicker(s.opts.LeaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		if err := s.sync(ctx); err != nil {
+			logger.Error(err, "Failed to sync shard members")
+		}
+		select {
+		case <-ctx.Done():
+			releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := s.release(releaseCtx); err != nil {
+				logger.Error(err, "Failed to release shard Lease")
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync renews the Lease of this replica, then rebalances the Namespaces if
+// the live Leases changed. When the Lease cannot be renewed until it lapses,
+// the Namespaces are given up instead.
+func (s *Shard) sync(ctx context.Context) error {
+	renewed := s.now()
+	if err := s.renew(ctx); err != nil {
+		s.mutex.RLock()
+		lapsed := s.lapsed() && s.ring != nil
+		s.mutex.RUnlock()
+		if lapsed {
+			return errors.Join(err, s.giveUp(ctx))
+		}
+		return err
+	}
+	s.mutex.Lock()
+	s.renewed = renewed
+	s.mutex.Unlock()
+	members, err := s.liveMembers(ctx)
+	if err != nil {
+		return err
+	}
+	return s.rebalance(ctx, NewRing(members))
+}
+
+func (s *Shard) leaseKey() types.NamespacedName {
+	return types.NamespacedName{Namespace: s.opts.Namespace, Name: LeasePrefix + s.opts.Identity}
+}
+
+func (s *Shard) renew(ctx context.Context) error {
+	now := metav1.NewMicroTime(s.now())
+	var lease coordinationv1.Lease
+	err := s.reader.Get(ctx, s.leaseKey(), &lease)
+	if apierrors.IsNotFound(err) {
+		seconds := int32(s.opts.LeaseDuration.Seconds())
+		lease = coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: s.opts.Namespace,
+				Name:      s.leaseKey().Name,
+				Labels:    map[string]string{MemberLabel: "true"},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &s.opts.Identity,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		if err := s.client.Create(ctx, &lease); err != nil {
+			return fmt.Errorf("failed to create shard Lease: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get shard Lease: %w", err)
+	}
+	lease.Spec.RenewTime = &now
+	if err := s.client.Update(ctx, &lease); err != nil {
+		return fmt.Errorf("failed to renew shard Lease: %w", err)
+	}
+	return nil
+}
+
+// liveMembers returns the holders of the Leases renewed within their
+// duration, including this replica.
+func (s *Shard) liveMembers(ctx context.Context) ([]string, error) {
+	var leases coordinationv1.LeaseList
+	if err := s.reader.List(ctx, &leases, client.InNamespace(s.opts.Namespace),
+		client.MatchingLabels{MemberLabel: "true"}); err != nil {
+		return nil, fmt.Errorf("failed to list shard Leases: %w", err)
+	}
+	members := []string{s.opts.Identity}
+	now := s.now()
+	for _, lease := range leases.Items {
+		spec := lease.Spec
+		if spec.HolderIdentity == nil || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+			continue
+		}
+		expiry := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+		if now.Before(expiry) {
+			members = append(members, *spec.HolderIdentity)
+		}
+	}
+	return members, nil
+}
+
+// rebalance replaces the Ring when the members changed, and delivers the
+// Namespaces this replica gained to Gained and those it lost to Lost.
+func (s *Shard) rebalance(ctx context.Context, ring *Ring) error {
+	s.mutex.RLock()
+	previous := s.ring
+	s.mutex.RUnlock()
+	if previous != nil && slices.Equal(previous.Members(), ring.Members()) {
+		return nil
+	}
+
+	// The Namespaces are listed before the Ring is replaced, so that a failed
+	// list is retried on the next sync instead of losing the gained ones.
+	var namespaces corev1.NamespaceList
+	if err := s.client.List(ctx, &namespaces); err != nil {
+		return fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	var gained, lost []event.GenericEvent
+	for i := range namespaces.Items {
+		name := namespaces.Items[i].Name
+		owner, previousOwner := ring.Owner(name), previous.Owner(name)
+		switch {
+		case owner == s.opts.Identity && previousOwner != s.opts.Identity:
+			gained = append(gained, event.GenericEvent{Object: &namespaces.Items[i]})
+		case owner != s.opts.Identity && previousOwner == s.opts.Identity:
+			lost = append(lost, event.GenericEvent{Object: &namespaces.Items[i]})
+		}
+	}
+
+	s.mutex.Lock()
+	s.ring = ring
+	s.mutex.Unlock()
+
+	log.FromContext(ctx).Info("Shard members changed", "shard", s.opts.Identity,
+		"members", strings.Join(ring.Members(), ","), "gainedNamespaces", len(gained), "lostNamespaces", len(lost))
+	metrics.ShardMembers.Set(float64(len(ring.Members())))
+	metrics.ShardRebalances.Inc()
+
+	deliver(ctx, s.gained, gained)
+	deliver(ctx, s.lost, lost)
+	return nil
+}
+
+// giveUp drops the Ring once the Lease of this replica lapsed, and delivers
+// the Namespaces it owned to Lost. The next successful sync rebalances from
+// scratch, so that every Namespace it owns again is delivered to Gained.
+func (s *Shard) giveUp(ctx context.Context) error {
+	var namespaces corev1.NamespaceList
+	if err := s.client.List(ctx, &namespaces); err != nil {
+		return fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	s.mutex.Lock()
+	previous := s.ring
+	s.ring = nil
+	s.mutex.Unlock()
+
+	var lost []event.GenericEvent
+	for i := range namespaces.Items {
+		if previous.Owner(namespaces.Items[i].Name) == s.opts.Identity {
+			lost = append(lost, event.GenericEvent{Object: &namespaces.Items[i]})
+		}
+	}
+	log.FromContext(ctx).Info("Shard Lease lapsed, giving up namespaces", "shard", s.opts.Identity,
+		"lostNamespaces", len(lost))
+	deliver(ctx, s.lost, lost)
+	return nil
+}
+
+// deliver sends events to ch in the background: delivery waits for the Ingress
+// controller, which must not hold up the renewal of the Lease.
+func deliver(ctx context.Context, ch chan<- event.GenericEvent, events []event.GenericEvent) {
+	if len(events) == 0 {
+		return
+	}
+	go func() {
+		for _, e := range events {
+			select {
+			case ch <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// release deletes the Lease of this replica.
+func (s *Shard) release(ctx context.Context) error {
+	lease := &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{
+		Namespace: s.opts.Namespace,
+		Name:      s.leaseKey().Name,
+	}}
+	return client.IgnoreNotFound(s.client.Delete(ctx, lease))
+}
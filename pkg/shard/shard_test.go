@@ -0,0 +1,244 @@
+package shard
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jmnote/tester/testcase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	"github.com/kuoss/ingress-annotator/pkg/testutil/fakeclient"
+)
+
+var now = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newLease(identity string, renewed time.Time) *coordinationv1.Lease {
+	seconds := int32(15)
+	renewTime := metav1.NewMicroTime(renewed)
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "annotator",
+			Name:      LeasePrefix + identity,
+			Labels:    map[string]string{MemberLabel: "true"},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       &identity,
+			LeaseDurationSeconds: &seconds,
+			RenewTime:            &renewTime,
+		},
+	}
+}
+
+// cachedClient stands for the manager client, whose cache holds no Leases:
+// reading them through it fails, as the manager may only read the Leases of
+// its own namespace.
+type cachedClient struct {
+	client.Client
+}
+
+func (c cachedClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	if _, ok := obj.(*coordinationv1.Lease); ok {
+		return errors.New("mocked Lease informer error")
+	}
+	return c.Client.Get(ctx, key, obj, opts...)
+}
+
+func (c cachedClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if _, ok := list.(*coordinationv1.LeaseList); ok {
+		return errors.New("mocked Lease informer error")
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func newShard(c client.Client, identity string) *Shard {
+	s := New(cachedClient{c}, c, Options{Namespace: "annotator", Identity: identity, LeaseDuration: 15 * time.Second})
+	s.now = func() time.Time { return now }
+	s.renewed = now
+	return s
+}
+
+func TestShard_Nil(t *testing.T) {
+	var s *Shard
+	assert.True(t, s.Owns("default"))
+	assert.Nil(t, s.Members())
+}
+
+func TestShard_sync(t *testing.T) {
+	testCases := []struct {
+		objects     []client.Object
+		clientOpts  *fakeclient.ClientOpts
+		wantMembers []string
+		wantError   string
+	}{
+		{
+			wantMembers: []string{"pod-0"},
+		},
+		{
+			objects:     []client.Object{newLease("pod-0", now.Add(-time.Hour))},
+			wantMembers: []string{"pod-0"},
+		},
+		{
+			objects:     []client.Object{newLease("pod-1", now.Add(-5*time.Second))},
+			wantMembers: []string{"pod-0", "pod-1"},
+		},
+		{
+			objects:     []client.Object{newLease("pod-1", now.Add(-20*time.Second))},
+			wantMembers: []string{"pod-0"},
+		},
+		{
+			clientOpts:  &fakeclient.ClientOpts{GetError: "*"},
+			wantMembers: nil,
+			wantError:   "failed to get shard Lease: mocked GetError",
+		},
+		{
+			clientOpts:  &fakeclient.ClientOpts{ListError: true},
+			wantMembers: nil,
+			wantError:   "failed to list shard Leases: mocked ListError",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i), func(t *testing.T) {
+			c := fakeclient.NewClient(tc.clientOpts, tc.objects...)
+			s := newShard(c, "pod-0")
+			err := s.sync(context.TODO())
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.wantMembers, s.Members())
+			if tc.wantError != "" {
+				return
+			}
+
+			var lease coordinationv1.Lease
+			require.NoError(t, c.Get(context.TODO(), s.leaseKey(), &lease))
+			assert.Equal(t, "pod-0", *lease.Spec.HolderIdentity)
+			assert.True(t, lease.Spec.RenewTime.Time.Equal(now))
+		})
+	}
+}
+
+func TestShard_rebalance(t *testing.T) {
+	var namespaces []client.Object
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+	c := fakeclient.NewClient(nil, namespaces...)
+	s := newShard(c, "pod-0")
+
+	// Alone, the replica gains every Namespace.
+	require.NoError(t, s.rebalance(context.TODO(), NewRing([]string{"pod-0"})))
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d", "e", "f", "g", "h"}, receive(t, s.Gained(), 8))
+
+	// Nothing is gained when the members are the same.
+	require.NoError(t, s.rebalance(context.TODO(), NewRing([]string{"pod-0"})))
+	assert.Empty(t, receive(t, s.Gained(), 0))
+
+	// A second replica takes some Namespaces over.
+	ring := NewRing([]string{"pod-0", "pod-1"})
+	require.NoError(t, s.rebalance(context.TODO(), ring))
+	assert.Empty(t, receive(t, s.Gained(), 0))
+	var owned []string
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		assert.Equal(t, ring.Owner(name) == "pod-0", s.Owns(name), name)
+		if s.Owns(name) {
+			owned = append(owned, name)
+		}
+	}
+	assert.NotEmpty(t, owned)
+	assert.Less(t, len(owned), 8)
+	lost := receive(t, s.Lost(), 8-len(owned))
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d", "e", "f", "g", "h"}, append(lost, owned...))
+
+	// Once it leaves, its Namespaces come back.
+	require.NoError(t, s.rebalance(context.TODO(), NewRing([]string{"pod-0"})))
+	assert.ElementsMatch(t, lost, receive(t, s.Gained(), len(lost)))
+	assert.Empty(t, receive(t, s.Lost(), 0))
+}
+
+func TestShard_sync_Lapsed(t *testing.T) {
+	var namespaces []client.Object
+	for _, name := range []string{"a", "b", "c"} {
+		namespaces = append(namespaces, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+	c := fakeclient.NewClient(nil, namespaces...)
+	s := newShard(c, "pod-0")
+	require.NoError(t, s.sync(context.TODO()))
+	assert.Len(t, receive(t, s.Gained(), 3), 3)
+
+	// The Lease cannot be renewed, but has not lapsed yet.
+	s.reader = cachedClient{c}
+	s.now = func() time.Time { return now.Add(10 * time.Second) }
+	assert.EqualError(t, s.sync(context.TODO()), "failed to get shard Lease: mocked Lease informer error")
+	assert.True(t, s.Owns("a"))
+	assert.Empty(t, receive(t, s.Lost(), 0))
+
+	// Once it lapsed, the Namespaces are no longer owned, and are given up.
+	s.now = func() time.Time { return now.Add(20 * time.Second) }
+	assert.False(t, s.Owns("a"))
+	assert.EqualError(t, s.sync(context.TODO()), "failed to get shard Lease: mocked Lease informer error")
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, receive(t, s.Lost(), 3))
+	assert.Nil(t, s.Members())
+	assert.EqualError(t, s.sync(context.TODO()), "failed to get shard Lease: mocked Lease informer error")
+	assert.Empty(t, receive(t, s.Lost(), 0))
+
+	// Once renewed, the Namespaces are taken back.
+	s.reader = c
+	require.NoError(t, s.sync(context.TODO()))
+	assert.True(t, s.Owns("a"))
+	assert.ElementsMatch(t, []string{"a", "b", "c"}, receive(t, s.Gained(), 3))
+}
+
+func TestShard_Start(t *testing.T) {
+	c := fakeclient.NewClient(nil)
+	s := New(cachedClient{c}, c, Options{Namespace: "annotator", Identity: "pod-0", LeaseDuration: 30 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Start(ctx) }()
+
+	require.Eventually(t, func() bool { return s.Owns("default") }, time.Second, 5*time.Millisecond)
+	var lease coordinationv1.Lease
+	require.NoError(t, c.Get(context.TODO(), s.leaseKey(), &lease))
+
+	cancel()
+	require.NoError(t, <-done)
+	err := c.Get(context.TODO(), s.leaseKey(), &lease)
+	assert.True(t, apierrors.IsNotFound(err), "the Lease is released")
+}
+
+// receive returns the names of the n Namespaces delivered to ch, and fails if
+// more are delivered.
+func receive(t *testing.T, ch <-chan event.GenericEvent, n int) []string {
+	t.Helper()
+	var names []string
+	for i := 0; i < n; i++ {
+		select {
+		case e := <-ch:
+			names = append(names, e.Object.GetName())
+		case <-time.After(time.Second):
+			t.Fatalf("received %d of %d Namespaces", i, n)
+		}
+	}
+	select {
+	case e := <-ch:
+		t.Fatalf("unexpected Namespace %s", e.Object.GetName())
+	case <-time.After(10 * time.Millisecond):
+	}
+	return names
+}
+
+func TestNewFixed(t *testing.T) {
+	assert.True(t, NewFixed("pod-0", "pod-0").Owns("default"))
+	assert.False(t, NewFixed("pod-0", "pod-1").Owns("default"))
+	assert.Equal(t, []string{"pod-0", "pod-1"}, NewFixed("pod-0", "pod-1", "pod-0").Members())
+}
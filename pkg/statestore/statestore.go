@@ -0,0 +1,177 @@
+package statestore
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kuoss/ingress-annotator/pkg/model"
+	"github.com/kuoss/ingress-annotator/pkg/util"
+)
+
+const (
+	TypeAnnotation = "annotation"
+	TypeConfigMap  = "configmap"
+
+	// ConfigMapName is the name of the per-namespace ConfigMap used by ConfigMapStateStore.
+	ConfigMapName = "ingress-annotator-state"
+)
+
+// IStateStore keeps the managed state of Ingresses.
+//
+// Save may modify the annotations of the given Ingress; the caller is
+// responsible for persisting the Ingress afterwards.
+type IStateStore interface {
+	Load(ctx context.Context, ing *networkingv1.Ingress) (*model.ManagedState, error)
+	Save(ctx context.Context, ing *networkingv1.Ingress, state *model.ManagedState) error
+	Delete(ctx context.Context, nn types.NamespacedName) error
+}
+
+func New(storeType string, c client.Client) (IStateStore, error) {
+	switch storeType {
+	case TypeAnnotation:
+		return &AnnotationStateStore{}, nil
+	case TypeConfigMap:
+		return &ConfigMapStateStore{Client: c}, nil
+	}
+	return nil, fmt.Errorf("invalid state store %q: must be one of %s, %s", storeType, TypeAnnotation, TypeConfigMap)
+}
+
+// AnnotationStateStore keeps the managed state in the managed-annotations
+// annotation of the Ingress itself.
+type AnnotationStateStore struct{}
+
+func (s *AnnotationStateStore) Load(ctx context.Context, ing *networkingv1.Ingress) (*model.ManagedState, error) {
+	return stateFromAnnotations(ctx, ing.Annotations), nil
+}
+
+func (s *AnnotationStateStore) Save(_ context.Context, ing *networkingv1.Ingress, state *model.ManagedState) error {
+	removeStateAnnotations(ing)
+	if state.IsEmpty() {
+		return nil
+	}
+	if ing.Annotations == nil {
+		ing.Annotations = make(map[string]string)
+	}
+	ing.Annotations[model.ManagedAnnotationsKey] = string(util.MustMarshalJSON(state)) + "\n"
+	return nil
+}
+
+func (s *AnnotationStateStore) Delete(context.Context, types.NamespacedName) error {
+	return nil
+}
+
+// ConfigMapStateStore keeps the managed state of all Ingresses of a namespace
+// in a ConfigMap of that namespace, keyed by Ingress name. State still found
+// in Ingress annotations is read as a fallback and removed on the next Save.
+type ConfigMapStateStore struct {
+	client.Client
+}
+
+func (s *ConfigMapStateStore) Load(ctx context.Context, ing *networkingv1.Ingress) (*model.ManagedState, error) {
+	var cm corev1.ConfigMap
+	if err := s.Get(ctx, client.ObjectKey{Namespace: ing.Namespace, Name: ConfigMapName}, &cm); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to get state ConfigMap: %w", err)
+		}
+	}
+	value, ok := cm.Data[ing.Name]
+	if !ok {
+		return stateFromAnnotations(ctx, ing.Annotations), nil
+	}
+	return unmarshalState(ctx, value), nil
+}
+
+func (s *ConfigMapStateStore) Save(ctx context.Context, ing *networkingv1.Ingress, state *model.ManagedState) error {
+	removeStateAnnotations(ing)
+	value := ""
+	if !state.IsEmpty() {
+		value = string(util.MustMarshalJSON(state))
+	}
+	return s.setEntry(ctx, types.NamespacedName{Namespace: ing.Namespace, Name: ing.Name}, value)
+}
+
+func (s *ConfigMapStateStore) Delete(ctx context.Context, nn types.NamespacedName) error {
+	return s.setEntry(ctx, nn, "")
+}
+
+// setEntry writes the value for the Ingress, removing the entry when value is
+// empty. The ConfigMap is deleted once it has no entries left.
+//
+// Workers writing to the same namespace race to create, update and delete
+// the ConfigMap; the loser reads it again and retries, with a backoff that
+// leaves time for the cache to catch up.
+func (s *ConfigMapStateStore) setEntry(ctx context.Context, nn types.NamespacedName, value string) error {
+	return retry.OnError(retry.DefaultBackoff, isRace, func() error {
+		var cm corev1.ConfigMap
+		err := s.Get(ctx, client.ObjectKey{Namespace: nn.Namespace, Name: ConfigMapName}, &cm)
+		if apierrors.IsNotFound(err) {
+			if value == "" {
+				return nil
+			}
+			cm = corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: nn.Namespace, Name: ConfigMapName},
+				Data:       map[string]string{nn.Name: value},
+			}
+			return s.Create(ctx, &cm)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get state ConfigMap: %w", err)
+		}
+
+		current, exists := cm.Data[nn.Name]
+		if (value == "" && !exists) || (exists && current == value) {
+			return nil
+		}
+		if value == "" {
+			delete(cm.Data, nn.Name)
+			if len(cm.Data) == 0 {
+				return client.IgnoreNotFound(s.Client.Delete(ctx, &cm))
+			}
+		} else {
+			if cm.Data == nil {
+				cm.Data = make(map[string]string)
+			}
+			cm.Data[nn.Name] = value
+		}
+		return s.Update(ctx, &cm)
+	})
+}
+
+func removeStateAnnotations(ing *networkingv1.Ingress) {
+	delete(ing.Annotations, model.ManagedAnnotationsKey)
+}
+
+// stateFromAnnotations reads the managed state kept in Ingress annotations,
+// migrating older formats.
+func stateFromAnnotations(ctx context.Context, annotations map[string]string) *model.ManagedState {
+	if value, ok := annotations[model.ManagedAnnotationsKey]; ok && value != "" {
+		return unmarshalState(ctx, value)
+	}
+	return model.NewManagedState()
+}
+
+// unmarshalState parses a managed state, falling back to an empty state so
+// that a corrupted record does not block reconciliation.
+func unmarshalState(ctx context.Context, value string) *model.ManagedState {
+	state, err := model.UnmarshalManagedState(value)
+	if err != nil {
+		ctrl.LoggerFrom(ctx).Error(err, "Warning: Failed to unmarshal managed annotations")
+		return model.NewManagedState()
+	}
+	return state
+}
+
+// isRace reports whether err comes from another writer changing the state
+// ConfigMap since it was read.
+func isRace(err error) bool {
+	return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) || apierrors.IsNotFound(err)
+}
@@ -0,0 +1,212 @@
+package statestore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/jmnote/tester/testcase"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/kuoss/ingress-annotator/pkg/model"
+	"github.com/kuoss/ingress-annotator/pkg/testutil/fakeclient"
+)
+
+func newState() *model.ManagedState {
+	state := model.NewManagedState()
+	state.Annotations["key1"] = model.ManagedAnnotation{Value: "value1", Rule: "rule1", Source: model.SourceIngress, Generation: "gen1"}
+	return state
+}
+
+const stateJSON = `{"version":2,"annotations":{"key1":{"value":"value1","rule":"rule1","source":"ingress","generation":"gen1"}}}`
+
+func TestNew(t *testing.T) {
+	testCases := []struct {
+		storeType string
+		want      IStateStore
+		wantError string
+	}{
+		{TypeAnnotation, &AnnotationStateStore{}, ""},
+		{TypeConfigMap, &ConfigMapStateStore{}, ""},
+		{"xxx", nil, `invalid state store "xxx": must be one of annotation, configmap`},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.storeType), func(t *testing.T) {
+			got, err := New(tc.storeType, nil)
+			if tc.wantError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.wantError)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestAnnotationStateStore(t *testing.T) {
+	ctx := context.Background()
+	store := &AnnotationStateStore{}
+	ing := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default",
+		Name:      "my-ingress",
+		Annotations: map[string]string{
+			model.ManagedAnnotationsKey: `{"key1":"value1"}`,
+		},
+	}}
+
+	state, err := store.Load(ctx, ing)
+	assert.NoError(t, err)
+	assert.Equal(t, model.ManagedAnnotation{Value: "value1"}, state.Annotations["key1"])
+	assert.Empty(t, state.Originals)
+
+	err = store.Save(ctx, ing, newState())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{model.ManagedAnnotationsKey: stateJSON + "\n"}, ing.Annotations)
+
+	err = store.Save(ctx, ing, model.NewManagedState())
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{}, ing.Annotations)
+
+	assert.NoError(t, store.Delete(ctx, types.NamespacedName{Namespace: "default", Name: "my-ingress"}))
+}
+
+func TestConfigMapStateStore_Load(t *testing.T) {
+	testCases := []struct {
+		name        string
+		cm          *corev1.ConfigMap
+		annotations map[string]string
+		clientOpts  *fakeclient.ClientOpts
+		want        *model.ManagedState
+		wantError   string
+	}{
+		{
+			name: "entry in ConfigMap",
+			cm: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: ConfigMapName},
+				Data:       map[string]string{"my-ingress": stateJSON},
+			},
+			want: newState(),
+		},
+		{
+			name:        "fallback to Ingress annotation",
+			annotations: map[string]string{model.ManagedAnnotationsKey: stateJSON},
+			want:        newState(),
+		},
+		{
+			name: "invalid entry",
+			cm: &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: ConfigMapName},
+				Data:       map[string]string{"my-ingress": "invalid-json"},
+			},
+			want: model.NewManagedState(),
+		},
+		{
+			name:       "get error",
+			clientOpts: &fakeclient.ClientOpts{GetError: "ConfigMap"},
+			wantError:  "failed to get state ConfigMap: mocked GetError ConfigMap",
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			store := &ConfigMapStateStore{Client: fakeclient.NewClient(tc.clientOpts, tc.cm)}
+			ing := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "my-ingress", Annotations: tc.annotations}}
+
+			got, err := store.Load(context.Background(), ing)
+			if tc.wantError == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.wantError)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestConfigMapStateStore_SaveAndDelete(t *testing.T) {
+	ctx := context.Background()
+	c := fakeclient.NewClient(nil)
+	store := &ConfigMapStateStore{Client: c}
+	key := client.ObjectKey{Namespace: "default", Name: ConfigMapName}
+	ing1 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "default",
+		Name:        "ingress1",
+		Annotations: map[string]string{model.ManagedAnnotationsKey: `{"key1":"value1"}`},
+	}}
+	ing2 := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ingress2"}}
+
+	// Saving an empty state does not create the ConfigMap.
+	assert.NoError(t, store.Save(ctx, ing2, model.NewManagedState()))
+	assert.Error(t, c.Get(ctx, key, &corev1.ConfigMap{}))
+
+	// Saving moves the state out of the Ingress.
+	assert.NoError(t, store.Save(ctx, ing1, newState()))
+	assert.NoError(t, store.Save(ctx, ing2, newState()))
+	assert.Empty(t, ing1.Annotations)
+
+	var cm corev1.ConfigMap
+	assert.NoError(t, c.Get(ctx, key, &cm))
+	assert.Equal(t, map[string]string{"ingress1": stateJSON, "ingress2": stateJSON}, cm.Data)
+
+	// Saving an empty state and deleting remove entries, then the ConfigMap.
+	assert.NoError(t, store.Save(ctx, ing1, model.NewManagedState()))
+	assert.NoError(t, store.Delete(ctx, types.NamespacedName{Namespace: "default", Name: "ingress2"}))
+	assert.NoError(t, store.Delete(ctx, types.NamespacedName{Namespace: "default", Name: "ingress2"}))
+	assert.True(t, apierrors.IsNotFound(c.Get(ctx, key, &cm)))
+}
+
+// barrierClient holds the first Get of each of n writers until all of them
+// made it, so that they all find the ConfigMap missing and race to create it.
+type barrierClient struct {
+	client.Client
+	n       int32
+	gets    atomic.Int32
+	barrier sync.WaitGroup
+}
+
+func (c *barrierClient) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	err := c.Client.Get(ctx, key, obj, opts...)
+	if c.gets.Add(1) <= c.n {
+		c.barrier.Done()
+		c.barrier.Wait()
+	}
+	return err
+}
+
+func TestConfigMapStateStore_ConcurrentSave(t *testing.T) {
+	ctx := context.Background()
+	const writers = 4
+	c := &barrierClient{Client: fakeclient.NewClient(nil), n: writers}
+	c.barrier.Add(writers)
+	store := &ConfigMapStateStore{Client: c}
+
+	var wg sync.WaitGroup
+	errs := make([]error, writers)
+	want := make(map[string]string)
+	for i := 0; i < writers; i++ {
+		name := fmt.Sprintf("ingress%d", i)
+		want[name] = stateJSON
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ing := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+			errs[i] = store.Save(ctx, ing, newState())
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+
+	var cm corev1.ConfigMap
+	require.NoError(t, c.Get(ctx, client.ObjectKey{Namespace: "default", Name: ConfigMapName}, &cm))
+	assert.Equal(t, want, cm.Data)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"reflect"
 
+	coordinationv1 "k8s.io/api/coordination/v1"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
@@ -18,12 +19,16 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+
+	"github.com/kuoss/ingress-annotator/api/v1alpha1"
 )
 
 func NewScheme() *runtime.Scheme {
 	scheme := runtime.NewScheme()
+	_ = coordinationv1.AddToScheme(scheme)
 	_ = corev1.AddToScheme(scheme)
 	_ = networkingv1.AddToScheme(scheme)
+	_ = v1alpha1.AddToScheme(scheme)
 	return scheme
 }
 
@@ -48,6 +53,7 @@ func NewClient(opts *ClientOpts, objs ...client.Object) client.Client {
 		WithScheme(NewScheme()).
 		WithInterceptorFuncs(interceptorFuncs).
 		WithObjects(nonNilObjs...).
+		WithStatusSubresource(&v1alpha1.AnnotatorStatus{}).
 		Build()
 }
 
@@ -15,7 +15,6 @@ import (
 	model "github.com/kuoss/ingress-annotator/pkg/model"
 	gomock "go.uber.org/mock/gomock"
 	v1 "k8s.io/api/core/v1"
-	client "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 // MockIRulesStore is a mock of IRulesStore interface.
@@ -41,23 +40,32 @@ func (m *MockIRulesStore) EXPECT() *MockIRulesStoreMockRecorder {
 	return m.recorder
 }
 
-// ExtractRulesFromAnnotations mocks base method.
-func (m *MockIRulesStore) ExtractRulesFromAnnotations(objs ...client.Object) ([]string, error) {
+// GetGeneration mocks base method.
+func (m *MockIRulesStore) GetGeneration() string {
 	m.ctrl.T.Helper()
-	varargs := []any{}
-	for _, a := range objs {
-		varargs = append(varargs, a)
-	}
-	ret := m.ctrl.Call(m, "ExtractRulesFromAnnotations", varargs...)
-	ret0, _ := ret[0].([]string)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
-}
-
-// ExtractRulesFromAnnotations indicates an expected call of ExtractRulesFromAnnotations.
-func (mr *MockIRulesStoreMockRecorder) ExtractRulesFromAnnotations(objs ...any) *gomock.Call {
+	ret := m.ctrl.Call(m, "GetGeneration")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// GetGeneration indicates an expected call of GetGeneration.
+func (mr *MockIRulesStoreMockRecorder) GetGeneration() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetGeneration", reflect.TypeOf((*MockIRulesStore)(nil).GetGeneration))
+}
+
+// GetRolledBackGeneration mocks base method.
+func (m *MockIRulesStore) GetRolledBackGeneration() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetRolledBackGeneration")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// GetRolledBackGeneration indicates an expected call of GetRolledBackGeneration.
+func (mr *MockIRulesStoreMockRecorder) GetRolledBackGeneration() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExtractRulesFromAnnotations", reflect.TypeOf((*MockIRulesStore)(nil).ExtractRulesFromAnnotations), objs...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRolledBackGeneration", reflect.TypeOf((*MockIRulesStore)(nil).GetRolledBackGeneration))
 }
 
 // GetRules mocks base method.
@@ -74,6 +82,128 @@ func (mr *MockIRulesStoreMockRecorder) GetRules() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetRules", reflect.TypeOf((*MockIRulesStore)(nil).GetRules))
 }
 
+// GetStagedGeneration mocks base method.
+func (m *MockIRulesStore) GetStagedGeneration() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetStagedGeneration")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// GetStagedGeneration indicates an expected call of GetStagedGeneration.
+func (mr *MockIRulesStoreMockRecorder) GetStagedGeneration() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetStagedGeneration", reflect.TypeOf((*MockIRulesStore)(nil).GetStagedGeneration))
+}
+
+// GetStagedRules mocks base method.
+func (m *MockIRulesStore) GetStagedRules() *model.Rules {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetStagedRules")
+	ret0, _ := ret[0].(*model.Rules)
+	return ret0
+}
+
+// GetStagedRules indicates an expected call of GetStagedRules.
+func (mr *MockIRulesStoreMockRecorder) GetStagedRules() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetStagedRules", reflect.TypeOf((*MockIRulesStore)(nil).GetStagedRules))
+}
+
+// IsCleanupEnabled mocks base method.
+func (m *MockIRulesStore) IsCleanupEnabled() bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IsCleanupEnabled")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// IsCleanupEnabled indicates an expected call of IsCleanupEnabled.
+func (mr *MockIRulesStoreMockRecorder) IsCleanupEnabled() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsCleanupEnabled", reflect.TypeOf((*MockIRulesStore)(nil).IsCleanupEnabled))
+}
+
+// IsPauseRequested mocks base method.
+func (m *MockIRulesStore) IsPauseRequested() bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IsPauseRequested")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// IsPauseRequested indicates an expected call of IsPauseRequested.
+func (mr *MockIRulesStoreMockRecorder) IsPauseRequested() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsPauseRequested", reflect.TypeOf((*MockIRulesStore)(nil).IsPauseRequested))
+}
+
+// IsPaused mocks base method.
+func (m *MockIRulesStore) IsPaused() bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "IsPaused")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// IsPaused indicates an expected call of IsPaused.
+func (mr *MockIRulesStoreMockRecorder) IsPaused() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsPaused", reflect.TypeOf((*MockIRulesStore)(nil).IsPaused))
+}
+
+// LastReadError mocks base method.
+func (m *MockIRulesStore) LastReadError() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "LastReadError")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// LastReadError indicates an expected call of LastReadError.
+func (mr *MockIRulesStoreMockRecorder) LastReadError() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "LastReadError", reflect.TypeOf((*MockIRulesStore)(nil).LastReadError))
+}
+
+// MarkMissing mocks base method.
+func (m *MockIRulesStore) MarkMissing(policy model.MissingPolicy) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "MarkMissing", policy)
+}
+
+// MarkMissing indicates an expected call of MarkMissing.
+func (mr *MockIRulesStoreMockRecorder) MarkMissing(policy any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkMissing", reflect.TypeOf((*MockIRulesStore)(nil).MarkMissing), policy)
+}
+
+// MarkReadError mocks base method.
+func (m *MockIRulesStore) MarkReadError(err error) {
+	m.ctrl.T.Helper()
+	m.ctrl.Call(m, "MarkReadError", err)
+}
+
+// MarkReadError indicates an expected call of MarkReadError.
+func (mr *MockIRulesStoreMockRecorder) MarkReadError(err any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MarkReadError", reflect.TypeOf((*MockIRulesStore)(nil).MarkReadError), err)
+}
+
+// Rollback mocks base method.
+func (m *MockIRulesStore) Rollback() bool {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Rollback")
+	ret0, _ := ret[0].(bool)
+	return ret0
+}
+
+// Rollback indicates an expected call of Rollback.
+func (mr *MockIRulesStoreMockRecorder) Rollback() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Rollback", reflect.TypeOf((*MockIRulesStore)(nil).Rollback))
+}
+
 // UpdateRules mocks base method.
 func (m *MockIRulesStore) UpdateRules(cm *v1.ConfigMap) error {
 	m.ctrl.T.Helper()
@@ -0,0 +1,36 @@
+package mocks
+
+import (
+	"go.uber.org/mock/gomock"
+
+	"github.com/kuoss/ingress-annotator/pkg/model"
+)
+
+// RulesStoreOpts configures the mock rules store returned by NewRulesStore.
+type RulesStoreOpts struct {
+	// Rules default to rule1 setting new-key to new-value.
+	Rules            *model.Rules
+	Cleanup          bool
+	Paused           bool
+	PauseRequested   bool
+	ReadError        error
+	RolledBack       string
+	StagedGeneration string
+}
+
+// NewRulesStore returns a mock rules store holding opts.Rules at generation gen1.
+func NewRulesStore(mockCtrl *gomock.Controller, opts RulesStoreOpts) *MockIRulesStore {
+	if opts.Rules == nil {
+		opts.Rules = &model.Rules{"rule1": {"new-key": "new-value"}}
+	}
+	store := NewMockIRulesStore(mockCtrl)
+	store.EXPECT().GetRules().Return(opts.Rules).AnyTimes()
+	store.EXPECT().GetGeneration().Return("gen1").AnyTimes()
+	store.EXPECT().IsCleanupEnabled().Return(opts.Cleanup).AnyTimes()
+	store.EXPECT().IsPaused().Return(opts.Paused).AnyTimes()
+	store.EXPECT().IsPauseRequested().Return(opts.PauseRequested).AnyTimes()
+	store.EXPECT().LastReadError().Return(opts.ReadError).AnyTimes()
+	store.EXPECT().GetRolledBackGeneration().Return(opts.RolledBack).AnyTimes()
+	store.EXPECT().GetStagedGeneration().Return(opts.StagedGeneration).AnyTimes()
+	return store
+}
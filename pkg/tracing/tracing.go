@@ -0,0 +1,96 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	TracerName  = "github.com/kuoss/ingress-annotator"
+	ServiceName = "ingress-annotator"
+)
+
+// Attribute keys recorded on spans.
+const (
+	AttrRulesGeneration = attribute.Key("ingress_annotator.rules.generation")
+	AttrRuleNames       = attribute.Key("ingress_annotator.rules.names")
+	AttrNamespace       = attribute.Key("k8s.namespace.name")
+	AttrIngress         = attribute.Key("k8s.ingress.name")
+)
+
+// Options configures the OTLP exporter. Tracing is off unless Endpoint or one
+// of the OTEL_EXPORTER_OTLP_ENDPOINT and OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+// environment variables is set.
+type Options struct {
+	Endpoint    string
+	Insecure    bool
+	SampleRatio float64
+}
+
+// Setup installs a global TracerProvider exporting spans over OTLP/gRPC and
+// returns a function that flushes and stops it. Other exporter settings, such
+// as headers and certificates, are read from the standard OTEL_EXPORTER_OTLP_*
+// environment variables.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	if !opts.enabled() {
+		return func(context.Context) error { return nil }, nil
+	}
+	if opts.SampleRatio < 0 || opts.SampleRatio > 1 {
+		return nil, fmt.Errorf("invalid trace sample ratio %v: must be between 0 and 1", opts.SampleRatio)
+	}
+
+	var clientOpts []otlptracegrpc.Option
+	if opts.Endpoint != "" {
+		clientOpts = append(clientOpts, otlptracegrpc.WithEndpoint(opts.Endpoint))
+	}
+	if opts.Insecure {
+		clientOpts = append(clientOpts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, clientOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(ServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func (o Options) enabled() bool {
+	return o.Endpoint != "" || os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Start starts a span with the global TracerProvider, which is a no-op unless
+// Setup has installed an exporter.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(TracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err, if any, on span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// IngressAttributes returns the attributes identifying an Ingress.
+func IngressAttributes(nn types.NamespacedName) []attribute.KeyValue {
+	return []attribute.KeyValue{AttrNamespace.String(nn.Namespace), AttrIngress.String(nn.Name)}
+}
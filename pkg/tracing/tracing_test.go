@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jmnote/tester/testcase"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func setupInMemory(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return exporter
+}
+
+func TestSetup(t *testing.T) {
+	testCases := []struct {
+		name      string
+		opts      Options
+		env       string
+		wantError string
+	}{
+		{
+			name: "Off by default",
+			opts: Options{SampleRatio: 1},
+		},
+		{
+			name:      "Invalid sample ratio",
+			opts:      Options{Endpoint: "localhost:4317", SampleRatio: 2},
+			wantError: "invalid trace sample ratio 2: must be between 0 and 1",
+		},
+		{
+			name:      "Invalid sample ratio with endpoint from environment",
+			opts:      Options{SampleRatio: -1},
+			env:       "http://localhost:4317",
+			wantError: "invalid trace sample ratio -1: must be between 0 and 1",
+		},
+		{
+			name: "Endpoint set",
+			opts: Options{Endpoint: "localhost:4317", Insecure: true, SampleRatio: 1},
+		},
+	}
+	for i, tc := range testCases {
+		t.Run(testcase.Name(i, tc.name), func(t *testing.T) {
+			t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", tc.env)
+			previous := otel.GetTracerProvider()
+			defer otel.SetTracerProvider(previous)
+
+			shutdown, err := Setup(context.Background(), tc.opts)
+			if tc.wantError != "" {
+				assert.EqualError(t, err, tc.wantError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NoError(t, shutdown(context.Background()))
+		})
+	}
+}
+
+func TestEnd(t *testing.T) {
+	exporter := setupInMemory(t)
+
+	_, span := Start(context.Background(), "ok", AttrRulesGeneration.String("gen1"))
+	End(span, nil)
+	_, span = Start(context.Background(), "failed")
+	End(span, errors.New("mocked error"))
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "ok", spans[0].Name)
+	assert.Equal(t, codes.Unset, spans[0].Status.Code)
+	assert.Contains(t, spans[0].Attributes, AttrRulesGeneration.String("gen1"))
+	assert.Equal(t, "failed", spans[1].Name)
+	assert.Equal(t, codes.Error, spans[1].Status.Code)
+	assert.Equal(t, "mocked error", spans[1].Status.Description)
+}
@@ -0,0 +1,76 @@
+package trigger
+
+import (
+	"context"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/kuoss/ingress-annotator/pkg/audit"
+)
+
+// Trigger is what caused the reconcile of an Ingress.
+type Trigger struct {
+	// Cause is recorded in the audit log.
+	Cause audit.Trigger
+	// SpanContext is the parent of the span of the reconcile, if valid.
+	SpanContext trace.SpanContext
+}
+
+// Triggers remembers the trigger of the next reconcile of each Ingress.
+// Ingress reconciles are triggered through an annotation on the Ingress, so
+// their trigger cannot be passed along in a context. A nil Triggers
+// remembers nothing.
+type Triggers struct {
+	mutex   sync.Mutex
+	pending map[types.NamespacedName]Trigger
+}
+
+func New() *Triggers {
+	return &Triggers{pending: make(map[types.NamespacedName]Trigger)}
+}
+
+// Set records cause, and the span in ctx, as the trigger of the next
+// reconcile of nn.
+func (t *Triggers) Set(ctx context.Context, nn types.NamespacedName, cause audit.Trigger) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.pending[nn] = Trigger{Cause: cause, SpanContext: trace.SpanContextFromContext(ctx)}
+}
+
+// Get returns the trigger of the reconcile of nn; without a remembered
+// trigger, the Ingress itself was edited.
+func (t *Triggers) Get(nn types.NamespacedName) Trigger {
+	if t == nil {
+		return Trigger{Cause: audit.TriggerIngress}
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if trigger, ok := t.pending[nn]; ok {
+		return trigger
+	}
+	return Trigger{Cause: audit.TriggerIngress}
+}
+
+// Context returns ctx with the span that triggered the reconcile of nn, if
+// any, as parent.
+func (t *Triggers) Context(ctx context.Context, nn types.NamespacedName) context.Context {
+	if spanContext := t.Get(nn).SpanContext; spanContext.IsValid() {
+		return trace.ContextWithSpanContext(ctx, spanContext)
+	}
+	return ctx
+}
+
+// Forget drops the trigger remembered for nn once its reconcile is done.
+func (t *Triggers) Forget(nn types.NamespacedName) {
+	if t == nil {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.pending, nn)
+}
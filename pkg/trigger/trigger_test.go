@@ -0,0 +1,59 @@
+package trigger
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/kuoss/ingress-annotator/pkg/audit"
+	"github.com/kuoss/ingress-annotator/pkg/tracing"
+)
+
+func TestTriggers(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(previous)
+
+	triggers := New()
+	nn := types.NamespacedName{Namespace: "default", Name: "my-ingress"}
+	assert.Equal(t, audit.TriggerIngress, triggers.Get(nn).Cause)
+
+	// The cause is remembered without a recording span.
+	triggers.Set(context.Background(), nn, audit.TriggerNamespace)
+	assert.Equal(t, audit.TriggerNamespace, triggers.Get(nn).Cause)
+	_, span := tracing.Start(triggers.Context(context.Background(), nn), "untriggered")
+	tracing.End(span, nil)
+
+	ctx, parent := tracing.Start(context.Background(), "Enqueue Ingress")
+	triggers.Set(ctx, nn, audit.TriggerConfigMap)
+	tracing.End(parent, nil)
+	assert.Equal(t, audit.TriggerConfigMap, triggers.Get(nn).Cause)
+	_, span = tracing.Start(triggers.Context(context.Background(), nn), "triggered")
+	tracing.End(span, nil)
+
+	triggers.Forget(nn)
+	assert.Equal(t, audit.TriggerIngress, triggers.Get(nn).Cause)
+	_, span = tracing.Start(triggers.Context(context.Background(), nn), "forgotten")
+	tracing.End(span, nil)
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 4)
+	assert.False(t, spans[0].Parent.IsValid())
+	assert.Equal(t, spans[1].SpanContext.SpanID(), spans[2].Parent.SpanID())
+	assert.Equal(t, spans[1].SpanContext.TraceID(), spans[2].SpanContext.TraceID())
+	assert.False(t, spans[3].Parent.IsValid())
+}
+
+func TestTriggers_Nil(t *testing.T) {
+	var triggers *Triggers
+	nn := types.NamespacedName{Namespace: "default", Name: "my-ingress"}
+	triggers.Set(context.Background(), nn, audit.TriggerNamespace)
+	assert.Equal(t, audit.TriggerIngress, triggers.Get(nn).Cause)
+	triggers.Forget(nn)
+}